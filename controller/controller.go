@@ -3,6 +3,7 @@ package controller
 import (
 	"context"
 	"errors"
+	"fmt"
 	"pirosb3/real_feed/datasource"
 	"pirosb3/real_feed/feed"
 	"sync"
@@ -12,19 +13,54 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/shopspring/decimal"
 	log "github.com/sirupsen/logrus"
 )
 
-const ORDERBOOK_REPORT_TICKER_SECS = 2
-const CHANNEL_BUFFER_SIZE = 20
-const TS_LAYOUT = "2006-01-02T15:04:05.000000Z"
+const (
+	ORDERBOOK_REPORT_TICKER_SECS = 2
+	// HEALTH_EVENT_TIMEOUT is how long a market stays healthy without receiving any event,
+	// heartbeats included. Sources send a heartbeat every second while they are connected.
+	HEALTH_EVENT_TIMEOUT = 5 * time.Second
+	// TRADE_TAPE_RETENTION is how far back the trade tape of a market goes, and the longest window
+	// trade statistics can be computed over. At most TRADE_TAPE_MAX_TRADES are kept.
+	TRADE_TAPE_RETENTION  = time.Hour
+	TRADE_TAPE_MAX_TRADES = 100000
+	// MAX_CANDLES is how many closed candles of each interval are kept per market.
+	MAX_CANDLES = 1000
+	// CANDLE_CLOSE_DELAY is how long after the end of its interval a candle without further trades
+	// is closed, so that trades timestamped by the exchange just before the end are still included.
+	CANDLE_CLOSE_DELAY = 500 * time.Millisecond
+	// CANDLE_CLOSE_TICKER is how often candles are checked for closing.
+	CANDLE_CLOSE_TICKER = 100 * time.Millisecond
+	// CANDLE_LISTENER_BUFFER is how many closed candles a candle listener can fall behind before
+	// it misses some.
+	CANDLE_LISTENER_BUFFER = 64
+)
 
-func DateStringToUnixEpoch(timestamp string) (int64, error) {
-	t, err := time.Parse(TS_LAYOUT, timestamp)
-	if err != nil {
-		return -1, err
-	}
-	return int64(t.Unix()), nil
+// CANDLE_INTERVALS are the intervals candles are aggregated over for every market.
+var CANDLE_INTERVALS = []time.Duration{
+	time.Second,
+	time.Minute,
+	5 * time.Minute,
+	time.Hour,
+}
+
+// TRADE_STATS_WINDOWS are the rolling windows reported by the trade gauges and returned by
+// GetTradeStats when no window is requested.
+var TRADE_STATS_WINDOWS = []time.Duration{
+	time.Minute,
+	5 * time.Minute,
+	time.Hour,
+}
+
+// LIQUIDITY_CURVE_BPS are the distances from mid, in basis points, reported by the liquidity gauges
+// and returned by GetLiquidityCurve when no distance is requested.
+var LIQUIDITY_CURVE_BPS = []decimal.Decimal{
+	decimal.NewFromInt(10),
+	decimal.NewFromInt(25),
+	decimal.NewFromInt(50),
+	decimal.NewFromInt(100),
 }
 
 var (
@@ -38,37 +74,95 @@ var (
 		Help:      "Orderbook Depth",
 		Namespace: "feed",
 	}, []string{"uuid", "market", "side"})
+	liquiditySizeGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "liquiditySize",
+		Help:      "Base amount executable within distanceBps of mid",
+		Namespace: "feed",
+	}, []string{"uuid", "market", "side", "distanceBps"})
+	liquidityAveragePriceGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "liquidityAveragePrice",
+		Help:      "Average price of executing all the liquidity within distanceBps of mid",
+		Namespace: "feed",
+	}, []string{"uuid", "market", "side", "distanceBps"})
+	tradeVolumeCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "tradeVolume",
+		Help:      "Base volume traded, by taker side",
+		Namespace: "feed",
+	}, []string{"uuid", "market", "side"})
+	lastTradePriceGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "lastTradePrice",
+		Help:      "Price of the last trade",
+		Namespace: "feed",
+	}, []string{"uuid", "market"})
+	rollingVolumeGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "rollingVolume",
+		Help:      "Base volume traded within the rolling window",
+		Namespace: "feed",
+	}, []string{"uuid", "market", "window"})
+	rollingVWAPGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "rollingVWAP",
+		Help:      "Volume weighted average price of the trades within the rolling window",
+		Namespace: "feed",
+	}, []string{"uuid", "market", "window"})
+	droppedTradesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "droppedTrades",
+		Help:      "Counts trades dropped by the source, which are missing from the trade tape",
+		Namespace: "feed",
+	}, []string{"uuid", "market"})
+	resyncCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "resyncs",
+		Help:      "Counts how many times the orderbook was invalidated and a fresh snapshot requested",
+		Namespace: "feed",
+	}, []string{"uuid", "market", "reason"})
 )
 
 type FeedController struct {
-	orderbook *feed.OrderbookFeed
-	websocket *datasource.CoinbaseProWebsocket
-	ctx       context.Context
-	startLock sync.Mutex
-	stopFn    context.CancelFunc
-	started   bool
-	outChan   chan (map[string]interface{})
-	inChan    chan (interface{})
-	product   string
-	uuid      string
+	orderbook      *feed.OrderbookFeed
+	tape           *feed.TradeTape
+	candles        *feed.CandleAggregator
+	source         datasource.Source
+	ctx            context.Context
+	startLock      sync.Mutex
+	stopFn         context.CancelFunc
+	started        bool
+	product        string
+	uuid           string
+	lastSequence   int64
+	lastTrade      int64
+	lastUpdateTime time.Time
+	resyncing      bool
+	healthLock     sync.Mutex
+	lastEventTime  time.Time
+	sourceFailed   bool
+	listenersLock  sync.Mutex
+	listeners      map[chan struct{}]bool
+	candleLock     sync.Mutex
+	candleSubs     map[chan *feed.Candle]bool
 }
 
+// NewFeedController creates a controller that keeps an orderbook for `product` up to date with the
+// events emitted by `source`. The source is started along with the controller, and should be
+// created with the same context so that both shut down together.
 func NewFeedController(
 	ctx context.Context,
 	product string,
+	source datasource.Source,
 ) *FeedController {
 	aUUID, _ := uuid.NewUUID()
 	orderbook := feed.NewOrderbookFeed(product)
 	newContext, stopFn := context.WithCancel(ctx)
 	return &FeedController{
-		uuid:      aUUID.String(),
-		orderbook: orderbook,
-		stopFn:    stopFn,
-		ctx:       newContext,
-		started:   false,
-		outChan:   make(chan (map[string]interface{}), CHANNEL_BUFFER_SIZE),
-		inChan:    make(chan (interface{}), CHANNEL_BUFFER_SIZE),
-		product:   product,
+		uuid:       aUUID.String(),
+		orderbook:  orderbook,
+		tape:       feed.NewTradeTape(product, TRADE_TAPE_RETENTION, TRADE_TAPE_MAX_TRADES),
+		candles:    feed.NewCandleAggregator(product, CANDLE_INTERVALS, MAX_CANDLES),
+		stopFn:     stopFn,
+		ctx:        newContext,
+		started:    false,
+		source:     source,
+		product:    product,
+		listeners:  make(map[chan struct{}]bool),
+		candleSubs: make(map[chan *feed.Candle]bool),
 	}
 }
 
@@ -80,8 +174,9 @@ func (fc *FeedController) Start() error {
 	defer fc.startLock.Unlock()
 
 	fc.started = true
-	fc.websocket = datasource.NewCoinbaseProWebsocket(fc.ctx, fc.product, fc.outChan, fc.inChan)
-	fc.websocket.Start()
+	if err := fc.source.Start(); err != nil {
+		return err
+	}
 
 	go fc.runOrderbookReporter()
 	go fc.runLoop()
@@ -96,92 +191,313 @@ func (fc *FeedController) runOrderbookReporter() {
 			log.Warning("Orderbook reporter shutdown")
 			return
 		case <-timer.C:
-			fc.orderbook.CleanUpOrderbook()
-
 			bids, asks := fc.orderbook.GetBookCount()
 			orderbookDepthGauge.WithLabelValues(fc.uuid, fc.product, "bids").Set(float64(bids))
 			orderbookDepthGauge.WithLabelValues(fc.uuid, fc.product, "asks").Set(float64(asks))
+			fc.reportLiquidityCurve()
+			fc.reportTradeStats()
+		}
+	}
+}
+
+func (fc *FeedController) reportTradeStats() {
+	now := time.Now()
+	for _, window := range TRADE_STATS_WINDOWS {
+		stats, err := fc.tape.Stats(window, now)
+		if err != nil {
+			continue
 		}
+		volume, _ := stats.Volume.Float64()
+		vwap, _ := stats.VWAP.Float64()
+		rollingVolumeGauge.WithLabelValues(fc.uuid, fc.product, window.String()).Set(volume)
+		rollingVWAPGauge.WithLabelValues(fc.uuid, fc.product, window.String()).Set(vwap)
 	}
 }
 
+func (fc *FeedController) reportLiquidityCurve() {
+	curve, _, err := fc.orderbook.GetLiquidityCurve(LIQUIDITY_CURVE_BPS)
+	if err != nil {
+		return
+	}
+	report := func(side string, points []*feed.LiquidityPoint) {
+		for _, point := range points {
+			size, _ := point.Size.Float64()
+			averagePrice, _ := point.AveragePrice.Float64()
+			liquiditySizeGauge.WithLabelValues(fc.uuid, fc.product, side, point.DistanceBps.String()).Set(size)
+			liquidityAveragePriceGauge.WithLabelValues(fc.uuid, fc.product, side, point.DistanceBps.String()).Set(averagePrice)
+		}
+	}
+	report("bids", curve.Bids)
+	report("asks", curve.Asks)
+}
+
+// runLoop handles the events of the source, and closes the candles of quiet markets, in a single
+// goroutine so that candles are closed in order.
 func (fc *FeedController) runLoop() {
+	candleTicker := time.NewTicker(CANDLE_CLOSE_TICKER)
+	defer candleTicker.Stop()
 	for {
 		select {
 		case <-fc.ctx.Done():
 			log.Warning("Feed controller event loop shut down")
 			return
-		case wsType := <-fc.outChan:
-			switch wsType["type"].(string) {
-			case "snapshot":
-				bidsInterface := wsType["bids"].([]interface{})
-				bids := make([]*feed.Update, len(bidsInterface))
-				for idx, bidsEl := range bidsInterface {
-					bids[idx] = &feed.Update{
-						Price: bidsEl.([]interface{})[0].(string),
-						Size:  bidsEl.([]interface{})[1].(string),
-					}
-				}
-
-				asksInterface := wsType["asks"].([]interface{})
-				asks := make([]*feed.Update, len(asksInterface))
-				for idx, asksEl := range asksInterface {
-					asks[idx] = &feed.Update{
-						Price: asksEl.([]interface{})[0].(string),
-						Size:  asksEl.([]interface{})[1].(string),
-					}
-				}
-				fc.orderbook.SetSnapshot(time.Now().Unix(), bids, asks)
-				log.WithField("numBids", len(bids)).WithField("numAsks", len(asks)).Infoln("Set new snapshot")
-			case "l2update":
-				timestamp, err := DateStringToUnixEpoch(wsType["time"].(string))
-				if err != nil {
-					log.WithField("timestamp", wsType["time"].(string)).Errorln("Incorrect date format found.")
-					continue
-				}
-
-				var bids []*feed.Update
-				var asks []*feed.Update
-				changes := wsType["changes"].([]interface{})
-				for _, change := range changes {
-					changeEl := change.([]interface{})
-					update := &feed.Update{
-						Price: changeEl[1].(string),
-						Size:  changeEl[2].(string),
-					}
-					switch changeEl[0] {
-					case "buy":
-						bids = append(bids, update)
-					case "sell":
-						asks = append(asks, update)
-					}
-				}
-				fc.orderbook.WriteUpdate(timestamp, bids, asks)
-			case "heartbeat":
-				heartbeatTicker.WithLabelValues(fc.uuid, fc.product).Inc()
-			case "subscriptions":
+		case event := <-fc.source.Events():
+			fc.handleEvent(event)
+		case now := <-candleTicker.C:
+			fc.publishCandles(fc.candles.Advance(now.Add(-CANDLE_CLOSE_DELAY)))
+		}
+	}
+}
+
+// resync invalidates the orderbook and asks the source for a fresh snapshot. Further
+// calls are ignored until the snapshot arrives, so a burst of drops causes a single resync.
+func (fc *FeedController) resync(reason string) {
+	if fc.resyncing {
+		return
+	}
+	log.WithField("market", fc.product).WithField("reason", reason).Warningln("Orderbook out of sync, requesting a new snapshot")
+	resyncCounter.WithLabelValues(fc.uuid, fc.product, reason).Inc()
+	fc.resyncing = true
+	fc.orderbook.Invalidate()
+	fc.source.RequestSnapshot()
+	fc.notifyListeners()
+}
+
+// Subscribe returns a channel that receives a signal every time the orderbook changes. Signals are
+// coalesced, a slow listener only sees that the book changed since it last looked. Call the returned
+// function to unsubscribe.
+func (fc *FeedController) Subscribe() (<-chan struct{}, func()) {
+	listener := make(chan struct{}, 1)
+	fc.listenersLock.Lock()
+	fc.listeners[listener] = true
+	fc.listenersLock.Unlock()
+	return listener, func() {
+		fc.listenersLock.Lock()
+		delete(fc.listeners, listener)
+		fc.listenersLock.Unlock()
+	}
+}
+
+func (fc *FeedController) notifyListeners() {
+	fc.listenersLock.Lock()
+	defer fc.listenersLock.Unlock()
+	for listener := range fc.listeners {
+		select {
+		case listener <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// SubscribeCandles returns a channel that receives every candle as it closes, of every interval.
+// A listener that falls more than CANDLE_LISTENER_BUFFER candles behind misses candles. Call the
+// returned function to unsubscribe.
+func (fc *FeedController) SubscribeCandles() (<-chan *feed.Candle, func()) {
+	listener := make(chan *feed.Candle, CANDLE_LISTENER_BUFFER)
+	fc.candleLock.Lock()
+	fc.candleSubs[listener] = true
+	fc.candleLock.Unlock()
+	return listener, func() {
+		fc.candleLock.Lock()
+		delete(fc.candleSubs, listener)
+		fc.candleLock.Unlock()
+	}
+}
+
+func (fc *FeedController) publishCandles(candles []*feed.Candle) {
+	if len(candles) == 0 {
+		return
+	}
+	fc.candleLock.Lock()
+	defer fc.candleLock.Unlock()
+	for listener := range fc.candleSubs {
+		for _, candle := range candles {
+			select {
+			case listener <- candle:
 			default:
-				log.WithField("messageType", wsType["type"].(string)).Warningln("Received an unexpected message")
 			}
 		}
 	}
 }
 
+// sampleMid adds the mid of the book at time `at` to the candles, if the book is valid.
+func (fc *FeedController) sampleMid(at time.Time) {
+	top, _, err := fc.orderbook.GetTopOfBook()
+	if err != nil || top.Mid.IsZero() {
+		return
+	}
+	fc.publishCandles(fc.candles.AddMid(at, top.Mid))
+}
+
+func (fc *FeedController) handleEvent(event *datasource.Event) {
+	fc.healthLock.Lock()
+	fc.lastEventTime = time.Now()
+	if event.Type == datasource.SOURCE_FAILED_EVENT {
+		fc.sourceFailed = true
+	}
+	fc.healthLock.Unlock()
+
+	// Events are numbered by the source, any gap means an event was dropped. Trades are also counted
+	// on their own, a gap made up of trades only leaves the book as it is
+	if fc.lastSequence > 0 && event.Sequence != fc.lastSequence+1 {
+		droppedEvents := event.Sequence - fc.lastSequence - 1
+		droppedTrades := event.TradeSequence - fc.lastTrade
+		if event.Type == datasource.TRADE_EVENT {
+			droppedTrades--
+		}
+		if droppedEvents > 0 && droppedEvents == droppedTrades {
+			log.WithField("market", fc.product).WithField("droppedTrades", droppedTrades).Warningln("Trades were dropped, the tape is missing them")
+			droppedTradesCounter.WithLabelValues(fc.uuid, fc.product).Add(float64(droppedTrades))
+		} else {
+			log.WithField("expected", fc.lastSequence+1).WithField("received", event.Sequence).Warningln("Gap in event sequence")
+			fc.resync("gap")
+		}
+	}
+	fc.lastSequence = event.Sequence
+	fc.lastTrade = event.TradeSequence
+
+	switch event.Type {
+	case datasource.SNAPSHOT_EVENT:
+		// A snapshot older than the book is rejected, the book stays as it was and a resync carries on
+		if !fc.orderbook.SetSnapshot(event.Time.Unix(), event.Bids, event.Asks) {
+			log.WithField("market", fc.product).WithField("snapshotTime", event.Time).Warningln("Rejected a snapshot older than the orderbook")
+			if fc.resyncing {
+				fc.source.RequestSnapshot()
+			}
+			return
+		}
+		fc.resyncing = false
+		fc.lastUpdateTime = time.Time{}
+		log.WithField("numBids", len(event.Bids)).WithField("numAsks", len(event.Asks)).Infoln("Set new snapshot")
+		fc.notifyListeners()
+		fc.sampleMid(event.Time)
+	case datasource.UPDATE_EVENT:
+		if event.Time.Before(fc.lastUpdateTime) {
+			log.WithField("lastUpdateTime", fc.lastUpdateTime).WithField("updateTime", event.Time).Warningln("Received an out of order update")
+			fc.resync("out_of_order")
+		}
+		fc.lastUpdateTime = event.Time
+		if fc.orderbook.WriteUpdate(event.Time.Unix(), event.Bids, event.Asks) {
+			fc.notifyListeners()
+			fc.sampleMid(event.Time)
+		}
+	case datasource.TRADE_EVENT:
+		for _, trade := range event.Trades {
+			// Every new trade is recorded on the tape, a late trade only misses the candles that
+			// already closed
+			if !fc.tape.Add(trade) {
+				continue
+			}
+			fc.publishCandles(fc.candles.AddTrade(trade))
+			size, _ := trade.Size.Float64()
+			price, _ := trade.Price.Float64()
+			tradeVolumeCounter.WithLabelValues(fc.uuid, fc.product, trade.Side).Add(size)
+			lastTradePriceGauge.WithLabelValues(fc.uuid, fc.product).Set(price)
+		}
+	case datasource.HEARTBEAT_EVENT:
+		heartbeatTicker.WithLabelValues(fc.uuid, fc.product).Inc()
+	case datasource.SOURCE_FAILED_EVENT:
+		// The source will not recover by itself, stop serving prices rather than let them go stale
+		log.WithField("product", fc.product).Errorln("Source failed, the orderbook is no longer updated")
+		fc.orderbook.Invalidate()
+		fc.notifyListeners()
+	default:
+		log.WithField("eventType", event.Type).Warningln("Received an unexpected event")
+	}
+}
+
+// Health returns nil when the market can be served, otherwise the reason it cannot. A market is
+// unhealthy once its source failed, while its book is not synced or stale, and when no event was
+// received within HEALTH_EVENT_TIMEOUT, which means the source is disconnected.
+func (fc *FeedController) Health() error {
+	fc.healthLock.Lock()
+	sourceFailed := fc.sourceFailed
+	lastEventTime := fc.lastEventTime
+	fc.healthLock.Unlock()
+
+	if sourceFailed {
+		return errors.New("Source failed and is no longer updating the orderbook")
+	}
+	if err := fc.orderbook.CheckValid(); err != nil {
+		return err
+	}
+	if time.Since(lastEventTime) > HEALTH_EVENT_TIMEOUT {
+		return fmt.Errorf("No event received for %s, the source is probably disconnected", time.Since(lastEventTime).Round(time.Second))
+	}
+	return nil
+}
+
 func (fc *FeedController) Stop() {
 	if fc.started {
 		fc.stopFn()
 	}
 }
 
-func (fc *FeedController) BuyQuote(amount float64) (float64, int64, error) {
+func (fc *FeedController) GetTopOfBook() (*feed.TopOfBook, int64, error) {
+	return fc.orderbook.GetTopOfBook()
+}
+func (fc *FeedController) GetTopOfBookWithQuotes(requests []*feed.QuoteRequest) (*feed.TopOfBook, []*feed.QuoteResult, int64, error) {
+	return fc.orderbook.GetTopOfBookWithQuotes(requests)
+}
+func (fc *FeedController) GetDepth(depth int, withinPercent decimal.Decimal) (*feed.OrderbookDepth, int64, error) {
+	return fc.orderbook.GetDepth(depth, withinPercent)
+}
+func (fc *FeedController) Quote(operation string, amount decimal.Decimal) (*feed.Quote, int64, error) {
+	return fc.orderbook.Quote(operation, amount)
+}
+func (fc *FeedController) BatchQuote(requests []*feed.QuoteRequest) ([]*feed.QuoteResult, int64) {
+	return fc.orderbook.BatchQuote(requests)
+}
+func (fc *FeedController) GetLiquidityCurve(distancesBps []decimal.Decimal) (*feed.LiquidityCurve, int64, error) {
+	return fc.orderbook.GetLiquidityCurve(distancesBps)
+}
+func (fc *FeedController) GetMaxFillableAtPrice(limitPrice decimal.Decimal) (*feed.MaxFillable, int64, error) {
+	return fc.orderbook.GetMaxFillableAtPrice(limitPrice)
+}
+func (fc *FeedController) GetMaxFillableWithinSlippage(maxSlippageBps decimal.Decimal) (*feed.MaxFillable, int64, error) {
+	return fc.orderbook.GetMaxFillableWithinSlippage(maxSlippageBps)
+}
+func (fc *FeedController) QuoteWithFee(operation string, amount, feeBps decimal.Decimal) (*feed.Quote, int64, error) {
+	return fc.orderbook.QuoteWithFee(operation, amount, feeBps)
+}
+func (fc *FeedController) GetLevelsCovering(side string, size decimal.Decimal) ([]*feed.Level, int64, error) {
+	return fc.orderbook.GetLevelsCovering(side, size)
+}
+func (fc *FeedController) LastTrade() (*feed.Trade, error) {
+	return fc.tape.LastTrade()
+}
+func (fc *FeedController) RecentTrades(limit int) ([]*feed.Trade, error) {
+	return fc.tape.RecentTrades(limit)
+}
+
+// TradeStats summarizes the trades of each of the rolling `windows` up to now.
+func (fc *FeedController) TradeStats(windows []time.Duration) ([]*feed.TradeStats, error) {
+	now := time.Now()
+	allStats := make([]*feed.TradeStats, len(windows))
+	for idx, window := range windows {
+		stats, err := fc.tape.Stats(window, now)
+		if err != nil {
+			return nil, err
+		}
+		allStats[idx] = stats
+	}
+	return allStats, nil
+}
+
+// Candles returns up to `limit` closed candles of `interval`, oldest first, and the open candle last
+// with `includeOpen`.
+func (fc *FeedController) Candles(interval time.Duration, limit int, includeOpen bool) ([]*feed.Candle, error) {
+	return fc.candles.Candles(interval, limit, includeOpen)
+}
+func (fc *FeedController) BuyQuote(amount decimal.Decimal) (decimal.Decimal, int64, error) {
 	return fc.orderbook.BuyQuote(amount)
 }
-func (fc *FeedController) SellQuote(amount float64) (float64, int64, error) {
+func (fc *FeedController) SellQuote(amount decimal.Decimal) (decimal.Decimal, int64, error) {
 	return fc.orderbook.SellQuote(amount)
 }
-func (fc *FeedController) BuyBase(amount float64) (float64, int64, error) {
+func (fc *FeedController) BuyBase(amount decimal.Decimal) (decimal.Decimal, int64, error) {
 	return fc.orderbook.BuyBase(amount)
 }
-func (fc *FeedController) SellBase(amount float64) (float64, int64, error) {
+func (fc *FeedController) SellBase(amount decimal.Decimal) (decimal.Decimal, int64, error) {
 	return fc.orderbook.SellBase(amount)
 }
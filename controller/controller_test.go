@@ -1,12 +1,1302 @@
 package controller
 
-import "testing"
-
-func TestDateParsingWorks(t *testing.T) {
-	dateString := "2020-10-11T20:50:02.941691Z"
-	expectedResult := int64(1602449402)
-	result, _ := DateStringToUnixEpoch(dateString)
-	if result != expectedResult {
-		t.Errorf("Expected %d but got %d", expectedResult, result)
+import (
+	"context"
+	"errors"
+	"pirosb3/real_feed/datasource"
+	"pirosb3/real_feed/datasource/coinbasetest"
+	"pirosb3/real_feed/feed"
+	"pirosb3/real_feed/rpc"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/shopspring/decimal"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// fakeSource is a datasource.Source driven by the test.
+type fakeSource struct {
+	events           chan *datasource.Event
+	snapshotRequests int
+}
+
+func newFakeSource() *fakeSource {
+	return &fakeSource{events: make(chan *datasource.Event, datasource.CHANNEL_BUFFER_SIZE)}
+}
+
+func (fs *fakeSource) Start() error                     { return nil }
+func (fs *fakeSource) Events() <-chan *datasource.Event { return fs.events }
+func (fs *fakeSource) RequestSnapshot()                 { fs.snapshotRequests++ }
+
+func makeSnapshotEvent(sequence int64) *datasource.Event {
+	return &datasource.Event{
+		Type:     datasource.SNAPSHOT_EVENT,
+		Sequence: sequence,
+		Time:     time.Now(),
+		Bids:     []*feed.Update{&feed.Update{Price: "333.2", Size: "0.5"}},
+		Asks:     []*feed.Update{&feed.Update{Price: "335.12", Size: "0.5"}},
+	}
+}
+
+func makeUpdateEvent(sequence int64, updateTime time.Time) *datasource.Event {
+	return &datasource.Event{
+		Type:     datasource.UPDATE_EVENT,
+		Sequence: sequence,
+		Time:     updateTime,
+		Bids:     []*feed.Update{&feed.Update{Price: "333.2", Size: "1.5"}},
+	}
+}
+
+func TestEventsAreAppliedToTheBook(t *testing.T) {
+	ctx, cancelFn := context.WithCancel(context.Background())
+	defer cancelFn()
+	source := newFakeSource()
+	fc := NewFeedController(ctx, "ETH-DAI", source)
+	fc.Start()
+
+	source.events <- makeSnapshotEvent(1)
+	source.events <- makeUpdateEvent(2, time.Now())
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		result, _, err := fc.SellBase(decimal.RequireFromString("1.5"))
+		if err == nil && result.Equal(decimal.RequireFromString("499.8")) {
+			return
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+	t.Error("Expected the snapshot and update to be applied")
+}
+
+func TestGapTriggersResync(t *testing.T) {
+	source := newFakeSource()
+	fc := NewFeedController(context.Background(), "ETH-DAI", source)
+	amount := decimal.RequireFromString("0.5")
+
+	now := time.Now()
+	fc.handleEvent(makeSnapshotEvent(1))
+	fc.handleEvent(makeUpdateEvent(2, now))
+	if _, _, err := fc.SellBase(amount); err != nil {
+		t.Fatalf("Expected book to be valid, got %s", err.Error())
+	}
+
+	// Event 3 was dropped
+	fc.handleEvent(makeUpdateEvent(4, now))
+	if _, _, err := fc.SellBase(amount); err == nil {
+		t.Error("Expected book to be invalid after a gap")
+	}
+	if source.snapshotRequests != 1 {
+		t.Fatalf("Expected a snapshot to be requested, got %d requests", source.snapshotRequests)
+	}
+
+	// More gaps while waiting for the snapshot do not request another one
+	fc.handleEvent(makeUpdateEvent(6, now))
+	if source.snapshotRequests != 1 {
+		t.Errorf("Expected a single snapshot request, got %d", source.snapshotRequests)
+	}
+
+	fc.handleEvent(makeSnapshotEvent(7))
+	if _, _, err := fc.SellBase(amount); err != nil {
+		t.Errorf("Expected book to be valid after a new snapshot, got %s", err.Error())
+	}
+}
+
+func TestOlderSnapshotDoesNotEndResync(t *testing.T) {
+	source := newFakeSource()
+	fc := NewFeedController(context.Background(), "ETH-DAI", source)
+	amount := decimal.RequireFromString("0.5")
+
+	now := time.Now()
+	fc.handleEvent(makeSnapshotEvent(1))
+	fc.handleEvent(makeUpdateEvent(2, now))
+	fc.handleEvent(makeUpdateEvent(4, now))
+
+	// A snapshot taken before the last update is rejected and another one requested
+	older := makeSnapshotEvent(5)
+	older.Time = now.Add(-time.Minute)
+	fc.handleEvent(older)
+	if _, _, err := fc.SellBase(amount); err == nil {
+		t.Error("Expected book to stay invalid after an older snapshot")
+	}
+	if !fc.resyncing || source.snapshotRequests != 2 {
+		t.Errorf("Expected the resync to carry on with a new request, got %d requests", source.snapshotRequests)
+	}
+
+	fc.handleEvent(makeSnapshotEvent(6))
+	if _, _, err := fc.SellBase(amount); err != nil || fc.resyncing {
+		t.Errorf("Expected book to be valid after a new snapshot, got %v", err)
+	}
+}
+
+func TestOutOfOrderUpdateTriggersResync(t *testing.T) {
+	source := newFakeSource()
+	fc := NewFeedController(context.Background(), "ETH-DAI", source)
+
+	now := time.Now()
+	fc.handleEvent(makeSnapshotEvent(1))
+	fc.handleEvent(makeUpdateEvent(2, now))
+	fc.handleEvent(makeUpdateEvent(3, now.Add(-time.Second)))
+	if _, _, err := fc.SellBase(decimal.RequireFromString("0.5")); err == nil {
+		t.Error("Expected book to be invalid after an out of order update")
+	}
+	if source.snapshotRequests != 1 {
+		t.Errorf("Expected a snapshot to be requested, got %d requests", source.snapshotRequests)
+	}
+}
+
+func TestDroppedTradeDoesNotResyncTheBook(t *testing.T) {
+	source := newFakeSource()
+	fc := NewFeedController(context.Background(), "ETH-DAI", source)
+	trade := func(sequence, tradeSequence int64) *datasource.Event {
+		return &datasource.Event{
+			Type:          datasource.TRADE_EVENT,
+			Sequence:      sequence,
+			TradeSequence: tradeSequence,
+			Time:          time.Now(),
+			Trades: []*feed.Trade{{
+				TradeID: tradeSequence,
+				Side:    feed.TRADE_BUY,
+				Price:   decimal.RequireFromString("335.12"),
+				Size:    decimal.NewFromInt(1),
+				Time:    time.Now(),
+			}},
+		}
+	}
+
+	fc.handleEvent(makeSnapshotEvent(1))
+	fc.handleEvent(trade(2, 1))
+	// The third event, the second trade, was dropped
+	update := makeUpdateEvent(4, time.Now())
+	update.TradeSequence = 2
+	fc.handleEvent(update)
+	fc.handleEvent(trade(6, 4))
+	if source.snapshotRequests != 0 || fc.resyncing {
+		t.Errorf("Expected dropped trades to leave the book as it is, got %d snapshot requests", source.snapshotRequests)
+	}
+	if trades, _ := fc.RecentTrades(0); len(trades) != 2 {
+		t.Errorf("Expected the trades received to be on the tape, got %d", len(trades))
+	}
+
+	// The seventh event, an update of the book, was dropped
+	update = makeUpdateEvent(8, time.Now())
+	update.TradeSequence = 4
+	fc.handleEvent(update)
+	if source.snapshotRequests != 1 {
+		t.Errorf("Expected a dropped update to request a snapshot, got %d requests", source.snapshotRequests)
+	}
+}
+
+func TestSourceFailureInvalidatesTheBook(t *testing.T) {
+	source := newFakeSource()
+	fc := NewFeedController(context.Background(), "ETH-DAI", source)
+
+	fc.handleEvent(makeSnapshotEvent(1))
+	fc.handleEvent(&datasource.Event{Type: datasource.SOURCE_FAILED_EVENT, Sequence: 2, Product: "ETH-DAI"})
+	if _, _, err := fc.SellBase(decimal.RequireFromString("0.5")); err == nil {
+		t.Error("Expected book to be invalid after the source failed")
+	}
+	if source.snapshotRequests != 0 {
+		t.Errorf("Expected no snapshot to be requested from a failed source, got %d requests", source.snapshotRequests)
+	}
+}
+
+func TestHealthFollowsTheBook(t *testing.T) {
+	source := newFakeSource()
+	fc := NewFeedController(context.Background(), "ETH-DAI", source)
+	if fc.Health() == nil {
+		t.Error("Expected a market without a snapshot to be unhealthy")
+	}
+	fc.handleEvent(makeSnapshotEvent(1))
+	if err := fc.Health(); err != nil {
+		t.Errorf("Expected a synced market to be healthy, got %s", err.Error())
+	}
+
+	fc.healthLock.Lock()
+	fc.lastEventTime = time.Now().Add(-2 * HEALTH_EVENT_TIMEOUT)
+	fc.healthLock.Unlock()
+	if fc.Health() == nil {
+		t.Error("Expected a market without recent events to be unhealthy")
+	}
+
+	fc.handleEvent(&datasource.Event{Type: datasource.SOURCE_FAILED_EVENT, Sequence: 2, Product: "ETH-DAI"})
+	if fc.Health() == nil {
+		t.Error("Expected a market with a failed source to be unhealthy")
+	}
+}
+
+func TestHealthReporterSetsStatusPerMarket(t *testing.T) {
+	feedControllers := map[string]*FeedController{
+		"ETH-DAI": NewFeedController(context.Background(), "ETH-DAI", newFakeSource()),
+		"BTC-USD": NewFeedController(context.Background(), "BTC-USD", newFakeSource()),
+	}
+	feedControllers["ETH-DAI"].handleEvent(makeSnapshotEvent(1))
+	server := health.NewServer()
+	hr := NewHealthReporter(context.Background(), server, feedControllers)
+
+	status := func(service string) healthpb.HealthCheckResponse_ServingStatus {
+		response, err := server.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+		if err != nil {
+			t.Fatalf("Health check for %q failed: %s", service, err.Error())
+		}
+		return response.GetStatus()
+	}
+	if status("ETH-DAI") != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Error("Expected markets to be reported as not serving before the first check")
+	}
+
+	hr.check()
+	if status("ETH-DAI") != healthpb.HealthCheckResponse_SERVING {
+		t.Error("Expected ETH-DAI to be serving")
+	}
+	if status("BTC-USD") != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Error("Expected BTC-USD to not be serving without a snapshot")
+	}
+	if status("") != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Error("Expected the overall service to not be serving while a market is not")
+	}
+
+	feedControllers["BTC-USD"].handleEvent(makeSnapshotEvent(1))
+	hr.check()
+	if status("") != healthpb.HealthCheckResponse_SERVING {
+		t.Error("Expected the overall service to be serving once every market is")
+	}
+}
+
+func TestGrpcControllerRoutesByProduct(t *testing.T) {
+	feedControllers := map[string]*FeedController{
+		"ETH-DAI": NewFeedController(context.Background(), "ETH-DAI", newFakeSource()),
+		"BTC-USD": NewFeedController(context.Background(), "BTC-USD", newFakeSource()),
+	}
+	feedControllers["ETH-DAI"].handleEvent(makeSnapshotEvent(1))
+	ob := NewOrderbookGrpcController(feedControllers)
+
+	response, _ := ob.SellBase(context.Background(), &rpc.PricingRequest{Product: "ETH-DAI", InAmount: 0.5})
+	if response.GetError() != "" || response.GetOutAmount() != 166.6 {
+		t.Errorf("Expected 166.6, got %f (error: %s)", response.GetOutAmount(), response.GetError())
+	}
+
+	// BTC-USD is served, but never received a snapshot
+	_, err := ob.SellBase(context.Background(), &rpc.PricingRequest{Product: "BTC-USD", InAmount: 0.5})
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("Expected Unavailable for a book without a snapshot, got %v", err)
+	}
+
+	_, err = ob.SellBase(context.Background(), &rpc.PricingRequest{Product: "LTC-USD", InAmount: 0.5})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound for a product that is not served, got %v", err)
+	}
+}
+
+func TestErrorsCarryStatusDetails(t *testing.T) {
+	fc := NewFeedController(context.Background(), "ETH-DAI", newFakeSource())
+	fc.handleEvent(makeSnapshotEvent(1))
+	ob := NewOrderbookGrpcController(map[string]*FeedController{"ETH-DAI": fc})
+
+	errorInfo := func(err error) *errdetails.ErrorInfo {
+		for _, detail := range status.Convert(err).Details() {
+			if info, ok := detail.(*errdetails.ErrorInfo); ok {
+				return info
+			}
+		}
+		t.Fatalf("Expected an ErrorInfo in %v", err)
+		return nil
+	}
+
+	// The bids only hold 0.5 ETH, the asks 0.5 * 335.12 = 167.56 DAI
+	_, err := ob.SellBase(context.Background(), &rpc.PricingRequest{Product: "ETH-DAI", InAmount: 2})
+	info := errorInfo(err)
+	if status.Code(err) != codes.FailedPrecondition || info.GetReason() != REASON_INSUFFICIENT_LIQUIDITY {
+		t.Errorf("Expected insufficient liquidity, got %v", err)
+	}
+	if info.GetMetadata()["maxFillable"] != "0.5" {
+		t.Errorf("Expected 0.5 to be fillable, got %s", info.GetMetadata()["maxFillable"])
+	}
+	_, err = ob.SellQuote(context.Background(), &rpc.PricingRequest{Product: "ETH-DAI", InAmount: 200})
+	if maxFillable := errorInfo(err).GetMetadata()["maxFillable"]; maxFillable != "167.56" {
+		t.Errorf("Expected 167.56 to be fillable, got %s", maxFillable)
+	}
+
+	_, err = ob.BuyBase(context.Background(), &rpc.PricingRequest{Product: "ETH-DAI", InAmount: -1})
+	if status.Code(err) != codes.InvalidArgument || errorInfo(err).GetReason() != REASON_INVALID_ARGUMENT {
+		t.Errorf("Expected an invalid argument, got %v", err)
+	}
+
+	_, err = ob.BuyBase(context.Background(), &rpc.PricingRequest{Product: "LTC-USD", InAmount: 1})
+	if errorInfo(err).GetReason() != REASON_UNKNOWN_PRODUCT {
+		t.Errorf("Expected an unknown product, got %v", err)
+	}
+}
+
+// fakeTopOfBookStream collects the messages sent on a StreamTopOfBook call.
+type fakeTopOfBookStream struct {
+	grpc.ServerStream
+	ctx       context.Context
+	responses chan *rpc.TopOfBookResponse
+}
+
+func (fs *fakeTopOfBookStream) Context() context.Context { return fs.ctx }
+func (fs *fakeTopOfBookStream) Send(response *rpc.TopOfBookResponse) error {
+	fs.responses <- response
+	return nil
+}
+
+func TestStreamTopOfBook(t *testing.T) {
+	ctx, cancelFn := context.WithCancel(context.Background())
+	defer cancelFn()
+	fc := NewFeedController(ctx, "ETH-DAI", newFakeSource())
+	fc.handleEvent(makeSnapshotEvent(1))
+	ob := NewOrderbookGrpcController(map[string]*FeedController{"ETH-DAI": fc})
+
+	stream := &fakeTopOfBookStream{ctx: ctx, responses: make(chan *rpc.TopOfBookResponse, 10)}
+	go ob.StreamTopOfBook(&rpc.TopOfBookRequest{Product: "ETH-DAI", QuoteSize: "0.25"}, stream)
+
+	receive := func() *rpc.TopOfBookResponse {
+		select {
+		case response := <-stream.responses:
+			return response
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for top of book")
+		}
+		return nil
+	}
+	response := receive()
+	if response.GetBestBid() != "333.2" || response.GetBestAsk() != "335.12" || response.GetError() != "" {
+		t.Errorf("Unexpected top of book %v", response)
+	}
+	if response.GetBuyBaseAmount() != "83.78" || response.GetSellBaseAmount() != "83.3" {
+		t.Errorf("Expected 83.78 to buy and 83.3 to sell, got %s and %s", response.GetBuyBaseAmount(), response.GetSellBaseAmount())
+	}
+
+	fc.handleEvent(&datasource.Event{
+		Type:     datasource.UPDATE_EVENT,
+		Sequence: 2,
+		Time:     time.Now(),
+		Bids:     []*feed.Update{&feed.Update{Price: "334", Size: "1"}},
+	})
+	response = receive()
+	if response.GetBestBid() != "334" || response.GetSpread() != "1.12" {
+		t.Errorf("Expected best bid 334 and spread 1.12, got %s and %s", response.GetBestBid(), response.GetSpread())
+	}
+
+	for _, quoteSize := range []string{"0", "-1"} {
+		err := ob.StreamTopOfBook(&rpc.TopOfBookRequest{Product: "ETH-DAI", QuoteSize: quoteSize}, stream)
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("Expected InvalidArgument for a quote size of %s, got %v", quoteSize, err)
+		}
+	}
+}
+
+func TestTopOfBookReportsBothQuoteErrors(t *testing.T) {
+	fc := NewFeedController(context.Background(), "ETH-DAI", newFakeSource())
+	fc.handleEvent(makeSnapshotEvent(1))
+	ob := NewOrderbookGrpcController(map[string]*FeedController{"ETH-DAI": fc})
+
+	// Both sides only hold 0.5
+	response := ob.makeTopOfBookResponse(fc, &rpc.TopOfBookRequest{Product: "ETH-DAI"}, decimal.NewFromInt(1))
+	if response.GetBestBid() != "333.2" || response.GetBuyBaseAmount() != "" || response.GetSellBaseAmount() != "" {
+		t.Errorf("Expected the top of book without quotes, got %v", response)
+	}
+	if !strings.Contains(response.GetError(), "buy: ") || !strings.Contains(response.GetError(), "sell: ") {
+		t.Errorf("Expected both quote errors, got %s", response.GetError())
+	}
+}
+
+func TestGetOrderbook(t *testing.T) {
+	fc := NewFeedController(context.Background(), "ETH-DAI", newFakeSource())
+	fc.handleEvent(makeSnapshotEvent(1))
+	ob := NewOrderbookGrpcController(map[string]*FeedController{"ETH-DAI": fc})
+
+	response, _ := ob.GetOrderbook(context.Background(), &rpc.OrderbookRequest{Product: "ETH-DAI", Depth: 10})
+	if response.GetError() != "" {
+		t.Fatal(response.GetError())
+	}
+	if len(response.GetBids()) != 1 || response.GetBids()[0].GetPrice() != "333.2" || response.GetAsks()[0].GetSize() != "0.5" {
+		t.Errorf("Unexpected orderbook %v", response)
+	}
+	if response.GetMid() != "334.16" {
+		t.Errorf("Expected mid 334.16, got %s", response.GetMid())
+	}
+
+	_, err := ob.GetOrderbook(context.Background(), &rpc.OrderbookRequest{Product: "ETH-DAI", WithinPercent: "abc"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected an invalid argument for an invalid percentage, got %v", err)
+	}
+}
+
+func TestPricingBreakdown(t *testing.T) {
+	fc := NewFeedController(context.Background(), "ETH-DAI", newFakeSource())
+	fc.handleEvent(makeSnapshotEvent(1))
+	ob := NewOrderbookGrpcController(map[string]*FeedController{"ETH-DAI": fc})
+
+	response, _ := ob.BuyBase(context.Background(), &rpc.PricingRequest{Product: "ETH-DAI", InAmount: 0.25})
+	if len(response.GetFills()) != 0 || response.GetVwap() != "" {
+		t.Error("Breakdown should only be included when requested")
+	}
+	response, _ = ob.BuyBase(context.Background(), &rpc.PricingRequest{Product: "ETH-DAI", InAmount: 0.25, IncludeBreakdown: true})
+	if len(response.GetFills()) != 1 || response.GetFills()[0].GetSize() != "0.25" || response.GetVwap() != "335.12" || response.GetWorstPrice() != "335.12" {
+		t.Errorf("Unexpected breakdown %v", response)
+	}
+}
+
+func TestOutOfOrderUpdateFromWebsocketResubscribes(t *testing.T) {
+	server := coinbasetest.NewServer()
+	defer server.Close()
+	server.SetSnapshot("ETH-DAI", [][]string{{"333.2", "0.5"}}, [][]string{{"335.12", "0.5"}})
+
+	ctx, cancelFn := context.WithCancel(context.Background())
+	defer cancelFn()
+	source := datasource.NewCoinbaseProWebsocket(ctx, server.URL, "ETH-DAI")
+	fc := NewFeedController(ctx, "ETH-DAI", source)
+	fc.Start()
+	amount := decimal.RequireFromString("0.5")
+	isValid := func() bool {
+		_, _, err := fc.SellBase(amount)
+		return err == nil
+	}
+	if !coinbasetest.WaitFor(time.Second, isValid) {
+		t.Fatal("Expected the snapshot to be applied")
+	}
+
+	now := time.Now()
+	server.SendUpdate("ETH-DAI", now, [][]string{{"buy", "333.2", "1"}})
+	server.SendUpdate("ETH-DAI", now.Add(-time.Second), [][]string{{"buy", "333.2", "2"}})
+	resubscribed := func() bool {
+		received := server.Received()
+		return len(received) == 3 && received[1]["type"] == "unsubscribe" && received[2]["type"] == "subscribe"
+	}
+	if !coinbasetest.WaitFor(time.Second, resubscribed) {
+		t.Fatalf("Expected the product to be resubscribed, server received %v", server.Received())
+	}
+	if !coinbasetest.WaitFor(time.Second, isValid) {
+		t.Error("Expected the book to be valid again after the new snapshot")
+	}
+}
+
+// countingSource counts the snapshots requested from the source it wraps.
+type countingSource struct {
+	datasource.Source
+	snapshotRequests int32
+}
+
+func (cs *countingSource) RequestSnapshot() {
+	atomic.AddInt32(&cs.snapshotRequests, 1)
+	cs.Source.RequestSnapshot()
+}
+
+func TestMalformedUpdateFromWebsocketResyncs(t *testing.T) {
+	server := coinbasetest.NewServer()
+	defer server.Close()
+	server.SetSnapshot("ETH-DAI", [][]string{{"333.2", "0.5"}}, [][]string{{"335.12", "0.5"}})
+
+	ctx, cancelFn := context.WithCancel(context.Background())
+	defer cancelFn()
+	source := &countingSource{Source: datasource.NewCoinbaseProWebsocket(ctx, server.URL, "ETH-DAI")}
+	fc := NewFeedController(ctx, "ETH-DAI", source)
+	fc.Start()
+	isValid := func() bool {
+		_, _, err := fc.SellBase(decimal.RequireFromString("0.5"))
+		return err == nil
+	}
+	if !coinbasetest.WaitFor(time.Second, isValid) {
+		t.Fatal("Expected the snapshot to be applied")
+	}
+
+	gaps := testutil.ToFloat64(resyncCounter.WithLabelValues(fc.uuid, "ETH-DAI", "gap"))
+	server.SendRaw(`{"type": "l2update", "product_id": "ETH-DAI", "changes": "not changes"}`)
+	server.SendUpdate("ETH-DAI", time.Now(), [][]string{{"buy", "333.2", "1"}})
+	requested := func() bool {
+		return atomic.LoadInt32(&source.snapshotRequests) == 1
+	}
+	if !coinbasetest.WaitFor(time.Second, requested) {
+		t.Fatal("Expected a snapshot to be requested after the malformed update")
+	}
+	if resyncs := testutil.ToFloat64(resyncCounter.WithLabelValues(fc.uuid, "ETH-DAI", "gap")); resyncs != gaps+1 {
+		t.Errorf("Expected the resync to be counted as a gap, got %f resyncs", resyncs-gaps)
+	}
+}
+
+func TestV2QuotesKeepDecimalPrecision(t *testing.T) {
+	fc := NewFeedController(context.Background(), "BTC-USD", newFakeSource())
+	fc.handleEvent(&datasource.Event{
+		Type:     datasource.SNAPSHOT_EVENT,
+		Sequence: 1,
+		Time:     time.Now(),
+		Bids:     []*feed.Update{&feed.Update{Price: "12345.67", Size: "100"}},
+		Asks:     []*feed.Update{&feed.Update{Price: "12345.68", Size: "100"}},
+	})
+	ob := NewOrderbookGrpcControllerV2(map[string]*FeedController{"BTC-USD": fc}, nil)
+
+	response, err := ob.SellBase(context.Background(), &rpc.QuoteRequest{Product: "BTC-USD", Amount: "87.654321", IncludeBreakdown: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.GetAmount() != "1082151.32114007" {
+		t.Errorf("Expected 1082151.32114007, got %s", response.GetAmount())
+	}
+	if len(response.GetFills()) != 1 || response.GetVwap() != "12345.67" {
+		t.Errorf("Expected a single fill at 12345.67, got %v", response)
+	}
+
+	_, err = ob.SellBase(context.Background(), &rpc.QuoteRequest{Product: "BTC-USD", Amount: "1e"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected an invalid argument for an unparseable amount, got %v", err)
+	}
+}
+
+func TestBatchQuote(t *testing.T) {
+	fc := NewFeedController(context.Background(), "ETH-DAI", newFakeSource())
+	fc.handleEvent(makeSnapshotEvent(1))
+	ob := NewOrderbookGrpcControllerV2(map[string]*FeedController{"ETH-DAI": fc}, nil)
+
+	response, err := ob.BatchQuote(context.Background(), &rpc.BatchQuoteRequest{
+		Product: "ETH-DAI",
+		Items: []*rpc.BatchQuoteItem{
+			{Operation: rpc.Operation_SELL_BASE, Amount: "0.25"},
+			{Operation: rpc.Operation_BUY_BASE, Amount: "0.25"},
+			{Operation: rpc.Operation_BUY_BASE, Amount: "5"},
+			{Operation: rpc.Operation_BUY_BASE, Amount: "abc"},
+			{Operation: rpc.Operation_OPERATION_UNSPECIFIED, Amount: "1"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := response.GetResults()
+	if len(results) != 5 {
+		t.Fatalf("Expected 5 results, got %d", len(results))
+	}
+	if results[0].GetQuote().GetAmount() != "83.3" || results[1].GetQuote().GetAmount() != "83.78" {
+		t.Errorf("Expected 83.3 and 83.78, got %s and %s", results[0].GetQuote().GetAmount(), results[1].GetQuote().GetAmount())
+	}
+	if results[0].GetQuote().GetLastUpdated() != response.GetLastUpdated() || results[1].GetQuote().GetLastUpdated() != response.GetLastUpdated() {
+		t.Error("Expected every quote to share the batch's lastUpdated")
+	}
+	expectedCodes := []codes.Code{codes.FailedPrecondition, codes.InvalidArgument, codes.InvalidArgument}
+	for idx, expectedCode := range expectedCodes {
+		result := results[idx+2]
+		if result.GetQuote() != nil || codes.Code(result.GetError().GetCode()) != expectedCode {
+			t.Errorf("Expected item %d to fail with %s, got %v", idx+2, expectedCode, result)
+		}
+	}
+
+	_, err = ob.BatchQuote(context.Background(), &rpc.BatchQuoteRequest{
+		Product: "ETH-DAI",
+		Items:   make([]*rpc.BatchQuoteItem, MAX_BATCH_SIZE+1),
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected oversized batches to be rejected, got %v", err)
+	}
+}
+
+func TestGetLiquidityCurve(t *testing.T) {
+	fc := NewFeedController(context.Background(), "ETH-DAI", newFakeSource())
+	fc.handleEvent(makeSnapshotEvent(1))
+	ob := NewOrderbookGrpcControllerV2(map[string]*FeedController{"ETH-DAI": fc}, nil)
+
+	response, err := ob.GetLiquidityCurve(context.Background(), &rpc.LiquidityCurveRequest{Product: "ETH-DAI"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.GetBids()) != len(LIQUIDITY_CURVE_BPS) || response.GetMid() != "334.16" {
+		t.Fatalf("Expected the default distances around 334.16, got %v", response)
+	}
+	// Both sides are 0.96 DAI from mid, about 29 bps
+	for idx, expectedSize := range []string{"0", "0", "0.5", "0.5"} {
+		if response.GetBids()[idx].GetSize() != expectedSize || response.GetAsks()[idx].GetSize() != expectedSize {
+			t.Errorf("Expected %s within %s bps, got %s bids and %s asks", expectedSize, response.GetBids()[idx].GetDistanceBps(),
+				response.GetBids()[idx].GetSize(), response.GetAsks()[idx].GetSize())
+		}
+	}
+
+	response, err = ob.GetLiquidityCurve(context.Background(), &rpc.LiquidityCurveRequest{Product: "ETH-DAI", DistancesBps: []string{"30"}})
+	if err != nil || len(response.GetAsks()) != 1 || response.GetAsks()[0].GetAveragePrice() != "335.12" {
+		t.Errorf("Expected the asks within 30 bps to average 335.12, got %v (%v)", response, err)
+	}
+	_, err = ob.GetLiquidityCurve(context.Background(), &rpc.LiquidityCurveRequest{Product: "ETH-DAI", DistancesBps: []string{"far"}})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected an invalid argument, got %v", err)
+	}
+}
+
+func TestGetMaxFillable(t *testing.T) {
+	fc := NewFeedController(context.Background(), "ETH-DAI", newFakeSource())
+	fc.handleEvent(makeSnapshotEvent(1))
+	ob := NewOrderbookGrpcControllerV2(map[string]*FeedController{"ETH-DAI": fc}, nil)
+
+	response, err := ob.GetMaxFillable(context.Background(), &rpc.MaxFillableRequest{
+		Product: "ETH-DAI",
+		Limit:   &rpc.MaxFillableRequest_LimitPrice{LimitPrice: "333"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.GetBuy().GetSize() != "0" || response.GetSell().GetSize() != "0.5" || response.GetSell().GetNotional() != "166.6" {
+		t.Errorf("Expected nothing to buy and 0.5 to sell at 333, got %v", response)
+	}
+
+	response, err = ob.GetMaxFillable(context.Background(), &rpc.MaxFillableRequest{
+		Product: "ETH-DAI",
+		Limit:   &rpc.MaxFillableRequest_MaxSlippageBps{MaxSlippageBps: "100"},
+	})
+	if err != nil || response.GetBuy().GetSize() != "0.5" || response.GetSell().GetSize() != "0.5" {
+		t.Errorf("Expected both levels to be within 100 bps, got %v (%v)", response, err)
+	}
+
+	_, err = ob.GetMaxFillable(context.Background(), &rpc.MaxFillableRequest{Product: "ETH-DAI"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected a missing limit to be rejected, got %v", err)
+	}
+}
+
+func TestQuotesNetOfFees(t *testing.T) {
+	fc := NewFeedController(context.Background(), "ETH-DAI", newFakeSource())
+	fc.handleEvent(makeSnapshotEvent(1))
+	feedControllers := map[string]*FeedController{"ETH-DAI": fc}
+	feeSchedule := &feed.FeeSchedule{
+		Tiers: []*feed.FeeTier{{MakerBps: decimal.NewFromInt(40), TakerBps: decimal.NewFromInt(60)}},
+	}
+	ob := NewOrderbookGrpcControllerV2(feedControllers, feeSchedule)
+
+	response, err := ob.SellBase(context.Background(), &rpc.QuoteRequest{Product: "ETH-DAI", Amount: "0.5", NetOfFees: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.GetAmount() != "165.6004" || response.GetFee() != "0.9996" || response.GetFeeBps() != "60" {
+		t.Errorf("Expected 165.6004 after a 0.9996 fee at 60 bps, got %v", response)
+	}
+	response, _ = ob.SellBase(context.Background(), &rpc.QuoteRequest{Product: "ETH-DAI", Amount: "0.5"})
+	if response.GetAmount() != "166.6" || response.GetFee() != "" {
+		t.Errorf("Expected the gross 166.6 without netOfFees, got %v", response)
+	}
+
+	batch, err := ob.BatchQuote(context.Background(), &rpc.BatchQuoteRequest{
+		Product:   "ETH-DAI",
+		Items:     []*rpc.BatchQuoteItem{{Operation: rpc.Operation_SELL_BASE, Amount: "0.5"}},
+		NetOfFees: true,
+	})
+	if err != nil || batch.GetResults()[0].GetQuote().GetAmount() != "165.6004" {
+		t.Errorf("Expected batches to be net of fees too, got %v (%v)", batch, err)
+	}
+
+	ob = NewOrderbookGrpcControllerV2(feedControllers, nil)
+	_, err = ob.SellBase(context.Background(), &rpc.QuoteRequest{Product: "ETH-DAI", Amount: "0.5", NetOfFees: true})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Expected net quotes to fail without a fee schedule, got %v", err)
+	}
+}
+
+func makeRoutingControllers(ethBtcBid string) map[string]*FeedController {
+	books := map[string][]string{
+		"ETH-USD": {"3000", "10", "3001", "10"},
+		"BTC-USD": {"40000", "1", "40010", "1"},
+		"ETH-BTC": {ethBtcBid, "5", "0.09", "5"},
+	}
+	feedControllers := make(map[string]*FeedController)
+	for product, book := range books {
+		fc := NewFeedController(context.Background(), product, newFakeSource())
+		fc.handleEvent(&datasource.Event{
+			Type:     datasource.SNAPSHOT_EVENT,
+			Sequence: 1,
+			Time:     time.Now(),
+			Bids:     []*feed.Update{&feed.Update{Price: book[0], Size: book[1]}},
+			Asks:     []*feed.Update{&feed.Update{Price: book[2], Size: book[3]}},
+		})
+		feedControllers[product] = fc
+	}
+	return feedControllers
+}
+
+func TestRouterFindsTheBestRoute(t *testing.T) {
+	noFee := func(product string) decimal.Decimal { return decimal.Zero }
+	router := NewRouter(makeRoutingControllers("0.07"))
+	if paths := router.paths("ETH", "BTC"); len(paths) != 2 {
+		t.Errorf("Expected a direct and an indirect path, got %d paths", len(paths))
+	}
+
+	// Selling ETH for USD then buying BTC gives 3000 / 40010 BTC, more than the 0.07 BTC bid directly
+	route, err := router.BestRoute("ETH", "BTC", decimal.NewFromInt(1), noFee)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if route.AmountOut.String() != "0.0749812546863284" || len(route.Legs) != 2 {
+		t.Fatalf("Expected 0.0749812546863284 BTC in 2 legs, got %s in %d legs", route.AmountOut, len(route.Legs))
+	}
+	if route.Legs[0].Product != "ETH-USD" || route.Legs[0].Operation != feed.SELL_BASE ||
+		route.Legs[1].Product != "BTC-USD" || route.Legs[1].Operation != feed.SELL_QUOTE || route.Legs[1].AmountIn.String() != "3000" {
+		t.Errorf("Unexpected legs %v and %v", route.Legs[0], route.Legs[1])
+	}
+
+	router = NewRouter(makeRoutingControllers("0.08"))
+	route, _ = router.BestRoute("ETH", "BTC", decimal.NewFromInt(1), noFee)
+	if route.AmountOut.String() != "0.08" || len(route.Legs) != 1 {
+		t.Errorf("Expected the direct route to win, got %s in %d legs", route.AmountOut, len(route.Legs))
+	}
+
+	if _, err := router.BestRoute("ETH", "SOL", decimal.NewFromInt(1), noFee); !errors.Is(err, feed.ErrNoRoute) {
+		t.Errorf("Expected no route to SOL, got %v", err)
+	}
+}
+
+func TestQuoteRoute(t *testing.T) {
+	ob := NewOrderbookGrpcControllerV2(makeRoutingControllers("0.07"), nil)
+	response, err := ob.QuoteRoute(context.Background(), &rpc.RouteQuoteRequest{
+		FromAsset:        "BTC",
+		ToAsset:          "ETH",
+		Amount:           "0.5",
+		IncludeBreakdown: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Selling 0.5 BTC for 20000 USD buys 6.6644451849383539 ETH, more than 0.5 / 0.09 directly
+	if response.GetAmountOut() != "6.6644451849383539" || len(response.GetLegs()) != 2 {
+		t.Fatalf("Unexpected route %v", response)
+	}
+	leg := response.GetLegs()[1]
+	if leg.GetProduct() != "ETH-USD" || leg.GetOperation() != rpc.Operation_SELL_QUOTE || leg.GetAmountIn() != "20000" || len(leg.GetQuote().GetFills()) != 1 {
+		t.Errorf("Unexpected second leg %v", leg)
+	}
+
+	_, err = ob.QuoteRoute(context.Background(), &rpc.RouteQuoteRequest{FromAsset: "BTC", ToAsset: "SOL", Amount: "1"})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound without a route, got %v", err)
+	}
+}
+
+func makeVenueController(bids, asks []*feed.Update) *FeedController {
+	fc := NewFeedController(context.Background(), "ETH-USD", newFakeSource())
+	fc.handleEvent(&datasource.Event{
+		Type:     datasource.SNAPSHOT_EVENT,
+		Sequence: 1,
+		Time:     time.Now(),
+		Bids:     bids,
+		Asks:     asks,
+	})
+	return fc
+}
+
+func makeVenues() map[string]map[string]*FeedController {
+	return map[string]map[string]*FeedController{
+		"alpha": {"ETH-USD": makeVenueController(
+			[]*feed.Update{&feed.Update{Price: "2999", Size: "1"}},
+			[]*feed.Update{&feed.Update{Price: "3000", Size: "1"}, &feed.Update{Price: "3003", Size: "5"}},
+		)},
+		"beta": {"ETH-USD": makeVenueController(
+			[]*feed.Update{&feed.Update{Price: "2998", Size: "5"}},
+			[]*feed.Update{&feed.Update{Price: "3001", Size: "1"}, &feed.Update{Price: "3002", Size: "5"}},
+		)},
+	}
+}
+
+func TestSmartOrderRouterSplitsAcrossVenues(t *testing.T) {
+	noFee := func(venue, product string) decimal.Decimal { return decimal.Zero }
+	sor := NewSmartOrderRouter(makeVenues())
+
+	// 3 ETH takes 3000 on alpha, then 3001 and 3002 on beta
+	execution, err := sor.Plan("ETH-USD", feed.BUY_BASE, decimal.NewFromInt(3), noFee)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if execution.Amount.String() != "9003" || execution.AveragePrice.String() != "3001" || len(execution.Allocations) != 2 {
+		t.Fatalf("Unexpected execution %v", execution)
+	}
+	alpha, beta := execution.Allocations[0], execution.Allocations[1]
+	if alpha.Venue != "alpha" || alpha.Size.String() != "1" || beta.Venue != "beta" || beta.Size.String() != "2" || beta.Notional.String() != "6003" {
+		t.Errorf("Unexpected allocations %v and %v", alpha, beta)
+	}
+
+	// A 10bps fee on alpha makes its 3000 ask cost 3003, worse than beta's asks
+	alphaFee := func(venue, product string) decimal.Decimal {
+		if venue == "alpha" {
+			return decimal.NewFromInt(10)
+		}
+		return decimal.Zero
+	}
+	execution, _ = sor.Plan("ETH-USD", feed.BUY_BASE, decimal.NewFromInt(3), alphaFee)
+	if len(execution.Allocations) != 1 || execution.Allocations[0].Venue != "beta" || execution.Amount.String() != "9005" {
+		t.Errorf("Expected beta to fill everything, got %v", execution.Allocations)
+	}
+
+	execution, _ = sor.Plan("ETH-USD", feed.SELL_BASE, decimal.NewFromInt(2), noFee)
+	if execution.Amount.String() != "5997" || len(execution.Allocations) != 2 {
+		t.Errorf("Expected to sell 1 ETH on each venue for 5997, got %v", execution)
+	}
+
+	_, err = sor.Plan("ETH-USD", feed.SELL_BASE, decimal.NewFromInt(7), noFee)
+	var liquidityErr *feed.InsufficientLiquidityError
+	if !errors.As(err, &liquidityErr) || liquidityErr.MaxFillable.String() != "6" {
+		t.Errorf("Expected at most 6 ETH fillable across venues, got %v", err)
+	}
+	if _, err := sor.Plan("BTC-USD", feed.BUY_BASE, decimal.NewFromInt(1), noFee); err == nil {
+		t.Error("Expected an error for a product no venue serves")
+	}
+}
+
+func TestSmartOrderRouterSkipsInvalidVenues(t *testing.T) {
+	venues := makeVenues()
+	venues["alpha"]["ETH-USD"].orderbook.Invalidate()
+	sor := NewSmartOrderRouter(venues)
+	execution, err := sor.Plan("ETH-USD", feed.BUY_BASE, decimal.NewFromInt(1), func(venue, product string) decimal.Decimal { return decimal.Zero })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(execution.Allocations) != 1 || execution.Allocations[0].Venue != "beta" {
+		t.Errorf("Expected alpha to be left out, got %v", execution.Allocations)
+	}
+}
+
+func TestPlanExecution(t *testing.T) {
+	ob := NewOrderbookGrpcControllerV2(map[string]*FeedController{}, nil)
+	ob.SetSmartOrderRouter(NewSmartOrderRouter(makeVenues()))
+	response, err := ob.PlanExecution(context.Background(), &rpc.ExecutionRequest{
+		Product:          "ETH-USD",
+		Operation:        rpc.Operation_BUY_BASE,
+		Amount:           "3",
+		IncludeBreakdown: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.GetAmount() != "9003" || len(response.GetAllocations()) != 2 || len(response.GetAllocations()[1].GetFills()) != 2 {
+		t.Fatalf("Unexpected execution %v", response)
+	}
+
+	_, err = ob.PlanExecution(context.Background(), &rpc.ExecutionRequest{Product: "ETH-USD", Operation: rpc.Operation_BUY_QUOTE, Amount: "3"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for BUY_QUOTE, got %v", err)
+	}
+}
+
+func TestPlanExecutionChargesEachVenueItsOwnFee(t *testing.T) {
+	asks := []*feed.Update{&feed.Update{Price: "3000", Size: "1"}, &feed.Update{Price: "3020", Size: "5"}}
+	bids := []*feed.Update{&feed.Update{Price: "2990", Size: "1"}}
+	venues := map[string]map[string]*FeedController{
+		"alpha": {"ETH-USD": makeVenueController(bids, asks)},
+		"beta":  {"ETH-USD": makeVenueController(bids, asks)},
+	}
+	takerFee := func(bps int64) *feed.FeeSchedule {
+		return &feed.FeeSchedule{Tiers: []*feed.FeeTier{{TakerBps: decimal.NewFromInt(bps)}}}
+	}
+	ob := NewOrderbookGrpcControllerV2(map[string]*FeedController{}, nil)
+	ob.SetSmartOrderRouter(NewSmartOrderRouter(venues))
+	ob.SetVenueFeeSchedules(map[string]*feed.FeeSchedule{"alpha": takerFee(50)})
+
+	request := &rpc.ExecutionRequest{Product: "ETH-USD", Operation: rpc.Operation_BUY_BASE, Amount: "1", NetOfFees: true}
+	_, err := ob.PlanExecution(context.Background(), request)
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Expected FailedPrecondition while beta has no fee schedule, got %v", err)
+	}
+
+	// Both venues ask 3000, beta is cheaper after its 10bps fee although alpha sorts first
+	ob.SetVenueFeeSchedules(map[string]*feed.FeeSchedule{"alpha": takerFee(50), "beta": takerFee(10)})
+	response, err := ob.PlanExecution(context.Background(), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.GetAllocations()) != 1 || response.GetAllocations()[0].GetVenue() != "beta" || response.GetAmount() != "3003" {
+		t.Errorf("Expected beta to fill the whole order for 3003, got %v", response)
+	}
+
+	// Once beta's best ask is used up, alpha's 3000 ask costs 3015 after fees and beats beta's 3020
+	request.Amount = "2"
+	response, _ = ob.PlanExecution(context.Background(), request)
+	if len(response.GetAllocations()) != 2 || response.GetAllocations()[0].GetFee() != "15" || response.GetAllocations()[1].GetFee() != "3" {
+		t.Errorf("Expected 1 ETH on each venue, each paying its own fee, got %v", response)
+	}
+}
+
+func TestGetConsolidatedOrderbook(t *testing.T) {
+	venues := makeVenues()
+	venues["gamma"] = map[string]*FeedController{"ETH-USD": NewFeedController(context.Background(), "ETH-USD", newFakeSource())}
+	ob := NewOrderbookGrpcControllerV2(map[string]*FeedController{}, nil)
+	ob.SetSmartOrderRouter(NewSmartOrderRouter(venues))
+
+	response, err := ob.GetConsolidatedOrderbook(context.Background(), &rpc.OrderbookRequest{Product: "ETH-USD", Depth: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.GetAsks()) != 2 || response.GetAsks()[1].GetSources()[0].GetVenue() != "beta" || response.GetMid() != "2999.5" {
+		t.Errorf("Unexpected consolidated book %v", response)
+	}
+	gamma := response.GetVenues()[2]
+	if gamma.GetVenue() != "gamma" || codes.Code(gamma.GetError().GetCode()) != codes.Unavailable {
+		t.Errorf("Expected gamma to be left out without a snapshot, got %v", gamma)
+	}
+
+	if response.GetCrossed() || response.GetAsks()[0].GetCrossed() {
+		t.Errorf("Expected the book not to be crossed, got %v", response)
+	}
+
+	// 2 ETH buys 1 at 3000 on alpha and 1 at 3001 on beta
+	quote, err := ob.QuoteConsolidated(context.Background(), &rpc.ConsolidatedQuoteRequest{
+		Product:          "ETH-USD",
+		Operation:        rpc.Operation_BUY_BASE,
+		Amount:           "2",
+		IncludeBreakdown: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quote.GetQuote().GetAmount() != "6001" || len(quote.GetQuote().GetFills()) != 2 || len(quote.GetVenues()) != 3 {
+		t.Errorf("Unexpected consolidated quote %v", quote)
+	}
+
+	_, err = ob.GetConsolidatedOrderbook(context.Background(), &rpc.OrderbookRequest{Product: "BTC-USD"})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound, got %v", err)
+	}
+}
+
+func makeOrderEvent(sequence int64, update *feed.OrderUpdate) *datasource.Event {
+	return &datasource.Event{
+		Type:     datasource.ORDER_EVENT,
+		Sequence: sequence,
+		Product:  "ETH-USD",
+		Time:     time.Now(),
+		Orders:   []*feed.OrderUpdate{update},
+	}
+}
+
+func TestOrderFeedControllerHoldsEventsUntilSnapshot(t *testing.T) {
+	source := newFakeSource()
+	oc := NewOrderFeedController(context.Background(), "ETH-USD", source)
+
+	// The first event is already part of the snapshot, the second follows it
+	oc.handleEvent(makeOrderEvent(1, &feed.OrderUpdate{Type: feed.ORDER_OPEN, Sequence: 10, OrderID: "bid-1", Side: feed.BIDS, Price: "99", Size: "1"}))
+	oc.handleEvent(makeOrderEvent(2, &feed.OrderUpdate{Type: feed.ORDER_OPEN, Sequence: 11, OrderID: "bid-2", Side: feed.BIDS, Price: "99", Size: "2"}))
+	oc.handleEvent(&datasource.Event{
+		Type:             datasource.ORDER_SNAPSHOT_EVENT,
+		Sequence:         3,
+		Time:             time.Now(),
+		ExchangeSequence: 10,
+		Orders: []*feed.OrderUpdate{
+			{Type: feed.ORDER_OPEN, Sequence: 10, OrderID: "bid-1", Side: feed.BIDS, Price: "99", Size: "1"},
+			{Type: feed.ORDER_OPEN, Sequence: 10, OrderID: "ask-1", Side: feed.ASKS, Price: "101", Size: "1"},
+		},
+	})
+	depth, _, err := oc.GetDepth(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if depth.Bids[0].Orders != 2 || depth.Bids[0].Size.String() != "3" {
+		t.Errorf("Expected the held order to be applied once, got %v", depth.Bids[0])
+	}
+
+	// Skipping an exchange sequence number invalidates the book and requests a snapshot
+	oc.handleEvent(makeOrderEvent(4, &feed.OrderUpdate{Type: feed.ORDER_DONE, Sequence: 13, OrderID: "bid-1", Side: feed.BIDS}))
+	if source.snapshotRequests != 1 {
+		t.Errorf("Expected a snapshot request, got %d", source.snapshotRequests)
+	}
+	if _, _, err := oc.GetDepth(0); !errors.Is(err, feed.ErrNoSnapshot) {
+		t.Errorf("Expected the book to be invalidated, got %v", err)
+	}
+}
+
+func TestOrderFeedControllerRequestsAnotherSnapshotWhenOneIsRejected(t *testing.T) {
+	source := newFakeSource()
+	oc := NewOrderFeedController(context.Background(), "ETH-USD", source)
+	snapshot := func(sequence, exchangeSequence int64) *datasource.Event {
+		return &datasource.Event{
+			Type:             datasource.ORDER_SNAPSHOT_EVENT,
+			Sequence:         sequence,
+			Time:             time.Now(),
+			ExchangeSequence: exchangeSequence,
+			Orders: []*feed.OrderUpdate{
+				{Type: feed.ORDER_OPEN, Sequence: exchangeSequence, OrderID: "bid-1", Side: feed.BIDS, Price: "99", Size: "1"},
+			},
+		}
+	}
+
+	oc.handleEvent(snapshot(1, 10))
+	oc.handleEvent(makeOrderEvent(2, &feed.OrderUpdate{Type: feed.ORDER_OPEN, Sequence: 11, OrderID: "bid-2", Side: feed.BIDS, Price: "99", Size: "2"}))
+	// The source dropped event 3, the held update follows the book and would not trigger another resync
+	oc.handleEvent(makeOrderEvent(4, &feed.OrderUpdate{Type: feed.ORDER_DONE, Sequence: 12, OrderID: "bid-1", Side: feed.BIDS}))
+	if source.snapshotRequests != 1 {
+		t.Fatalf("Expected a snapshot request, got %d", source.snapshotRequests)
+	}
+
+	// A snapshot taken before the last update is rejected and another one requested
+	oc.handleEvent(snapshot(5, 11))
+	if source.snapshotRequests != 2 || !oc.resyncing {
+		t.Errorf("Expected the resync to carry on with a new request, got %d requests", source.snapshotRequests)
+	}
+	if _, _, err := oc.GetDepth(0); !errors.Is(err, feed.ErrNoSnapshot) {
+		t.Errorf("Expected the book to stay invalid after an older snapshot, got %v", err)
+	}
+
+	oc.handleEvent(snapshot(6, 12))
+	if _, _, err := oc.GetDepth(0); err != nil || oc.resyncing {
+		t.Errorf("Expected the book to be valid after a new snapshot, got %v", err)
+	}
+}
+
+func TestHealthReporterSetsStatusPerLevel3Book(t *testing.T) {
+	source := newFakeSource()
+	oc := NewOrderFeedController(context.Background(), "ETH-USD", source)
+	server := health.NewServer()
+	hr := NewHealthReporter(context.Background(), server, map[string]*FeedController{})
+	hr.SetOrderFeedControllers(map[string]*OrderFeedController{"ETH-USD": oc})
+
+	status := func(service string) healthpb.HealthCheckResponse_ServingStatus {
+		response, err := server.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+		if err != nil {
+			t.Fatalf("Health check for %q failed: %s", service, err.Error())
+		}
+		return response.GetStatus()
+	}
+	hr.check()
+	if status("ETH-USD/l3") != healthpb.HealthCheckResponse_NOT_SERVING || status("") != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Error("Expected a level 3 book without a snapshot to not be serving")
+	}
+
+	oc.handleEvent(&datasource.Event{
+		Type:             datasource.ORDER_SNAPSHOT_EVENT,
+		Sequence:         1,
+		Time:             time.Now(),
+		ExchangeSequence: 10,
+		Orders: []*feed.OrderUpdate{
+			{Type: feed.ORDER_OPEN, Sequence: 10, OrderID: "bid-1", Side: feed.BIDS, Price: "99", Size: "1"},
+		},
+	})
+	hr.check()
+	if status("ETH-USD/l3") != healthpb.HealthCheckResponse_SERVING || status("") != healthpb.HealthCheckResponse_SERVING {
+		t.Error("Expected a synced level 3 book to be serving")
+	}
+
+	// A gap in exchange sequence numbers resyncs the book, which is not served until the snapshot arrives
+	oc.handleEvent(makeOrderEvent(2, &feed.OrderUpdate{Type: feed.ORDER_DONE, Sequence: 12, OrderID: "bid-1", Side: feed.BIDS}))
+	hr.check()
+	if status("ETH-USD/l3") != healthpb.HealthCheckResponse_NOT_SERVING || status("") != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Error("Expected a resyncing level 3 book to not be serving")
+	}
+
+	oc.handleEvent(&datasource.Event{Type: datasource.SOURCE_FAILED_EVENT, Sequence: 3, Product: "ETH-USD"})
+	if oc.Health() == nil {
+		t.Error("Expected a level 3 book with a failed source to be unhealthy")
+	}
+}
+
+func TestGetQueuePosition(t *testing.T) {
+	oc := NewOrderFeedController(context.Background(), "ETH-USD", newFakeSource())
+	oc.handleEvent(&datasource.Event{
+		Type:             datasource.ORDER_SNAPSHOT_EVENT,
+		Sequence:         1,
+		Time:             time.Now(),
+		ExchangeSequence: 10,
+		Orders: []*feed.OrderUpdate{
+			{Type: feed.ORDER_OPEN, Sequence: 10, OrderID: "ask-1", Side: feed.ASKS, Price: "101", Size: "1"},
+			{Type: feed.ORDER_OPEN, Sequence: 10, OrderID: "ask-2", Side: feed.ASKS, Price: "101", Size: "2"},
+		},
+	})
+	ob := NewOrderbookGrpcControllerV2(map[string]*FeedController{}, nil)
+	ob.SetOrderFeedControllers(map[string]*OrderFeedController{"ETH-USD": oc})
+
+	response, err := ob.GetQueuePosition(context.Background(), &rpc.QueuePositionRequest{
+		Product: "ETH-USD",
+		Order:   &rpc.QueuePositionRequest_OrderId{OrderId: "ask-2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.GetSide() != rpc.Side_ASK || response.GetOrdersAhead() != 1 || response.GetSizeAhead() != "1" || response.GetSize() != "2" {
+		t.Errorf("Unexpected queue position %v", response)
+	}
+
+	response, _ = ob.GetQueuePosition(context.Background(), &rpc.QueuePositionRequest{
+		Product: "ETH-USD",
+		Order:   &rpc.QueuePositionRequest_NewOrder{NewOrder: &rpc.NewOrder{Side: rpc.Side_ASK, Price: "101"}},
+	})
+	if response.GetOrdersAhead() != 2 || response.GetSizeAhead() != "3" || response.GetOrderId() != "" {
+		t.Errorf("Expected a new ask to queue behind both orders, got %v", response)
+	}
+
+	_, err = ob.GetQueuePosition(context.Background(), &rpc.QueuePositionRequest{
+		Product: "ETH-USD",
+		Order:   &rpc.QueuePositionRequest_OrderId{OrderId: "unknown"},
+	})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound for an unknown order, got %v", err)
+	}
+	levels, err := ob.GetOrderbookL3(context.Background(), &rpc.OrderbookL3Request{Product: "ETH-USD"})
+	if err != nil || levels.GetAsks()[0].GetOrders() != 2 {
+		t.Errorf("Expected 2 orders at 101, got %v and %v", levels, err)
+	}
+}
+
+func TestLateTradeOnlyMissesClosedCandles(t *testing.T) {
+	fc := NewFeedController(context.Background(), "ETH-DAI", newFakeSource())
+	start := time.Now().Truncate(time.Minute)
+	trade := func(sequence int64, size string, at time.Time) {
+		fc.handleEvent(&datasource.Event{
+			Type:          datasource.TRADE_EVENT,
+			Sequence:      sequence,
+			TradeSequence: sequence,
+			Time:          at,
+			Trades: []*feed.Trade{{
+				TradeID: sequence,
+				Side:    feed.TRADE_BUY,
+				Price:   decimal.RequireFromString("334"),
+				Size:    decimal.RequireFromString(size),
+				Time:    at,
+			}},
+		})
+	}
+	trade(1, "1", start.Add(10*time.Second))
+	trade(2, "1", start.Add(20*time.Second))
+	// Arrives once its second is closed, but within the current minute
+	trade(3, "5", start.Add(15*time.Second))
+
+	if trades, _ := fc.RecentTrades(0); len(trades) != 3 || trades[0].TradeID != 3 {
+		t.Errorf("Expected the late trade to be on the tape, got %v", trades)
+	}
+	stats, err := fc.tape.Stats(TRADE_TAPE_RETENTION, start.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	minutes, err := fc.Candles(time.Minute, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if volume := minutes[len(minutes)-1].Volume; !volume.Equal(stats.Volume) || volume.String() != "7" {
+		t.Errorf("Expected the minute to match the tape volume of 7, got %s and %s", volume, stats.Volume)
+	}
+	seconds, _ := fc.Candles(time.Second, 0, true)
+	for _, candle := range seconds {
+		if candle.Volume.GreaterThan(decimal.NewFromInt(1)) {
+			t.Errorf("Expected the late trade to miss the closed second, got %v", candle)
+		}
+	}
+}
+
+func TestTradeTapeRPCs(t *testing.T) {
+	fc := NewFeedController(context.Background(), "ETH-USD", newFakeSource())
+	ob := NewOrderbookGrpcControllerV2(map[string]*FeedController{"ETH-USD": fc}, nil)
+	_, err := ob.GetLastTrade(context.Background(), &rpc.TradesRequest{Product: "ETH-USD"})
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("Expected Unavailable before any trade, got %v", err)
+	}
+
+	for idx, price := range []string{"3000", "3002"} {
+		fc.handleEvent(&datasource.Event{
+			Type:     datasource.TRADE_EVENT,
+			Sequence: int64(idx + 1),
+			Time:     time.Now(),
+			Trades: []*feed.Trade{{
+				TradeID: int64(idx + 1),
+				Side:    feed.TRADE_BUY,
+				Price:   decimal.RequireFromString(price),
+				Size:    decimal.NewFromInt(1),
+				Time:    time.Now(),
+			}},
+		})
+	}
+	last, err := ob.GetLastTrade(context.Background(), &rpc.TradesRequest{Product: "ETH-USD"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.GetTrade().GetPrice() != "3002" || last.GetTrade().GetSide() != rpc.TradeSide_BUY {
+		t.Errorf("Unexpected last trade %v", last)
+	}
+	recent, _ := ob.GetRecentTrades(context.Background(), &rpc.TradesRequest{Product: "ETH-USD", Limit: 1})
+	if len(recent.GetTrades()) != 1 || recent.GetTrades()[0].GetTradeId() != 2 {
+		t.Errorf("Expected only the last trade, got %v", recent)
+	}
+
+	stats, err := ob.GetTradeStats(context.Background(), &rpc.TradeStatsRequest{Product: "ETH-USD", WindowSeconds: []int64{60}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.GetStats()) != 1 || stats.GetStats()[0].GetVolume() != "2" || stats.GetStats()[0].GetVwap() != "3001" {
+		t.Errorf("Unexpected trade stats %v", stats)
+	}
+	_, err = ob.GetTradeStats(context.Background(), &rpc.TradeStatsRequest{Product: "ETH-USD", WindowSeconds: []int64{86400}})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for a day long window, got %v", err)
+	}
+}
+
+// fakeCandleStream collects the candles sent on a StreamCandles call.
+type fakeCandleStream struct {
+	grpc.ServerStream
+	ctx     context.Context
+	candles chan *rpc.Candle
+}
+
+func (fs *fakeCandleStream) Context() context.Context { return fs.ctx }
+func (fs *fakeCandleStream) Send(candle *rpc.Candle) error {
+	fs.candles <- candle
+	return nil
+}
+
+func TestCandleRPCs(t *testing.T) {
+	ctx, cancelFn := context.WithCancel(context.Background())
+	defer cancelFn()
+	fc := NewFeedController(ctx, "ETH-DAI", newFakeSource())
+	ob := NewOrderbookGrpcControllerV2(map[string]*FeedController{"ETH-DAI": fc}, nil)
+	// The book is only valid if updated within the last seconds, so everything happens now
+	now := time.Now()
+	snapshot := makeSnapshotEvent(1)
+	snapshot.Time = now
+	fc.handleEvent(snapshot)
+	trade := func(sequence int64, price string) {
+		fc.handleEvent(&datasource.Event{
+			Type:     datasource.TRADE_EVENT,
+			Sequence: sequence,
+			Time:     now,
+			Trades: []*feed.Trade{{
+				TradeID: sequence,
+				Side:    feed.TRADE_SELL,
+				Price:   decimal.RequireFromString(price),
+				Size:    decimal.NewFromInt(1),
+				Time:    now,
+			}},
+		})
+	}
+	trade(2, "334")
+	trade(3, "333")
+
+	stream := &fakeCandleStream{ctx: ctx, candles: make(chan *rpc.Candle, 10)}
+	go ob.StreamCandles(&rpc.CandlesStreamRequest{Product: "ETH-DAI", Intervals: []rpc.CandleInterval{rpc.CandleInterval_ONE_MINUTE}}, stream)
+	for subscribed := false; !subscribed; time.Sleep(time.Millisecond) {
+		fc.candleLock.Lock()
+		subscribed = len(fc.candleSubs) > 0
+		fc.candleLock.Unlock()
+	}
+
+	// Closing the minute sends it on the stream, but not the seconds closed along with it
+	fc.publishCandles(fc.candles.Advance(now.Truncate(time.Minute).Add(time.Minute)))
+	select {
+	case candle := <-stream.candles:
+		if candle.GetInterval() != rpc.CandleInterval_ONE_MINUTE || candle.GetOpen() != "334" || candle.GetClose() != "333" ||
+			candle.GetMidClose() != "334.16" || !candle.GetClosed() {
+			t.Errorf("Unexpected candle %v", candle)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for a candle")
+	}
+	select {
+	case candle := <-stream.candles:
+		t.Errorf("Expected a single candle, got %v", candle)
+	default:
+	}
+
+	response, err := ob.GetCandles(context.Background(), &rpc.CandlesRequest{Product: "ETH-DAI", Interval: rpc.CandleInterval_ONE_SECOND, Limit: 1, IncludeOpen: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	candles := response.GetCandles()
+	if len(candles) != 2 || !candles[0].GetClosed() || candles[1].GetClosed() || candles[1].GetVolume() != "0" || candles[1].GetClose() != "333" {
+		t.Errorf("Expected the last closed second and the open one, flat at the last trade, got %v", candles)
+	}
+	_, err = ob.GetCandles(context.Background(), &rpc.CandlesRequest{Product: "ETH-DAI"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument without an interval, got %v", err)
 	}
 }
@@ -0,0 +1,133 @@
+package controller
+
+import (
+	"errors"
+
+	"pirosb3/real_feed/feed"
+
+	"github.com/golang/protobuf/proto"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ERROR_DOMAIN is the domain of every errdetails.ErrorInfo returned by the service.
+const ERROR_DOMAIN = "real_feed"
+
+// Reasons set on errdetails.ErrorInfo, so that clients can tell errors apart without matching messages.
+const (
+	REASON_NO_SNAPSHOT            = "NO_SNAPSHOT"
+	REASON_STALE_BOOK             = "STALE_BOOK"
+	REASON_INSUFFICIENT_LIQUIDITY = feed.INSUFFICIENT_LIQUIDITY
+	REASON_INVALID_ARGUMENT       = "INVALID_ARGUMENT"
+	REASON_UNKNOWN_PRODUCT        = "UNKNOWN_PRODUCT"
+	REASON_NO_FEE_SCHEDULE        = "NO_FEE_SCHEDULE"
+	REASON_NO_ROUTE               = "NO_ROUTE"
+	REASON_UNKNOWN_ORDER          = "UNKNOWN_ORDER"
+	REASON_NO_TRADES              = "NO_TRADES"
+	REASON_INTERNAL               = "INTERNAL"
+)
+
+// statusFromError converts an error returned by the feed package into a gRPC status error. Every
+// status carries an errdetails.ErrorInfo, some carry further details:
+//   - no snapshot, stale book, no trade yet: Unavailable, the client may retry later
+//   - insufficient liquidity: FailedPrecondition, the ErrorInfo metadata holds the `maxFillable` amount
+//   - invalid amount, depth, operation or window: InvalidArgument, with an errdetails.BadRequest naming `field`
+//   - unknown product: NotFound, with an errdetails.ResourceInfo naming the product
+//   - no route between two assets: NotFound
+//   - order not on the level 3 book: NotFound
+func statusFromError(err error, product string, field string) error {
+	var liquidityErr *feed.InsufficientLiquidityError
+	var productErr *feed.UnknownProductError
+	errorInfo := &errdetails.ErrorInfo{
+		Domain:   ERROR_DOMAIN,
+		Metadata: map[string]string{"product": product},
+	}
+
+	switch {
+	case errors.Is(err, feed.ErrNoSnapshot):
+		errorInfo.Reason = REASON_NO_SNAPSHOT
+		return withDetails(status.New(codes.Unavailable, err.Error()), errorInfo)
+	case errors.Is(err, feed.ErrStaleBook):
+		errorInfo.Reason = REASON_STALE_BOOK
+		return withDetails(status.New(codes.Unavailable, err.Error()), errorInfo)
+	case errors.Is(err, feed.ErrNoTrades):
+		errorInfo.Reason = REASON_NO_TRADES
+		return withDetails(status.New(codes.Unavailable, err.Error()), errorInfo)
+	case errors.As(err, &liquidityErr):
+		errorInfo.Reason = REASON_INSUFFICIENT_LIQUIDITY
+		errorInfo.Metadata["maxFillable"] = liquidityErr.MaxFillable.String()
+		return withDetails(status.New(codes.FailedPrecondition, err.Error()), errorInfo)
+	case errors.Is(err, feed.ErrInvalidAmount), errors.Is(err, feed.ErrInvalidDepth), errors.Is(err, feed.ErrUnsupportedOperation),
+		errors.Is(err, feed.ErrInvalidWindow):
+		errorInfo.Reason = REASON_INVALID_ARGUMENT
+		badRequest := &errdetails.BadRequest{
+			FieldViolations: []*errdetails.BadRequest_FieldViolation{
+				{Field: field, Description: err.Error()},
+			},
+		}
+		return withDetails(status.New(codes.InvalidArgument, err.Error()), errorInfo, badRequest)
+	case errors.Is(err, feed.ErrNoRoute):
+		errorInfo.Reason = REASON_NO_ROUTE
+		return withDetails(status.New(codes.NotFound, err.Error()), errorInfo)
+	case errors.Is(err, feed.ErrUnknownOrder):
+		errorInfo.Reason = REASON_UNKNOWN_ORDER
+		return withDetails(status.New(codes.NotFound, err.Error()), errorInfo)
+	case errors.As(err, &productErr):
+		errorInfo.Reason = REASON_UNKNOWN_PRODUCT
+		resourceInfo := &errdetails.ResourceInfo{
+			ResourceType: "market",
+			ResourceName: productErr.Product,
+			Description:  err.Error(),
+		}
+		return withDetails(status.New(codes.NotFound, err.Error()), errorInfo, resourceInfo)
+	}
+	errorInfo.Reason = REASON_INTERNAL
+	return withDetails(status.New(codes.Internal, err.Error()), errorInfo)
+}
+
+// invalidArgument returns an InvalidArgument status for a request `field` that could not be parsed.
+func invalidArgument(field string, description string, product string) error {
+	errorInfo := &errdetails.ErrorInfo{
+		Reason:   REASON_INVALID_ARGUMENT,
+		Domain:   ERROR_DOMAIN,
+		Metadata: map[string]string{"product": product},
+	}
+	badRequest := &errdetails.BadRequest{
+		FieldViolations: []*errdetails.BadRequest_FieldViolation{
+			{Field: field, Description: description},
+		},
+	}
+	return withDetails(status.New(codes.InvalidArgument, description), errorInfo, badRequest)
+}
+
+// noFeeSchedule returns a FailedPrecondition status for quotes net of fees when no fee schedule is configured.
+func noFeeSchedule(product string) error {
+	errorInfo := &errdetails.ErrorInfo{
+		Reason:   REASON_NO_FEE_SCHEDULE,
+		Domain:   ERROR_DOMAIN,
+		Metadata: map[string]string{"product": product},
+	}
+	return withDetails(status.New(codes.FailedPrecondition, "No fee schedule is configured"), errorInfo)
+}
+
+// noVenueFeeSchedule returns a FailedPrecondition status for executions net of fees routed to a venue
+// without a fee schedule.
+func noVenueFeeSchedule(product string, venue string) error {
+	errorInfo := &errdetails.ErrorInfo{
+		Reason:   REASON_NO_FEE_SCHEDULE,
+		Domain:   ERROR_DOMAIN,
+		Metadata: map[string]string{"product": product, "venue": venue},
+	}
+	return withDetails(status.New(codes.FailedPrecondition, "No fee schedule is configured for venue "+venue), errorInfo)
+}
+
+func withDetails(st *status.Status, details ...proto.Message) error {
+	detailed, err := st.WithDetails(details...)
+	if err != nil {
+		log.WithField("err", err.Error()).Errorln("Failed to attach error details")
+		return st.Err()
+	}
+	return detailed.Err()
+}
@@ -0,0 +1,115 @@
+package controller
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const HEALTH_CHECK_INTERVAL = time.Second
+
+// L3_SERVICE_SUFFIX is appended to the product to name the service of its level 3 book.
+const L3_SERVICE_SUFFIX = "/l3"
+
+var marketServingGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name:      "serving",
+	Help:      "Is 1 while a market is reported as serving through gRPC health checking, 0 otherwise",
+	Namespace: "feed",
+}, []string{"market"})
+
+// healthChecker is a book whose health is reported, FeedController or OrderFeedController.
+type healthChecker interface {
+	Health() error
+}
+
+// HealthReporter keeps a gRPC health server up to date with the health of every market. Each
+// market is reported as its own service, named after the product (example: "ETH-USD"), level 3
+// books are reported under the product followed by L3_SERVICE_SUFFIX (example: "ETH-USD/l3"), and
+// the overall service "" is serving only while every market and level 3 book is.
+type HealthReporter struct {
+	ctx      context.Context
+	server   *health.Server
+	services map[string]healthChecker
+	serving  map[string]bool
+}
+
+// NewHealthReporter creates a reporter for `feedControllers`. Statuses are only updated once
+// `.Start()` is called, until then every market is reported as not serving.
+func NewHealthReporter(ctx context.Context, server *health.Server, feedControllers map[string]*FeedController) *HealthReporter {
+	hr := &HealthReporter{
+		ctx:      ctx,
+		server:   server,
+		services: make(map[string]healthChecker),
+		serving:  make(map[string]bool),
+	}
+	server.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	for product, fc := range feedControllers {
+		hr.addService(product, fc)
+	}
+	return hr
+}
+
+// SetOrderFeedControllers reports the health of the level 3 books of `orderFeedControllers` as well.
+// It must be called before `.Start()`.
+func (hr *HealthReporter) SetOrderFeedControllers(orderFeedControllers map[string]*OrderFeedController) {
+	for product, oc := range orderFeedControllers {
+		hr.addService(product+L3_SERVICE_SUFFIX, oc)
+	}
+}
+
+func (hr *HealthReporter) addService(service string, checker healthChecker) {
+	hr.services[service] = checker
+	hr.server.SetServingStatus(service, healthpb.HealthCheckResponse_NOT_SERVING)
+}
+
+// Start checks the health of every market every HEALTH_CHECK_INTERVAL. The function call does not block.
+func (hr *HealthReporter) Start() {
+	go func() {
+		ticker := time.NewTicker(HEALTH_CHECK_INTERVAL)
+		defer ticker.Stop()
+		for {
+			hr.check()
+			select {
+			case <-hr.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (hr *HealthReporter) check() {
+	allServing := true
+	for service, checker := range hr.services {
+		err := checker.Health()
+		serving := err == nil
+		allServing = allServing && serving
+
+		if previous, ok := hr.serving[service]; !ok || previous != serving {
+			if serving {
+				log.WithField("market", service).Infoln("Market is serving")
+			} else {
+				log.WithField("market", service).WithField("reason", err.Error()).Warningln("Market is not serving")
+			}
+		}
+		hr.serving[service] = serving
+		status := healthpb.HealthCheckResponse_NOT_SERVING
+		servingValue := 0.0
+		if serving {
+			status = healthpb.HealthCheckResponse_SERVING
+			servingValue = 1
+		}
+		hr.server.SetServingStatus(service, status)
+		marketServingGauge.WithLabelValues(service).Set(servingValue)
+	}
+	if allServing {
+		hr.server.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	} else {
+		hr.server.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	}
+}
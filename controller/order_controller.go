@@ -0,0 +1,238 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"pirosb3/real_feed/datasource"
+	"pirosb3/real_feed/feed"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/shopspring/decimal"
+	log "github.com/sirupsen/logrus"
+)
+
+// MAX_PENDING_ORDER_EVENTS bounds how many order events are held while waiting for a level 3
+// snapshot. Once exceeded they are dropped and another snapshot is requested.
+const MAX_PENDING_ORDER_EVENTS = 50000
+
+var ordersGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name:      "l3Orders",
+	Help:      "Number of orders resting on the level 3 book",
+	Namespace: "feed",
+}, []string{"uuid", "market", "side"})
+
+// OrderFeedController keeps a level 3 book for `product` up to date with the order events emitted by
+// a full channel source, see datasource.NewCoinbaseProFullChannelWebsocket. Order events received
+// before the snapshot are held, and those that follow the snapshot are applied once it arrives.
+type OrderFeedController struct {
+	orderbook    *feed.OrderbookL3
+	source       datasource.Source
+	ctx          context.Context
+	startLock    sync.Mutex
+	stopFn       context.CancelFunc
+	started      bool
+	product      string
+	uuid         string
+	lastSequence int64
+	synced       bool
+	resyncing    bool
+	pending      []*datasource.Event
+
+	healthLock    sync.Mutex
+	lastEventTime time.Time
+	sourceFailed  bool
+}
+
+// NewOrderFeedController creates a controller that keeps a level 3 book for `product` up to date
+// with the events emitted by `source`. The source is started along with the controller.
+func NewOrderFeedController(
+	ctx context.Context,
+	product string,
+	source datasource.Source,
+) *OrderFeedController {
+	aUUID, _ := uuid.NewUUID()
+	newContext, stopFn := context.WithCancel(ctx)
+	return &OrderFeedController{
+		uuid:      aUUID.String(),
+		orderbook: feed.NewOrderbookL3(product),
+		stopFn:    stopFn,
+		ctx:       newContext,
+		source:    source,
+		product:   product,
+	}
+}
+
+func (oc *OrderFeedController) Start() error {
+	oc.startLock.Lock()
+	defer oc.startLock.Unlock()
+	if oc.started {
+		return errors.New("Order Feed Controller is already started and cannot be restarted. Please create a new instance")
+	}
+	oc.started = true
+	if err := oc.source.Start(); err != nil {
+		return err
+	}
+
+	go oc.runOrderbookReporter()
+	go oc.runLoop()
+	return nil
+}
+
+func (oc *OrderFeedController) Stop() {
+	if oc.started {
+		oc.stopFn()
+	}
+}
+
+func (oc *OrderFeedController) runOrderbookReporter() {
+	timer := time.NewTicker(ORDERBOOK_REPORT_TICKER_SECS * time.Second)
+	defer timer.Stop()
+	for {
+		select {
+		case <-oc.ctx.Done():
+			return
+		case <-timer.C:
+			bids, asks := oc.orderbook.GetOrderCount()
+			ordersGauge.WithLabelValues(oc.uuid, oc.product, "bids").Set(float64(bids))
+			ordersGauge.WithLabelValues(oc.uuid, oc.product, "asks").Set(float64(asks))
+		}
+	}
+}
+
+func (oc *OrderFeedController) runLoop() {
+	for {
+		select {
+		case <-oc.ctx.Done():
+			log.Warning("Order feed controller event loop shut down")
+			return
+		case event := <-oc.source.Events():
+			oc.handleEvent(event)
+		}
+	}
+}
+
+// resync invalidates the book and asks the source for a fresh snapshot. Further calls are ignored
+// until the snapshot arrives, unless too many events are pending, which means it never will.
+func (oc *OrderFeedController) resync(reason string) {
+	oc.synced = false
+	if oc.resyncing {
+		return
+	}
+	log.WithField("market", oc.product).WithField("reason", reason).Warningln("Level 3 book out of sync, requesting a new snapshot")
+	resyncCounter.WithLabelValues(oc.uuid, oc.product, reason).Inc()
+	oc.resyncing = true
+	oc.orderbook.Invalidate()
+	oc.source.RequestSnapshot()
+}
+
+// hold keeps `event` until the next snapshot.
+func (oc *OrderFeedController) hold(event *datasource.Event) {
+	if len(oc.pending) >= MAX_PENDING_ORDER_EVENTS {
+		oc.pending = nil
+		oc.resyncing = false
+		oc.resync("snapshot_timeout")
+	}
+	oc.pending = append(oc.pending, event)
+}
+
+// apply applies the orders of `event`, holding it instead if the book turns out to be out of sync.
+func (oc *OrderFeedController) apply(event *datasource.Event) {
+	for _, update := range event.Orders {
+		if _, err := oc.orderbook.Apply(event.Time.Unix(), update); err != nil {
+			log.WithField("market", oc.product).WithField("err", err.Error()).Warningln("Failed to apply order update")
+			oc.resync("exchange_gap")
+			oc.hold(event)
+			return
+		}
+	}
+}
+
+func (oc *OrderFeedController) handleEvent(event *datasource.Event) {
+	oc.healthLock.Lock()
+	oc.lastEventTime = time.Now()
+	if event.Type == datasource.SOURCE_FAILED_EVENT {
+		oc.sourceFailed = true
+	}
+	oc.healthLock.Unlock()
+
+	// Events are numbered by the source, any gap means an event was dropped
+	if oc.lastSequence > 0 && event.Sequence != oc.lastSequence+1 {
+		log.WithField("expected", oc.lastSequence+1).WithField("received", event.Sequence).Warningln("Gap in event sequence")
+		oc.resync("gap")
+	}
+	oc.lastSequence = event.Sequence
+
+	switch event.Type {
+	case datasource.ORDER_SNAPSHOT_EVENT:
+		// A snapshot older than the book is rejected, the book stays as it was and a resync carries on
+		if !oc.orderbook.SetSnapshot(event.Time.Unix(), event.ExchangeSequence, event.Orders) {
+			if oc.resyncing {
+				oc.source.RequestSnapshot()
+			}
+			return
+		}
+		log.WithField("market", oc.product).WithField("numOrders", len(event.Orders)).Infoln("Set new level 3 snapshot")
+		oc.synced = true
+		oc.resyncing = false
+		// Events already part of the snapshot are skipped by the book
+		pending := oc.pending
+		oc.pending = nil
+		for _, pendingEvent := range pending {
+			if !oc.synced {
+				oc.hold(pendingEvent)
+				continue
+			}
+			oc.apply(pendingEvent)
+		}
+	case datasource.ORDER_EVENT, datasource.TRADE_EVENT:
+		if !oc.synced {
+			oc.hold(event)
+			return
+		}
+		oc.apply(event)
+	case datasource.HEARTBEAT_EVENT:
+		heartbeatTicker.WithLabelValues(oc.uuid, oc.product).Inc()
+	case datasource.SOURCE_FAILED_EVENT:
+		log.WithField("product", oc.product).Errorln("Source failed, the level 3 book is no longer updated")
+		oc.synced = false
+		oc.orderbook.Invalidate()
+	default:
+		log.WithField("eventType", event.Type).Warningln("Received an unexpected event")
+	}
+}
+
+// Health returns nil when the level 3 book can be served, otherwise the reason it cannot. As for
+// FeedController.Health, the book is unhealthy once its source failed, while it is resyncing or stale,
+// and when no event was received within HEALTH_EVENT_TIMEOUT.
+func (oc *OrderFeedController) Health() error {
+	oc.healthLock.Lock()
+	sourceFailed := oc.sourceFailed
+	lastEventTime := oc.lastEventTime
+	oc.healthLock.Unlock()
+
+	if sourceFailed {
+		return errors.New("Source failed and is no longer updating the level 3 book")
+	}
+	if err := oc.orderbook.CheckValid(); err != nil {
+		return err
+	}
+	if time.Since(lastEventTime) > HEALTH_EVENT_TIMEOUT {
+		return fmt.Errorf("No event received for %s, the source is probably disconnected", time.Since(lastEventTime).Round(time.Second))
+	}
+	return nil
+}
+
+func (oc *OrderFeedController) GetDepth(depth int) (*feed.L3Depth, int64, error) {
+	return oc.orderbook.GetDepth(depth)
+}
+func (oc *OrderFeedController) GetQueuePosition(orderID string) (*feed.QueuePosition, int64, error) {
+	return oc.orderbook.GetQueuePosition(orderID)
+}
+func (oc *OrderFeedController) EstimateQueuePosition(side string, price decimal.Decimal) (*feed.QueuePosition, int64, error) {
+	return oc.orderbook.EstimateQueuePosition(side, price)
+}
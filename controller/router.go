@@ -0,0 +1,153 @@
+package controller
+
+import (
+	"sort"
+	"strings"
+
+	"pirosb3/real_feed/feed"
+
+	"github.com/shopspring/decimal"
+)
+
+// MAX_ROUTE_LEGS bounds how many books a synthetic route may chain.
+const MAX_ROUTE_LEGS = 3
+
+// RouteLeg converts AmountIn of FromAsset into ToAsset through a single book.
+type RouteLeg struct {
+	Product     string
+	Operation   string
+	FromAsset   string
+	ToAsset     string
+	AmountIn    decimal.Decimal
+	Quote       *feed.Quote
+	LastUpdated int64
+}
+
+// Route is a chain of legs, the amount out of each leg is the amount into the next one.
+type Route struct {
+	Legs      []*RouteLeg
+	AmountIn  decimal.Decimal
+	AmountOut decimal.Decimal
+}
+
+// edge is a conversion offered by a book. A book A-B converts A into B by selling base, and B into A
+// by selling quote.
+type edge struct {
+	product   string
+	operation string
+	toAsset   string
+}
+
+// Router quotes conversions between any two assets, through the book of the pair when there is one
+// and through chains of books otherwise, for example ETH to BTC through ETH-USD and BTC-USD.
+type Router struct {
+	feedControllers map[string]*FeedController
+	edges           map[string][]*edge
+}
+
+// NewRouter creates a router over the books of `feedControllers`, keyed by product (example: "ETH-USD").
+func NewRouter(feedControllers map[string]*FeedController) *Router {
+	products := make([]string, 0, len(feedControllers))
+	for product := range feedControllers {
+		products = append(products, product)
+	}
+	// Routes are explored in the same order every time
+	sort.Strings(products)
+
+	edges := make(map[string][]*edge)
+	for _, product := range products {
+		assets := strings.Split(product, "-")
+		if len(assets) != 2 {
+			continue
+		}
+		base, quote := assets[0], assets[1]
+		edges[base] = append(edges[base], &edge{product: product, operation: feed.SELL_BASE, toAsset: quote})
+		edges[quote] = append(edges[quote], &edge{product: product, operation: feed.SELL_QUOTE, toAsset: base})
+	}
+	return &Router{
+		feedControllers: feedControllers,
+		edges:           edges,
+	}
+}
+
+// paths returns every chain of at most MAX_ROUTE_LEGS edges from `fromAsset` to `toAsset` that
+// does not visit an asset twice.
+func (r *Router) paths(fromAsset, toAsset string) [][]*edge {
+	var paths [][]*edge
+	visited := map[string]bool{fromAsset: true}
+	var path []*edge
+	var walk func(asset string)
+	walk = func(asset string) {
+		for _, e := range r.edges[asset] {
+			if visited[e.toAsset] {
+				continue
+			}
+			path = append(path, e)
+			if e.toAsset == toAsset {
+				paths = append(paths, append([]*edge{}, path...))
+			} else if len(path) < MAX_ROUTE_LEGS {
+				visited[e.toAsset] = true
+				walk(e.toAsset)
+				visited[e.toAsset] = false
+			}
+			path = path[:len(path)-1]
+		}
+	}
+	walk(fromAsset)
+	return paths
+}
+
+// quotePath walks the books of `path` one after the other, each leg paying `feeBps(product)`.
+func (r *Router) quotePath(path []*edge, fromAsset string, amount decimal.Decimal, feeBps func(product string) decimal.Decimal) (*Route, error) {
+	route := &Route{AmountIn: amount}
+	asset := fromAsset
+	legAmount := amount
+	for _, e := range path {
+		quote, lastUpdated, err := r.feedControllers[e.product].QuoteWithFee(e.operation, legAmount, feeBps(e.product))
+		if err != nil {
+			return nil, err
+		}
+		route.Legs = append(route.Legs, &RouteLeg{
+			Product:     e.product,
+			Operation:   e.operation,
+			FromAsset:   asset,
+			ToAsset:     e.toAsset,
+			AmountIn:    legAmount,
+			Quote:       quote,
+			LastUpdated: lastUpdated,
+		})
+		asset = e.toAsset
+		legAmount = quote.Amount
+	}
+	route.AmountOut = legAmount
+	return route, nil
+}
+
+// BestRoute quotes the conversion of `amount` of `fromAsset` into `toAsset` along every route, and
+// returns the one that yields the most. Each leg is priced against its own book in turn, so legs are
+// not priced at the same instant. If no route can be priced, the error of the last route is returned.
+func (r *Router) BestRoute(fromAsset, toAsset string, amount decimal.Decimal, feeBps func(product string) decimal.Decimal) (*Route, error) {
+	if fromAsset == toAsset {
+		return nil, feed.ErrNoRoute
+	}
+	paths := r.paths(fromAsset, toAsset)
+	if len(paths) == 0 {
+		return nil, feed.ErrNoRoute
+	}
+	var bestRoute *Route
+	var lastErr error
+	for _, path := range paths {
+		route, err := r.quotePath(path, fromAsset, amount, feeBps)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if bestRoute == nil || route.AmountOut.GreaterThan(bestRoute.AmountOut) {
+			bestRoute = route
+		}
+	}
+	if bestRoute == nil {
+		return nil, lastErr
+	}
+	return bestRoute, nil
+}
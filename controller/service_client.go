@@ -2,62 +2,234 @@ package controller
 
 import (
 	"context"
-	"fmt"
+	"strings"
+	"time"
 
+	"pirosb3/real_feed/feed"
 	"pirosb3/real_feed/rpc"
+
+	"github.com/shopspring/decimal"
 )
 
 type OrderbookGrpcController struct {
 	rpc.UnimplementedOrderbookServiceServer
-	feedController *FeedController
-	product        string
+	feedControllers map[string]*FeedController
 }
 
-func NewOrderbookGrpcController(feedController *FeedController, product string) *OrderbookGrpcController {
+// NewOrderbookGrpcController serves quotes for every product in `feedControllers`, keyed by product.
+func NewOrderbookGrpcController(feedControllers map[string]*FeedController) *OrderbookGrpcController {
 	return &OrderbookGrpcController{
-		feedController: feedController,
-		product:        product,
+		feedControllers: feedControllers,
+	}
+}
+
+func (ob *OrderbookGrpcController) getFeedController(productRequested string) (*FeedController, error) {
+	feedController, ok := ob.feedControllers[productRequested]
+	if !ok {
+		return nil, statusFromError(&feed.UnknownProductError{Product: productRequested}, productRequested, "product")
 	}
+	return feedController, nil
 }
 
-func (ob *OrderbookGrpcController) handleResponse(response float64, lastUpdated int64, err error, productRequested string) (*rpc.PricingResponse, error) {
-	if ob.product != productRequested {
-		return &rpc.PricingResponse{
-			Product: ob.product,
-			Error:   fmt.Sprintf("Requested quote for feed '%s', but service is serving feed '%s'", productRequested, ob.product),
-		}, nil
+func makeFills(fills []*feed.Fill) []*rpc.Fill {
+	rpcFills := make([]*rpc.Fill, len(fills))
+	for idx, fill := range fills {
+		rpcFills[idx] = &rpc.Fill{
+			Price: fill.Price.String(),
+			Size:  fill.Size.String(),
+		}
 	}
+	return rpcFills
+}
+
+// handleResponse converts a quote into a response. Errors are returned as gRPC status errors, see statusFromError.
+func (ob *OrderbookGrpcController) handleResponse(quote *feed.Quote, lastUpdated int64, err error, in *rpc.PricingRequest) (*rpc.PricingResponse, error) {
 	if err != nil {
-		return &rpc.PricingResponse{
-			Product: ob.product,
-			Error:   err.Error(),
-		}, nil
+		return nil, statusFromError(err, in.GetProduct(), "inAmount")
 	}
-	return &rpc.PricingResponse{
-		Product:     ob.product,
+	outAmount, _ := quote.Amount.Float64()
+	response := &rpc.PricingResponse{
+		Product:     in.GetProduct(),
 		LastUpdated: lastUpdated,
-		OutAmount:   float32(response),
-	}, nil
+		OutAmount:   float32(outAmount),
+	}
+	if in.GetIncludeBreakdown() {
+		response.Fills = makeFills(quote.Fills)
+		response.Vwap = quote.VWAP.String()
+		response.WorstPrice = quote.WorstPrice.String()
+		response.SlippageBps = quote.SlippageBps.String()
+	}
+	return response, nil
+}
+
+func (ob *OrderbookGrpcController) performOperation(operation string, in *rpc.PricingRequest) (*rpc.PricingResponse, error) {
+	feedController, err := ob.getFeedController(in.GetProduct())
+	if err != nil {
+		return nil, err
+	}
+	quote, lastUpdated, err := feedController.Quote(operation, decimal.NewFromFloat32(in.GetInAmount()))
+	return ob.handleResponse(quote, lastUpdated, err, in)
 }
 
 func (ob OrderbookGrpcController) BuyBase(ctx context.Context, in *rpc.PricingRequest) (*rpc.PricingResponse, error) {
-	response, lastUpdated, err := ob.feedController.BuyBase(float64(in.GetInAmount()))
-	return ob.handleResponse(response, lastUpdated, err, in.GetProduct())
+	return ob.performOperation(feed.BUY_BASE, in)
 }
 
 func (ob OrderbookGrpcController) BuyQuote(ctx context.Context, in *rpc.PricingRequest) (*rpc.PricingResponse, error) {
-	response, lastUpdated, err := ob.feedController.BuyQuote(float64(in.GetInAmount()))
-	return ob.handleResponse(response, lastUpdated, err, in.GetProduct())
+	return ob.performOperation(feed.BUY_QUOTE, in)
 }
 
 func (ob OrderbookGrpcController) SellBase(ctx context.Context, in *rpc.PricingRequest) (*rpc.PricingResponse, error) {
-	response, lastUpdated, err := ob.feedController.SellBase(float64(in.GetInAmount()))
-	return ob.handleResponse(response, lastUpdated, err, in.GetProduct())
+	return ob.performOperation(feed.SELL_BASE, in)
 }
 
 func (ob OrderbookGrpcController) SellQuote(ctx context.Context, in *rpc.PricingRequest) (*rpc.PricingResponse, error) {
-	response, lastUpdated, err := ob.feedController.SellQuote(float64(in.GetInAmount()))
-	return ob.handleResponse(response, lastUpdated, err, in.GetProduct())
+	return ob.performOperation(feed.SELL_QUOTE, in)
+}
+
+// makeTopOfBookResponse reads the top of the book and the quotes for `quoteSize` from the same version
+// of the book. When both quotes fail, both errors are reported.
+func (ob *OrderbookGrpcController) makeTopOfBookResponse(feedController *FeedController, in *rpc.TopOfBookRequest, quoteSize decimal.Decimal) *rpc.TopOfBookResponse {
+	var requests []*feed.QuoteRequest
+	if quoteSize.Sign() > 0 {
+		requests = []*feed.QuoteRequest{
+			{Operation: feed.BUY_BASE, Amount: quoteSize},
+			{Operation: feed.SELL_BASE, Amount: quoteSize},
+		}
+	}
+	topOfBook, results, lastUpdated, err := feedController.GetTopOfBookWithQuotes(requests)
+	if err != nil {
+		return &rpc.TopOfBookResponse{
+			Product:     in.GetProduct(),
+			LastUpdated: lastUpdated,
+			Error:       err.Error(),
+		}
+	}
+	response := &rpc.TopOfBookResponse{
+		Product:     in.GetProduct(),
+		BestBid:     topOfBook.BidPrice.String(),
+		BestBidSize: topOfBook.BidSize.String(),
+		BestAsk:     topOfBook.AskPrice.String(),
+		BestAskSize: topOfBook.AskSize.String(),
+		Mid:         topOfBook.Mid.String(),
+		Spread:      topOfBook.Spread.String(),
+		LastUpdated: lastUpdated,
+	}
+	if len(results) == 0 {
+		return response
+	}
+	response.QuoteSize = quoteSize.String()
+	var errs []string
+	if results[0].Err == nil {
+		response.BuyBaseAmount = results[0].Quote.Amount.String()
+	} else {
+		errs = append(errs, "buy: "+results[0].Err.Error())
+	}
+	if results[1].Err == nil {
+		response.SellBaseAmount = results[1].Quote.Amount.String()
+	} else {
+		errs = append(errs, "sell: "+results[1].Err.Error())
+	}
+	response.Error = strings.Join(errs, "; ")
+	return response
+}
+
+// StreamTopOfBook sends the top of the book straight away, and again every time the book changes.
+// Changes that happen within `throttleMillis` of the last message are coalesced into a single message.
+// Invalid requests end the stream with a gRPC status error, while the book being unusable for a while
+// is reported in the `error` field of the messages, and the stream carries on.
+func (ob OrderbookGrpcController) StreamTopOfBook(in *rpc.TopOfBookRequest, stream rpc.OrderbookService_StreamTopOfBookServer) error {
+	feedController, err := ob.getFeedController(in.GetProduct())
+	if err != nil {
+		return err
+	}
+	quoteSize := decimal.Zero
+	if in.GetQuoteSize() != "" {
+		parsedSize, err := decimal.NewFromString(in.GetQuoteSize())
+		if err != nil {
+			return invalidArgument("quoteSize", "Quote size invalid", in.GetProduct())
+		}
+		if parsedSize.Sign() <= 0 {
+			return invalidArgument("quoteSize", "Quote size must be positive", in.GetProduct())
+		}
+		quoteSize = parsedSize
+	}
+	throttle := time.Duration(in.GetThrottleMillis()) * time.Millisecond
+
+	changes, unsubscribe := feedController.Subscribe()
+	defer unsubscribe()
+
+	var lastSent time.Time
+	var throttled <-chan time.Time
+	send := func() error {
+		lastSent = time.Now()
+		return stream.Send(ob.makeTopOfBookResponse(feedController, in, quoteSize))
+	}
+	if err := send(); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-changes:
+			if throttled != nil {
+				continue
+			}
+			if wait := throttle - time.Since(lastSent); wait > 0 {
+				throttled = time.After(wait)
+				continue
+			}
+			if err := send(); err != nil {
+				return err
+			}
+		case <-throttled:
+			throttled = nil
+			if err := send(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func makePriceLevels(levels []*feed.Level) []*rpc.PriceLevel {
+	priceLevels := make([]*rpc.PriceLevel, len(levels))
+	for idx, level := range levels {
+		priceLevels[idx] = &rpc.PriceLevel{
+			Price: level.Price.String(),
+			Size:  level.Size.String(),
+		}
+	}
+	return priceLevels
+}
+
+func (ob OrderbookGrpcController) GetOrderbook(ctx context.Context, in *rpc.OrderbookRequest) (*rpc.OrderbookResponse, error) {
+	feedController, err := ob.getFeedController(in.GetProduct())
+	if err != nil {
+		return nil, err
+	}
+	withinPercent := decimal.Zero
+	if in.GetWithinPercent() != "" {
+		parsedPercent, err := decimal.NewFromString(in.GetWithinPercent())
+		if err != nil {
+			return nil, invalidArgument("withinPercent", "Percentage invalid", in.GetProduct())
+		}
+		withinPercent = parsedPercent
+	}
+	depth, lastUpdated, err := feedController.GetDepth(int(in.GetDepth()), withinPercent)
+	if err != nil {
+		return nil, statusFromError(err, in.GetProduct(), "depth")
+	}
+	response := &rpc.OrderbookResponse{
+		Product:     in.GetProduct(),
+		Bids:        makePriceLevels(depth.Bids),
+		Asks:        makePriceLevels(depth.Asks),
+		LastUpdated: lastUpdated,
+	}
+	if depth.Mid.Sign() > 0 {
+		response.Mid = depth.Mid.String()
+	}
+	return response, nil
 }
 
 // func (ob OrderbookGrpcController) mustEmbedUnimplementedOrderbookServiceServer() {}
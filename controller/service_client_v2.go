@@ -0,0 +1,776 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"pirosb3/real_feed/feed"
+	"pirosb3/real_feed/rpc"
+
+	"github.com/shopspring/decimal"
+	"google.golang.org/grpc/status"
+)
+
+// OrderbookGrpcControllerV2 serves OrderbookServiceV2, which carries amounts as decimal strings.
+// The streaming and orderbook RPCs are shared with OrderbookGrpcController.
+type OrderbookGrpcControllerV2 struct {
+	rpc.UnimplementedOrderbookServiceV2Server
+	v1          *OrderbookGrpcController
+	router      *Router
+	sor         *SmartOrderRouter
+	feeSchedule *feed.FeeSchedule
+	venueFees   map[string]*feed.FeeSchedule
+	l3          map[string]*OrderFeedController
+}
+
+// NewOrderbookGrpcControllerV2 serves quotes for every product in `feedControllers`, keyed by product.
+// Quotes net of fees use the taker fees of `feeSchedule`, and fail if it is nil.
+func NewOrderbookGrpcControllerV2(feedControllers map[string]*FeedController, feeSchedule *feed.FeeSchedule) *OrderbookGrpcControllerV2 {
+	return &OrderbookGrpcControllerV2{
+		v1:          NewOrderbookGrpcController(feedControllers),
+		router:      NewRouter(feedControllers),
+		sor:         NewSmartOrderRouter(map[string]map[string]*FeedController{DEFAULT_VENUE: feedControllers}),
+		feeSchedule: feeSchedule,
+		venueFees:   map[string]*feed.FeeSchedule{DEFAULT_VENUE: feeSchedule},
+	}
+}
+
+// SetSmartOrderRouter replaces the router PlanExecution splits operations with, which by default
+// only knows of `feedControllers` as DEFAULT_VENUE. Call before serving.
+func (ob *OrderbookGrpcControllerV2) SetSmartOrderRouter(sor *SmartOrderRouter) {
+	ob.sor = sor
+}
+
+// SetVenueFeeSchedules sets the fee schedule of each venue PlanExecution routes to, keyed by venue.
+// By default only DEFAULT_VENUE has one, the schedule the controller was created with. Call before
+// serving.
+func (ob *OrderbookGrpcControllerV2) SetVenueFeeSchedules(venueFees map[string]*feed.FeeSchedule) {
+	ob.venueFees = venueFees
+}
+
+// SetOrderFeedControllers serves level 3 books for every product in `orderFeedControllers`, keyed by
+// product. Call before serving.
+func (ob *OrderbookGrpcControllerV2) SetOrderFeedControllers(orderFeedControllers map[string]*OrderFeedController) {
+	ob.l3 = orderFeedControllers
+}
+
+// feeBps returns the taker fee to quote `product` with, zero unless `netOfFees` is requested.
+func (ob *OrderbookGrpcControllerV2) feeBps(product string, netOfFees bool) (decimal.Decimal, error) {
+	if !netOfFees {
+		return decimal.Zero, nil
+	}
+	if ob.feeSchedule == nil {
+		return decimal.Zero, noFeeSchedule(product)
+	}
+	return ob.feeSchedule.Tier(product).TakerBps, nil
+}
+
+// venueFeeBps returns the taker fee to route `product` to `venue` with, zero unless `netOfFees` is
+// requested.
+func (ob *OrderbookGrpcControllerV2) venueFeeBps(venue, product string, netOfFees bool) (decimal.Decimal, error) {
+	if !netOfFees {
+		return decimal.Zero, nil
+	}
+	feeSchedule := ob.venueFees[venue]
+	if feeSchedule == nil {
+		return decimal.Zero, noVenueFeeSchedule(product, venue)
+	}
+	return feeSchedule.Tier(product).TakerBps, nil
+}
+
+// MAX_BATCH_SIZE bounds how many items a BatchQuote may price while holding the book's read lock.
+const MAX_BATCH_SIZE = 100
+
+var operations = map[rpc.Operation]string{
+	rpc.Operation_BUY_BASE:   feed.BUY_BASE,
+	rpc.Operation_BUY_QUOTE:  feed.BUY_QUOTE,
+	rpc.Operation_SELL_BASE:  feed.SELL_BASE,
+	rpc.Operation_SELL_QUOTE: feed.SELL_QUOTE,
+}
+
+var rpcOperations = map[string]rpc.Operation{
+	feed.BUY_BASE:   rpc.Operation_BUY_BASE,
+	feed.BUY_QUOTE:  rpc.Operation_BUY_QUOTE,
+	feed.SELL_BASE:  rpc.Operation_SELL_BASE,
+	feed.SELL_QUOTE: rpc.Operation_SELL_QUOTE,
+}
+
+func makeQuoteResponse(quote *feed.Quote, lastUpdated int64, product string, includeBreakdown, netOfFees bool, feeBps decimal.Decimal) *rpc.QuoteResponse {
+	response := &rpc.QuoteResponse{
+		Product:     product,
+		Amount:      quote.Amount.String(),
+		LastUpdated: lastUpdated,
+	}
+	if includeBreakdown {
+		response.Fills = makeFills(quote.Fills)
+		response.Vwap = quote.VWAP.String()
+		response.WorstPrice = quote.WorstPrice.String()
+		response.SlippageBps = quote.SlippageBps.String()
+	}
+	if netOfFees {
+		response.Fee = quote.Fee.String()
+		response.FeeBps = feeBps.String()
+	}
+	return response
+}
+
+func (ob *OrderbookGrpcControllerV2) performOperation(operation string, in *rpc.QuoteRequest) (*rpc.QuoteResponse, error) {
+	feedController, err := ob.v1.getFeedController(in.GetProduct())
+	if err != nil {
+		return nil, err
+	}
+	amount, err := decimal.NewFromString(in.GetAmount())
+	if err != nil {
+		return nil, invalidArgument("amount", "Amount invalid", in.GetProduct())
+	}
+	feeBps, err := ob.feeBps(in.GetProduct(), in.GetNetOfFees())
+	if err != nil {
+		return nil, err
+	}
+	quote, lastUpdated, err := feedController.QuoteWithFee(operation, amount, feeBps)
+	if err != nil {
+		return nil, statusFromError(err, in.GetProduct(), "amount")
+	}
+	return makeQuoteResponse(quote, lastUpdated, in.GetProduct(), in.GetIncludeBreakdown(), in.GetNetOfFees(), feeBps), nil
+}
+
+func (ob OrderbookGrpcControllerV2) BuyBase(ctx context.Context, in *rpc.QuoteRequest) (*rpc.QuoteResponse, error) {
+	return ob.performOperation(feed.BUY_BASE, in)
+}
+
+func (ob OrderbookGrpcControllerV2) BuyQuote(ctx context.Context, in *rpc.QuoteRequest) (*rpc.QuoteResponse, error) {
+	return ob.performOperation(feed.BUY_QUOTE, in)
+}
+
+func (ob OrderbookGrpcControllerV2) SellBase(ctx context.Context, in *rpc.QuoteRequest) (*rpc.QuoteResponse, error) {
+	return ob.performOperation(feed.SELL_BASE, in)
+}
+
+func (ob OrderbookGrpcControllerV2) SellQuote(ctx context.Context, in *rpc.QuoteRequest) (*rpc.QuoteResponse, error) {
+	return ob.performOperation(feed.SELL_QUOTE, in)
+}
+
+func (ob OrderbookGrpcControllerV2) StreamTopOfBook(in *rpc.TopOfBookRequest, stream rpc.OrderbookServiceV2_StreamTopOfBookServer) error {
+	return ob.v1.StreamTopOfBook(in, stream)
+}
+
+func (ob OrderbookGrpcControllerV2) GetOrderbook(ctx context.Context, in *rpc.OrderbookRequest) (*rpc.OrderbookResponse, error) {
+	return ob.v1.GetOrderbook(ctx, in)
+}
+
+// BatchQuote prices every item against the same version of the book. Items that cannot be parsed or
+// priced get an error result of their own, only an unknown product or an oversized batch fail the call.
+func (ob OrderbookGrpcControllerV2) BatchQuote(ctx context.Context, in *rpc.BatchQuoteRequest) (*rpc.BatchQuoteResponse, error) {
+	feedController, err := ob.v1.getFeedController(in.GetProduct())
+	if err != nil {
+		return nil, err
+	}
+	if len(in.GetItems()) > MAX_BATCH_SIZE {
+		return nil, invalidArgument("items", fmt.Sprintf("Batches are limited to %d items", MAX_BATCH_SIZE), in.GetProduct())
+	}
+	feeBps, err := ob.feeBps(in.GetProduct(), in.GetNetOfFees())
+	if err != nil {
+		return nil, err
+	}
+
+	// Items that cannot be parsed are not sent to the book
+	results := make([]*rpc.BatchQuoteResult, len(in.GetItems()))
+	var requests []*feed.QuoteRequest
+	var requestIdxs []int
+	for idx, item := range in.GetItems() {
+		results[idx] = &rpc.BatchQuoteResult{Item: item}
+		operation, ok := operations[item.GetOperation()]
+		if !ok {
+			results[idx].Error = status.Convert(invalidArgument("operation", "Operation invalid", in.GetProduct())).Proto()
+			continue
+		}
+		amount, err := decimal.NewFromString(item.GetAmount())
+		if err != nil {
+			results[idx].Error = status.Convert(invalidArgument("amount", "Amount invalid", in.GetProduct())).Proto()
+			continue
+		}
+		requests = append(requests, &feed.QuoteRequest{Operation: operation, Amount: amount, FeeBps: feeBps})
+		requestIdxs = append(requestIdxs, idx)
+	}
+
+	quoteResults, lastUpdated := feedController.BatchQuote(requests)
+	for idx, quoteResult := range quoteResults {
+		result := results[requestIdxs[idx]]
+		if quoteResult.Err != nil {
+			result.Error = status.Convert(statusFromError(quoteResult.Err, in.GetProduct(), "amount")).Proto()
+			continue
+		}
+		result.Quote = makeQuoteResponse(quoteResult.Quote, lastUpdated, in.GetProduct(), in.GetIncludeBreakdown(), in.GetNetOfFees(), feeBps)
+	}
+	return &rpc.BatchQuoteResponse{
+		Product:     in.GetProduct(),
+		LastUpdated: lastUpdated,
+		Results:     results,
+	}, nil
+}
+
+func makeLiquidityPoints(points []*feed.LiquidityPoint) []*rpc.LiquidityPoint {
+	rpcPoints := make([]*rpc.LiquidityPoint, len(points))
+	for idx, point := range points {
+		rpcPoints[idx] = &rpc.LiquidityPoint{
+			DistanceBps:  point.DistanceBps.String(),
+			LimitPrice:   point.LimitPrice.String(),
+			Size:         point.Size.String(),
+			Notional:     point.Notional.String(),
+			AveragePrice: point.AveragePrice.String(),
+		}
+	}
+	return rpcPoints
+}
+
+// GetLiquidityCurve returns the liquidity of both sides within each requested distance from mid,
+// or within LIQUIDITY_CURVE_BPS if none is requested.
+func (ob OrderbookGrpcControllerV2) GetLiquidityCurve(ctx context.Context, in *rpc.LiquidityCurveRequest) (*rpc.LiquidityCurveResponse, error) {
+	feedController, err := ob.v1.getFeedController(in.GetProduct())
+	if err != nil {
+		return nil, err
+	}
+	distancesBps := LIQUIDITY_CURVE_BPS
+	if len(in.GetDistancesBps()) > 0 {
+		distancesBps = make([]decimal.Decimal, len(in.GetDistancesBps()))
+		for idx, distance := range in.GetDistancesBps() {
+			parsedDistance, err := decimal.NewFromString(distance)
+			if err != nil {
+				return nil, invalidArgument("distancesBps", "Distance invalid", in.GetProduct())
+			}
+			distancesBps[idx] = parsedDistance
+		}
+	}
+	curve, lastUpdated, err := feedController.GetLiquidityCurve(distancesBps)
+	if err != nil {
+		return nil, statusFromError(err, in.GetProduct(), "distancesBps")
+	}
+	return &rpc.LiquidityCurveResponse{
+		Product:     in.GetProduct(),
+		Mid:         curve.Mid.String(),
+		Bids:        makeLiquidityPoints(curve.Bids),
+		Asks:        makeLiquidityPoints(curve.Asks),
+		LastUpdated: lastUpdated,
+	}, nil
+}
+
+func makeFillable(fillable *feed.Fillable) *rpc.Fillable {
+	return &rpc.Fillable{
+		Size:         fillable.Size.String(),
+		Notional:     fillable.Notional.String(),
+		AveragePrice: fillable.AveragePrice.String(),
+		WorstPrice:   fillable.WorstPrice.String(),
+	}
+}
+
+// GetMaxFillable returns how much can be bought and sold within either a limit price or a maximum slippage.
+func (ob OrderbookGrpcControllerV2) GetMaxFillable(ctx context.Context, in *rpc.MaxFillableRequest) (*rpc.MaxFillableResponse, error) {
+	feedController, err := ob.v1.getFeedController(in.GetProduct())
+	if err != nil {
+		return nil, err
+	}
+	var maxFillable *feed.MaxFillable
+	var lastUpdated int64
+	switch limit := in.GetLimit().(type) {
+	case *rpc.MaxFillableRequest_LimitPrice:
+		limitPrice, err := decimal.NewFromString(limit.LimitPrice)
+		if err != nil {
+			return nil, invalidArgument("limitPrice", "Limit price invalid", in.GetProduct())
+		}
+		if maxFillable, lastUpdated, err = feedController.GetMaxFillableAtPrice(limitPrice); err != nil {
+			return nil, statusFromError(err, in.GetProduct(), "limitPrice")
+		}
+	case *rpc.MaxFillableRequest_MaxSlippageBps:
+		maxSlippageBps, err := decimal.NewFromString(limit.MaxSlippageBps)
+		if err != nil {
+			return nil, invalidArgument("maxSlippageBps", "Slippage invalid", in.GetProduct())
+		}
+		if maxFillable, lastUpdated, err = feedController.GetMaxFillableWithinSlippage(maxSlippageBps); err != nil {
+			return nil, statusFromError(err, in.GetProduct(), "maxSlippageBps")
+		}
+	default:
+		return nil, invalidArgument("limit", "Either a limit price or a maximum slippage is required", in.GetProduct())
+	}
+	return &rpc.MaxFillableResponse{
+		Product:     in.GetProduct(),
+		Buy:         makeFillable(maxFillable.Buy),
+		Sell:        makeFillable(maxFillable.Sell),
+		LastUpdated: lastUpdated,
+	}, nil
+}
+
+// QuoteRoute converts an amount of one asset into another through the route that yields the most,
+// among the book of the pair, if served, and the chains of books through other assets.
+func (ob OrderbookGrpcControllerV2) QuoteRoute(ctx context.Context, in *rpc.RouteQuoteRequest) (*rpc.RouteQuoteResponse, error) {
+	pair := in.GetFromAsset() + "-" + in.GetToAsset()
+	amount, err := decimal.NewFromString(in.GetAmount())
+	if err != nil {
+		return nil, invalidArgument("amount", "Amount invalid", pair)
+	}
+	if _, err := ob.feeBps(pair, in.GetNetOfFees()); err != nil {
+		return nil, err
+	}
+	feeBps := func(product string) decimal.Decimal {
+		fee, _ := ob.feeBps(product, in.GetNetOfFees())
+		return fee
+	}
+	route, err := ob.router.BestRoute(in.GetFromAsset(), in.GetToAsset(), amount, feeBps)
+	if err != nil {
+		return nil, statusFromError(err, pair, "amount")
+	}
+
+	response := &rpc.RouteQuoteResponse{
+		FromAsset: in.GetFromAsset(),
+		ToAsset:   in.GetToAsset(),
+		AmountIn:  route.AmountIn.String(),
+		AmountOut: route.AmountOut.String(),
+		Legs:      make([]*rpc.RouteLeg, len(route.Legs)),
+	}
+	for idx, leg := range route.Legs {
+		response.Legs[idx] = &rpc.RouteLeg{
+			Product:   leg.Product,
+			Operation: rpcOperations[leg.Operation],
+			FromAsset: leg.FromAsset,
+			ToAsset:   leg.ToAsset,
+			AmountIn:  leg.AmountIn.String(),
+			Quote:     makeQuoteResponse(leg.Quote, leg.LastUpdated, leg.Product, in.GetIncludeBreakdown(), in.GetNetOfFees(), feeBps(leg.Product)),
+		}
+	}
+	return response, nil
+}
+
+// PlanExecution splits a BUY_BASE or SELL_BASE across every venue serving the product, so that the
+// operation as a whole costs the least, and returns the allocation to each venue. Net of fees, each
+// venue is charged the taker fee of its own schedule, and every venue needs one.
+func (ob OrderbookGrpcControllerV2) PlanExecution(ctx context.Context, in *rpc.ExecutionRequest) (*rpc.ExecutionResponse, error) {
+	operation := operations[in.GetOperation()]
+	if operation != feed.BUY_BASE && operation != feed.SELL_BASE {
+		return nil, invalidArgument("operation", "Only BUY_BASE and SELL_BASE can be split across venues", in.GetProduct())
+	}
+	amount, err := decimal.NewFromString(in.GetAmount())
+	if err != nil {
+		return nil, invalidArgument("amount", "Amount invalid", in.GetProduct())
+	}
+	venueFees := make(map[string]decimal.Decimal)
+	for _, venue := range ob.sor.Venues(in.GetProduct()) {
+		fee, err := ob.venueFeeBps(venue, in.GetProduct(), in.GetNetOfFees())
+		if err != nil {
+			return nil, err
+		}
+		venueFees[venue] = fee
+	}
+	feeBps := func(venue, product string) decimal.Decimal {
+		return venueFees[venue]
+	}
+	execution, err := ob.sor.Plan(in.GetProduct(), operation, amount, feeBps)
+	if err != nil {
+		return nil, statusFromError(err, in.GetProduct(), "amount")
+	}
+
+	response := &rpc.ExecutionResponse{
+		Product:      in.GetProduct(),
+		Operation:    in.GetOperation(),
+		Size:         execution.Size.String(),
+		Amount:       execution.Amount.String(),
+		Notional:     execution.Notional.String(),
+		Fee:          execution.Fee.String(),
+		AveragePrice: execution.AveragePrice.String(),
+		Allocations:  make([]*rpc.VenueAllocation, len(execution.Allocations)),
+	}
+	for idx, allocation := range execution.Allocations {
+		response.Allocations[idx] = &rpc.VenueAllocation{
+			Venue:        allocation.Venue,
+			Size:         allocation.Size.String(),
+			Notional:     allocation.Notional.String(),
+			AveragePrice: allocation.AveragePrice.String(),
+			Fee:          allocation.Fee.String(),
+			LastUpdated:  allocation.LastUpdated,
+		}
+		if in.GetIncludeBreakdown() {
+			response.Allocations[idx].Fills = makeFills(allocation.Fills)
+		}
+	}
+	return response, nil
+}
+
+func makeConsolidatedPriceLevels(levels []*feed.ConsolidatedLevel) []*rpc.ConsolidatedPriceLevel {
+	rpcLevels := make([]*rpc.ConsolidatedPriceLevel, len(levels))
+	for idx, level := range levels {
+		rpcLevels[idx] = &rpc.ConsolidatedPriceLevel{
+			Price:   level.Price.String(),
+			Size:    level.Size.String(),
+			Sources: make([]*rpc.LevelSource, len(level.Sources)),
+			Crossed: level.Crossed,
+		}
+		for sourceIdx, source := range level.Sources {
+			rpcLevels[idx].Sources[sourceIdx] = &rpc.LevelSource{
+				Venue: source.Venue,
+				Size:  source.Size.String(),
+			}
+		}
+	}
+	return rpcLevels
+}
+
+// GetConsolidatedOrderbook returns the books of every venue serving the product merged into one,
+// each level tagged with the venues resting at its price. Venues that cannot be quoted are left out
+// and reported in the response, the call only fails once no venue can be quoted.
+func (ob OrderbookGrpcControllerV2) GetConsolidatedOrderbook(ctx context.Context, in *rpc.OrderbookRequest) (*rpc.ConsolidatedOrderbookResponse, error) {
+	consolidated, err := ob.sor.ConsolidatedOrderbook(in.GetProduct())
+	if err != nil {
+		return nil, statusFromError(err, in.GetProduct(), "product")
+	}
+	withinPercent := decimal.Zero
+	if in.GetWithinPercent() != "" {
+		parsedPercent, err := decimal.NewFromString(in.GetWithinPercent())
+		if err != nil {
+			return nil, invalidArgument("withinPercent", "Percentage invalid", in.GetProduct())
+		}
+		withinPercent = parsedPercent
+	}
+	depth, statuses, lastUpdated, err := consolidated.GetDepth(int(in.GetDepth()), withinPercent)
+	if err != nil {
+		return nil, statusFromError(err, in.GetProduct(), "depth")
+	}
+	response := &rpc.ConsolidatedOrderbookResponse{
+		Product:     in.GetProduct(),
+		Bids:        makeConsolidatedPriceLevels(depth.Bids),
+		Asks:        makeConsolidatedPriceLevels(depth.Asks),
+		LastUpdated: lastUpdated,
+		Venues:      makeVenueStatuses(statuses, in.GetProduct()),
+		Crossed:     depth.Crossed,
+	}
+	if depth.Mid.Sign() > 0 {
+		response.Mid = depth.Mid.String()
+	}
+	return response, nil
+}
+
+func makeVenueStatuses(statuses []*feed.VenueStatus, product string) []*rpc.VenueStatus {
+	rpcStatuses := make([]*rpc.VenueStatus, len(statuses))
+	for idx, venueStatus := range statuses {
+		rpcStatuses[idx] = &rpc.VenueStatus{
+			Venue:       venueStatus.Venue,
+			LastUpdated: venueStatus.LastUpdated,
+		}
+		if venueStatus.Err != nil {
+			rpcStatuses[idx].Error = status.Convert(statusFromError(venueStatus.Err, product, "product")).Proto()
+		}
+	}
+	return rpcStatuses
+}
+
+// QuoteConsolidated prices a market operation against the books of every venue serving the product
+// merged into one, as if a single venue rested all their levels. Venues that cannot be quoted are left
+// out and reported in the response. Fees are not included, see PlanExecution.
+func (ob OrderbookGrpcControllerV2) QuoteConsolidated(ctx context.Context, in *rpc.ConsolidatedQuoteRequest) (*rpc.ConsolidatedQuoteResponse, error) {
+	consolidated, err := ob.sor.ConsolidatedOrderbook(in.GetProduct())
+	if err != nil {
+		return nil, statusFromError(err, in.GetProduct(), "product")
+	}
+	operation, ok := operations[in.GetOperation()]
+	if !ok {
+		return nil, invalidArgument("operation", "Operation invalid", in.GetProduct())
+	}
+	amount, err := decimal.NewFromString(in.GetAmount())
+	if err != nil {
+		return nil, invalidArgument("amount", "Amount invalid", in.GetProduct())
+	}
+	quote, statuses, lastUpdated, err := consolidated.Quote(operation, amount)
+	if err != nil {
+		return nil, statusFromError(err, in.GetProduct(), "amount")
+	}
+	return &rpc.ConsolidatedQuoteResponse{
+		Quote:  makeQuoteResponse(quote, lastUpdated, in.GetProduct(), in.GetIncludeBreakdown(), false, decimal.Zero),
+		Venues: makeVenueStatuses(statuses, in.GetProduct()),
+	}, nil
+}
+
+var sides = map[rpc.Side]string{
+	rpc.Side_BID: feed.BIDS,
+	rpc.Side_ASK: feed.ASKS,
+}
+
+var rpcSides = map[string]rpc.Side{
+	feed.BIDS: rpc.Side_BID,
+	feed.ASKS: rpc.Side_ASK,
+}
+
+func (ob *OrderbookGrpcControllerV2) getOrderFeedController(product string) (*OrderFeedController, error) {
+	orderFeedController, ok := ob.l3[product]
+	if !ok {
+		return nil, statusFromError(&feed.UnknownProductError{Product: product}, product, "product")
+	}
+	return orderFeedController, nil
+}
+
+func makeL3PriceLevels(levels []*feed.L3Level) []*rpc.PriceLevelL3 {
+	rpcLevels := make([]*rpc.PriceLevelL3, len(levels))
+	for idx, level := range levels {
+		rpcLevels[idx] = &rpc.PriceLevelL3{
+			Price:  level.Price.String(),
+			Size:   level.Size.String(),
+			Orders: int32(level.Orders),
+		}
+	}
+	return rpcLevels
+}
+
+// GetOrderbookL3 returns the levels of the level 3 book, with the number of orders resting at each price.
+func (ob OrderbookGrpcControllerV2) GetOrderbookL3(ctx context.Context, in *rpc.OrderbookL3Request) (*rpc.OrderbookL3Response, error) {
+	orderFeedController, err := ob.getOrderFeedController(in.GetProduct())
+	if err != nil {
+		return nil, err
+	}
+	depth, lastUpdated, err := orderFeedController.GetDepth(int(in.GetDepth()))
+	if err != nil {
+		return nil, statusFromError(err, in.GetProduct(), "depth")
+	}
+	response := &rpc.OrderbookL3Response{
+		Product:     in.GetProduct(),
+		Bids:        makeL3PriceLevels(depth.Bids),
+		Asks:        makeL3PriceLevels(depth.Asks),
+		LastUpdated: lastUpdated,
+	}
+	if depth.Mid.Sign() > 0 {
+		response.Mid = depth.Mid.String()
+	}
+	return response, nil
+}
+
+// GetQueuePosition returns where an order resting on the level 3 book stands in the queue of its
+// price, or where a new order would stand if placed now.
+func (ob OrderbookGrpcControllerV2) GetQueuePosition(ctx context.Context, in *rpc.QueuePositionRequest) (*rpc.QueuePositionResponse, error) {
+	orderFeedController, err := ob.getOrderFeedController(in.GetProduct())
+	if err != nil {
+		return nil, err
+	}
+	var position *feed.QueuePosition
+	var lastUpdated int64
+	switch order := in.GetOrder().(type) {
+	case *rpc.QueuePositionRequest_OrderId:
+		if position, lastUpdated, err = orderFeedController.GetQueuePosition(order.OrderId); err != nil {
+			return nil, statusFromError(err, in.GetProduct(), "orderId")
+		}
+	case *rpc.QueuePositionRequest_NewOrder:
+		side, ok := sides[order.NewOrder.GetSide()]
+		if !ok {
+			return nil, invalidArgument("newOrder.side", "Side invalid", in.GetProduct())
+		}
+		price, err := decimal.NewFromString(order.NewOrder.GetPrice())
+		if err != nil {
+			return nil, invalidArgument("newOrder.price", "Price invalid", in.GetProduct())
+		}
+		if position, lastUpdated, err = orderFeedController.EstimateQueuePosition(side, price); err != nil {
+			return nil, statusFromError(err, in.GetProduct(), "newOrder.price")
+		}
+	default:
+		return nil, invalidArgument("order", "Either an order id or a new order is required", in.GetProduct())
+	}
+	response := &rpc.QueuePositionResponse{
+		Product:     in.GetProduct(),
+		OrderId:     position.OrderID,
+		Side:        rpcSides[position.Side],
+		Price:       position.Price.String(),
+		OrdersAhead: int32(position.OrdersAhead),
+		SizeAhead:   position.SizeAhead.String(),
+		LevelOrders: int32(position.LevelOrders),
+		LevelSize:   position.LevelSize.String(),
+		LastUpdated: lastUpdated,
+	}
+	if position.OrderID != "" {
+		response.Size = position.Size.String()
+	}
+	return response, nil
+}
+
+var rpcTradeSides = map[string]rpc.TradeSide{
+	feed.TRADE_BUY:  rpc.TradeSide_BUY,
+	feed.TRADE_SELL: rpc.TradeSide_SELL,
+}
+
+func makeTrade(trade *feed.Trade) *rpc.Trade {
+	return &rpc.Trade{
+		TradeId: trade.TradeID,
+		Side:    rpcTradeSides[trade.Side],
+		Price:   trade.Price.String(),
+		Size:    trade.Size.String(),
+		Time:    trade.Time.UnixNano() / int64(time.Millisecond),
+	}
+}
+
+// GetLastTrade returns the most recent trade of the product.
+func (ob OrderbookGrpcControllerV2) GetLastTrade(ctx context.Context, in *rpc.TradesRequest) (*rpc.LastTradeResponse, error) {
+	feedController, err := ob.v1.getFeedController(in.GetProduct())
+	if err != nil {
+		return nil, err
+	}
+	trade, err := feedController.LastTrade()
+	if err != nil {
+		return nil, statusFromError(err, in.GetProduct(), "product")
+	}
+	return &rpc.LastTradeResponse{
+		Product: in.GetProduct(),
+		Trade:   makeTrade(trade),
+	}, nil
+}
+
+// GetRecentTrades returns the trades kept on the tape of the product, most recent first.
+func (ob OrderbookGrpcControllerV2) GetRecentTrades(ctx context.Context, in *rpc.TradesRequest) (*rpc.TradesResponse, error) {
+	feedController, err := ob.v1.getFeedController(in.GetProduct())
+	if err != nil {
+		return nil, err
+	}
+	trades, err := feedController.RecentTrades(int(in.GetLimit()))
+	if err != nil {
+		return nil, statusFromError(err, in.GetProduct(), "limit")
+	}
+	response := &rpc.TradesResponse{
+		Product: in.GetProduct(),
+		Trades:  make([]*rpc.Trade, len(trades)),
+	}
+	for idx, trade := range trades {
+		response.Trades[idx] = makeTrade(trade)
+	}
+	return response, nil
+}
+
+// GetTradeStats returns the volume and VWAP of the trades of each rolling window, which cannot be
+// longer than TRADE_TAPE_RETENTION.
+func (ob OrderbookGrpcControllerV2) GetTradeStats(ctx context.Context, in *rpc.TradeStatsRequest) (*rpc.TradeStatsResponse, error) {
+	feedController, err := ob.v1.getFeedController(in.GetProduct())
+	if err != nil {
+		return nil, err
+	}
+	windows := TRADE_STATS_WINDOWS
+	if len(in.GetWindowSeconds()) > 0 {
+		windows = make([]time.Duration, len(in.GetWindowSeconds()))
+		for idx, windowSeconds := range in.GetWindowSeconds() {
+			windows[idx] = time.Duration(windowSeconds) * time.Second
+		}
+	}
+	allStats, err := feedController.TradeStats(windows)
+	if err != nil {
+		return nil, statusFromError(err, in.GetProduct(), "windowSeconds")
+	}
+	response := &rpc.TradeStatsResponse{
+		Product: in.GetProduct(),
+		Stats:   make([]*rpc.TradeStats, len(allStats)),
+	}
+	for idx, stats := range allStats {
+		response.Stats[idx] = &rpc.TradeStats{
+			WindowSeconds: int64(stats.Window / time.Second),
+			Trades:        int32(stats.Trades),
+			Volume:        stats.Volume.String(),
+			BuyVolume:     stats.BuyVolume.String(),
+			SellVolume:    stats.SellVolume.String(),
+			Notional:      stats.Notional.String(),
+		}
+		if stats.Trades > 0 {
+			response.Stats[idx].Vwap = stats.VWAP.String()
+			response.Stats[idx].High = stats.High.String()
+			response.Stats[idx].Low = stats.Low.String()
+		}
+	}
+	return response, nil
+}
+
+var candleIntervals = map[rpc.CandleInterval]time.Duration{
+	rpc.CandleInterval_ONE_SECOND:   time.Second,
+	rpc.CandleInterval_ONE_MINUTE:   time.Minute,
+	rpc.CandleInterval_FIVE_MINUTES: 5 * time.Minute,
+	rpc.CandleInterval_ONE_HOUR:     time.Hour,
+}
+
+var rpcCandleIntervals = map[time.Duration]rpc.CandleInterval{
+	time.Second:     rpc.CandleInterval_ONE_SECOND,
+	time.Minute:     rpc.CandleInterval_ONE_MINUTE,
+	5 * time.Minute: rpc.CandleInterval_FIVE_MINUTES,
+	time.Hour:       rpc.CandleInterval_ONE_HOUR,
+}
+
+// makeCandle converts `candle`, prices that were never seen are left empty.
+func makeCandle(candle *feed.Candle, closed bool) *rpc.Candle {
+	response := &rpc.Candle{
+		Interval: rpcCandleIntervals[candle.Interval],
+		Start:    candle.Start.UnixNano() / int64(time.Millisecond),
+		Volume:   candle.Volume.String(),
+		Notional: candle.Notional.String(),
+		Trades:   int32(candle.Trades),
+		Closed:   closed,
+	}
+	if !candle.Close.IsZero() {
+		response.Open = candle.Open.String()
+		response.High = candle.High.String()
+		response.Low = candle.Low.String()
+		response.Close = candle.Close.String()
+	}
+	if !candle.MidClose.IsZero() {
+		response.MidOpen = candle.MidOpen.String()
+		response.MidHigh = candle.MidHigh.String()
+		response.MidLow = candle.MidLow.String()
+		response.MidClose = candle.MidClose.String()
+	}
+	return response
+}
+
+// GetCandles returns the most recent candles of an interval, oldest first.
+func (ob OrderbookGrpcControllerV2) GetCandles(ctx context.Context, in *rpc.CandlesRequest) (*rpc.CandlesResponse, error) {
+	feedController, err := ob.v1.getFeedController(in.GetProduct())
+	if err != nil {
+		return nil, err
+	}
+	interval, ok := candleIntervals[in.GetInterval()]
+	if !ok {
+		return nil, invalidArgument("interval", "Interval invalid", in.GetProduct())
+	}
+	candles, err := feedController.Candles(interval, int(in.GetLimit()), in.GetIncludeOpen())
+	if err != nil {
+		return nil, statusFromError(err, in.GetProduct(), "limit")
+	}
+	response := &rpc.CandlesResponse{
+		Product: in.GetProduct(),
+		Candles: make([]*rpc.Candle, len(candles)),
+	}
+	for idx, candle := range candles {
+		// Only the last candle can be open, and only if it was asked for
+		closed := !in.GetIncludeOpen() || idx < len(candles)-1
+		response.Candles[idx] = makeCandle(candle, closed)
+	}
+	return response, nil
+}
+
+// StreamCandles sends the candles of the requested intervals as they close. Candles close
+// CANDLE_CLOSE_DELAY after the end of their interval, or as soon as a later trade is received.
+func (ob OrderbookGrpcControllerV2) StreamCandles(in *rpc.CandlesStreamRequest, stream rpc.OrderbookServiceV2_StreamCandlesServer) error {
+	feedController, err := ob.v1.getFeedController(in.GetProduct())
+	if err != nil {
+		return err
+	}
+	intervals := make(map[time.Duration]bool)
+	for _, requested := range in.GetIntervals() {
+		interval, ok := candleIntervals[requested]
+		if !ok {
+			return invalidArgument("intervals", "Interval invalid", in.GetProduct())
+		}
+		intervals[interval] = true
+	}
+
+	candles, unsubscribe := feedController.SubscribeCandles()
+	defer unsubscribe()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case candle := <-candles:
+			if len(intervals) > 0 && !intervals[candle.Interval] {
+				continue
+			}
+			if err := stream.Send(makeCandle(candle, true)); err != nil {
+				return err
+			}
+		}
+	}
+}
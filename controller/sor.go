@@ -0,0 +1,202 @@
+package controller
+
+import (
+	"fmt"
+	"sort"
+
+	"pirosb3/real_feed/feed"
+
+	"github.com/shopspring/decimal"
+)
+
+// DEFAULT_VENUE names the venue of the books served when no other venue is configured.
+const DEFAULT_VENUE = "default"
+
+// VenueAllocation is the part of an execution routed to a single venue. Size is in base, Notional
+// is the quote exchanged before fees, and Fee is the taker fee paid on Notional.
+type VenueAllocation struct {
+	Venue        string
+	Size         decimal.Decimal
+	Notional     decimal.Decimal
+	AveragePrice decimal.Decimal
+	Fee          decimal.Decimal
+	Fills        []*feed.Fill
+	LastUpdated  int64
+}
+
+// Execution is a market operation of Size base split across venues. Amount is the quote paid, for
+// BUY_BASE, or received, for SELL_BASE, after fees. AveragePrice is the blended price before fees.
+type Execution struct {
+	Operation    string
+	Size         decimal.Decimal
+	Amount       decimal.Decimal
+	Notional     decimal.Decimal
+	Fee          decimal.Decimal
+	AveragePrice decimal.Decimal
+	Allocations  []*VenueAllocation
+}
+
+// venueLevel is a price level of a venue's book, ranked by its price after the venue's fee.
+type venueLevel struct {
+	venue          string
+	price          decimal.Decimal
+	size           decimal.Decimal
+	effectivePrice decimal.Decimal
+}
+
+// SmartOrderRouter splits market operations across the books that several venues keep for the same
+// product, so that the operation as a whole costs the least, fees included.
+type SmartOrderRouter struct {
+	venues       map[string]map[string]*FeedController
+	consolidated map[string]*feed.ConsolidatedOrderbook
+}
+
+// NewSmartOrderRouter creates a router over `venues`, keyed by venue and then by product
+// (example: "coinbase" then "ETH-USD").
+func NewSmartOrderRouter(venues map[string]map[string]*FeedController) *SmartOrderRouter {
+	sor := &SmartOrderRouter{
+		venues:       venues,
+		consolidated: make(map[string]*feed.ConsolidatedOrderbook),
+	}
+	for _, feedControllers := range venues {
+		for product := range feedControllers {
+			if _, ok := sor.consolidated[product]; ok {
+				continue
+			}
+			books := make(map[string]*feed.OrderbookFeed)
+			for _, venue := range sor.Venues(product) {
+				books[venue] = venues[venue][product].orderbook
+			}
+			sor.consolidated[product] = feed.NewConsolidatedOrderbook(product, books)
+		}
+	}
+	return sor
+}
+
+// Venues returns the names of the venues serving `product`, sorted.
+func (sor *SmartOrderRouter) Venues(product string) []string {
+	var venues []string
+	for venue, feedControllers := range sor.venues {
+		if _, ok := feedControllers[product]; ok {
+			venues = append(venues, venue)
+		}
+	}
+	sort.Strings(venues)
+	return venues
+}
+
+// ConsolidatedOrderbook returns the books of every venue serving `product` merged into one.
+func (sor *SmartOrderRouter) ConsolidatedOrderbook(product string) (*feed.ConsolidatedOrderbook, error) {
+	consolidated, ok := sor.consolidated[product]
+	if !ok {
+		return nil, &feed.UnknownProductError{Product: product}
+	}
+	return consolidated, nil
+}
+
+// Plan splits a BUY_BASE or SELL_BASE of `amount` base across the venues serving `product`, taking
+// the best levels across all books after each venue's `feeBps(venue, product)`. Venues whose book is
+// not valid are left out. Each book is read on its own, so books are not priced at the same instant.
+func (sor *SmartOrderRouter) Plan(product, operation string, amount decimal.Decimal, feeBps func(venue, product string) decimal.Decimal) (*Execution, error) {
+	var side string
+	switch operation {
+	case feed.BUY_BASE:
+		side = feed.ASKS
+	case feed.SELL_BASE:
+		side = feed.BIDS
+	default:
+		return nil, fmt.Errorf("%w: %s", feed.ErrUnsupportedOperation, operation)
+	}
+	if amount.Sign() <= 0 {
+		return nil, feed.ErrInvalidAmount
+	}
+	venues := sor.Venues(product)
+	if len(venues) == 0 {
+		return nil, &feed.UnknownProductError{Product: product}
+	}
+
+	one := decimal.NewFromInt(1)
+	feeRates := make(map[string]decimal.Decimal)
+	lastUpdated := make(map[string]int64)
+	var levels []*venueLevel
+	var lastErr error
+	for _, venue := range venues {
+		fee := feeBps(venue, product)
+		if fee.Sign() < 0 || fee.GreaterThanOrEqual(decimal.NewFromInt(10000)) {
+			return nil, feed.ErrInvalidAmount
+		}
+		venueLevels, epoch, err := sor.venues[venue][product].GetLevelsCovering(side, amount)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		feeRate := fee.Div(decimal.NewFromInt(10000))
+		feeRates[venue] = feeRate
+		lastUpdated[venue] = epoch
+		for _, level := range venueLevels {
+			effectivePrice := level.Price.Mul(one.Add(feeRate))
+			if side == feed.BIDS {
+				effectivePrice = level.Price.Mul(one.Sub(feeRate))
+			}
+			levels = append(levels, &venueLevel{
+				venue:          venue,
+				price:          level.Price,
+				size:           level.Size,
+				effectivePrice: effectivePrice,
+			})
+		}
+	}
+	if len(feeRates) == 0 {
+		return nil, lastErr
+	}
+
+	// Cheapest asks first when buying, richest bids first when selling. Venues are visited in name
+	// order, so on equal prices the stable sort prefers the venue that sorts first.
+	sort.SliceStable(levels, func(i, j int) bool {
+		if side == feed.ASKS {
+			return levels[i].effectivePrice.LessThan(levels[j].effectivePrice)
+		}
+		return levels[i].effectivePrice.GreaterThan(levels[j].effectivePrice)
+	})
+
+	allocations := make(map[string]*VenueAllocation)
+	remaining := amount
+	for _, level := range levels {
+		if remaining.Sign() <= 0 {
+			break
+		}
+		size := decimal.Min(level.size, remaining)
+		allocation, ok := allocations[level.venue]
+		if !ok {
+			allocation = &VenueAllocation{Venue: level.venue, LastUpdated: lastUpdated[level.venue]}
+			allocations[level.venue] = allocation
+		}
+		allocation.Size = allocation.Size.Add(size)
+		allocation.Notional = allocation.Notional.Add(size.Mul(level.price))
+		allocation.Fills = append(allocation.Fills, &feed.Fill{Price: level.price, Size: size})
+		remaining = remaining.Sub(size)
+	}
+	if remaining.Sign() > 0 {
+		return nil, &feed.InsufficientLiquidityError{Side: side, MaxFillable: amount.Sub(remaining)}
+	}
+
+	execution := &Execution{Operation: operation, Size: amount}
+	for _, venue := range venues {
+		allocation, ok := allocations[venue]
+		if !ok {
+			continue
+		}
+		allocation.AveragePrice = allocation.Notional.DivRound(allocation.Size, feed.DIVISION_PRECISION)
+		allocation.Fee = allocation.Notional.Mul(feeRates[venue])
+		execution.Notional = execution.Notional.Add(allocation.Notional)
+		execution.Fee = execution.Fee.Add(allocation.Fee)
+		execution.Allocations = append(execution.Allocations, allocation)
+	}
+	execution.AveragePrice = execution.Notional.DivRound(amount, feed.DIVISION_PRECISION)
+	if operation == feed.BUY_BASE {
+		execution.Amount = execution.Notional.Add(execution.Fee)
+	} else {
+		execution.Amount = execution.Notional.Sub(execution.Fee)
+	}
+	return execution, nil
+}
@@ -0,0 +1,336 @@
+// Package coinbasetest provides an in-process stand-in for the Coinbase Pro websocket feed,
+// speaking the subscribe, snapshot, l2update and heartbeat protocol used by the datasource package,
+// along with the level 3 book of the REST API.
+package coinbasetest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	TS_LAYOUT          = "2006-01-02T15:04:05.000000Z"
+	HEARTBEAT_INTERVAL = 100 * time.Millisecond
+)
+
+// Server is a fake Coinbase Pro websocket server. Clients connect to `URL`, and every
+// subscription to the level2 channel is answered with the snapshot set for the product.
+// Behaviours can be scripted while clients are connected.
+type Server struct {
+	URL     string
+	RESTURL string
+
+	httpServer  *httptest.Server
+	upgrader    websocket.Upgrader
+	lock        sync.Mutex
+	connections map[*connection]bool
+	snapshots   map[string]*snapshot
+	orders      map[string]*orderSnapshot
+	heartbeats  bool
+	received    []map[string]interface{}
+	sequence    int64
+	accepted    int
+}
+
+type snapshot struct {
+	bids, asks [][]string
+}
+
+type orderSnapshot struct {
+	sequence   int64
+	bids, asks [][]string
+}
+
+type connection struct {
+	lock     sync.Mutex
+	conn     *websocket.Conn
+	products map[string]bool
+	done     chan struct{}
+}
+
+func (c *connection) writeJSON(message interface{}) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.conn.WriteJSON(message)
+}
+
+func (c *connection) writeRaw(message string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.conn.WriteMessage(websocket.TextMessage, []byte(message))
+}
+
+// NewServer starts a fake server with heartbeats enabled. Call `.Close()` when done.
+func NewServer() *Server {
+	s := &Server{
+		connections: make(map[*connection]bool),
+		snapshots:   make(map[string]*snapshot),
+		orders:      make(map[string]*orderSnapshot),
+		heartbeats:  true,
+	}
+	s.httpServer = httptest.NewServer(http.HandlerFunc(s.handle))
+	s.URL = "ws" + strings.TrimPrefix(s.httpServer.URL, "http")
+	s.RESTURL = s.httpServer.URL
+	return s
+}
+
+// Close disconnects every client and stops the server.
+func (s *Server) Close() {
+	s.CloseConnections()
+	s.httpServer.Close()
+}
+
+// SetSnapshot sets the levels sent to clients subscribing to `product`. Levels are [price, size] pairs.
+func (s *Server) SetSnapshot(product string, bids, asks [][]string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.snapshots[product] = &snapshot{bids: bids, asks: asks}
+}
+
+// SetOrders sets the level 3 book of `product` served at RESTURL, as of exchange `sequence`. Orders
+// are [price, size, order_id] triplets, in queue order.
+func (s *Server) SetOrders(product string, sequence int64, bids, asks [][]string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.orders[product] = &orderSnapshot{sequence: sequence, bids: bids, asks: asks}
+}
+
+// SetHeartbeats starts or stops sending heartbeats to connected clients.
+func (s *Server) SetHeartbeats(enabled bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.heartbeats = enabled
+}
+
+// SendUpdate sends an l2update to every client subscribed to `product`. Changes are
+// [side, price, size] triplets. Pass an earlier `updateTime` to simulate out of order updates.
+func (s *Server) SendUpdate(product string, updateTime time.Time, changes [][]string) {
+	s.broadcast(product, map[string]interface{}{
+		"type":       "l2update",
+		"product_id": product,
+		"time":       updateTime.UTC().Format(TS_LAYOUT),
+		"changes":    changes,
+	})
+}
+
+// SendMatch sends a match to every client subscribed to `product`. `makerSide` is the side of the
+// resting order, "buy" or "sell", and the sequence follows the heartbeats.
+func (s *Server) SendMatch(product string, tradeID int64, makerSide, price, size string) {
+	s.lock.Lock()
+	s.sequence++
+	sequence := s.sequence
+	s.lock.Unlock()
+	s.broadcast(product, map[string]interface{}{
+		"type":           "match",
+		"product_id":     product,
+		"sequence":       sequence,
+		"trade_id":       tradeID,
+		"maker_order_id": "maker",
+		"taker_order_id": "taker",
+		"side":           makerSide,
+		"price":          price,
+		"size":           size,
+		"time":           time.Now().UTC().Format(TS_LAYOUT),
+	})
+}
+
+// SendRaw sends `message` as is to every client, for example to send malformed JSON.
+func (s *Server) SendRaw(message string) {
+	for _, c := range s.getConnections() {
+		c.writeRaw(message)
+	}
+}
+
+// CloseConnections drops every connected client.
+func (s *Server) CloseConnections() {
+	for _, c := range s.getConnections() {
+		c.conn.Close()
+	}
+}
+
+// Connections returns how many connections were accepted since the server started.
+func (s *Server) Connections() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.accepted
+}
+
+// Received returns every message received from clients, in order.
+func (s *Server) Received() []map[string]interface{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]map[string]interface{}{}, s.received...)
+}
+
+// WaitFor polls `condition` until it holds or `timeout` expires, returning whether it held.
+func WaitFor(timeout time.Duration, condition func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return condition()
+}
+
+func (s *Server) getConnections() []*connection {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var connections []*connection
+	for c := range s.connections {
+		connections = append(connections, c)
+	}
+	return connections
+}
+
+func (s *Server) broadcast(product string, message map[string]interface{}) {
+	for _, c := range s.getConnections() {
+		c.lock.Lock()
+		subscribed := c.products[product]
+		c.lock.Unlock()
+		if subscribed {
+			c.writeJSON(message)
+		}
+	}
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/products/") {
+		s.handleOrders(w, r)
+		return
+	}
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	c := &connection{
+		conn:     conn,
+		products: make(map[string]bool),
+		done:     make(chan struct{}),
+	}
+	s.lock.Lock()
+	s.connections[c] = true
+	s.accepted++
+	s.lock.Unlock()
+
+	go s.sendHeartbeats(c)
+	defer func() {
+		close(c.done)
+		conn.Close()
+		s.lock.Lock()
+		delete(s.connections, c)
+		s.lock.Unlock()
+	}()
+	for {
+		var message map[string]interface{}
+		if err := conn.ReadJSON(&message); err != nil {
+			return
+		}
+		s.lock.Lock()
+		s.received = append(s.received, message)
+		s.lock.Unlock()
+		s.handleMessage(c, message)
+	}
+}
+
+// handleOrders serves the level 3 book of /products/<product>/book?level=3.
+func (s *Server) handleOrders(w http.ResponseWriter, r *http.Request) {
+	product := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/products/"), "/book")
+	s.lock.Lock()
+	orders, ok := s.orders[product]
+	s.lock.Unlock()
+	if !ok || r.URL.Query().Get("level") != "3" {
+		http.NotFound(w, r)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"sequence": orders.sequence,
+		"bids":     orders.bids,
+		"asks":     orders.asks,
+	})
+}
+
+func (s *Server) handleMessage(c *connection, message map[string]interface{}) {
+	var products []string
+	productIds, _ := message["product_ids"].([]interface{})
+	for _, productID := range productIds {
+		if product, ok := productID.(string); ok {
+			products = append(products, product)
+		}
+	}
+	channels, _ := message["channels"].([]interface{})
+
+	switch message["type"] {
+	case "subscribe":
+		c.lock.Lock()
+		for _, product := range products {
+			c.products[product] = true
+		}
+		c.lock.Unlock()
+		c.writeJSON(map[string]interface{}{"type": "subscriptions", "channels": channels})
+		for _, product := range products {
+			s.lock.Lock()
+			snapshot, ok := s.snapshots[product]
+			s.lock.Unlock()
+			if ok {
+				c.writeJSON(map[string]interface{}{
+					"type":       "snapshot",
+					"product_id": product,
+					"bids":       snapshot.bids,
+					"asks":       snapshot.asks,
+				})
+			}
+		}
+	case "unsubscribe":
+		c.lock.Lock()
+		for _, product := range products {
+			delete(c.products, product)
+		}
+		c.lock.Unlock()
+		c.writeJSON(map[string]interface{}{"type": "subscriptions", "channels": channels})
+	default:
+		c.writeJSON(map[string]interface{}{"type": "error", "message": "Failed to subscribe"})
+	}
+}
+
+func (s *Server) sendHeartbeats(c *connection) {
+	ticker := time.NewTicker(HEARTBEAT_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			s.lock.Lock()
+			enabled := s.heartbeats
+			s.sequence++
+			sequence := s.sequence
+			s.lock.Unlock()
+			if !enabled {
+				continue
+			}
+			c.lock.Lock()
+			var products []string
+			for product := range c.products {
+				products = append(products, product)
+			}
+			c.lock.Unlock()
+			for _, product := range products {
+				c.writeJSON(map[string]interface{}{
+					"type":          "heartbeat",
+					"product_id":    product,
+					"sequence":      sequence,
+					"last_trade_id": 0,
+					"time":          time.Now().UTC().Format(TS_LAYOUT),
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package datasource
+
+import (
+	"encoding/json"
+	"fmt"
+	"pirosb3/real_feed/feed"
+	"time"
+
+	"github.com/shopspring/decimal"
+	log "github.com/sirupsen/logrus"
+)
+
+// DecodeError is returned for a Coinbase Pro message that cannot be turned into an Event.
+type DecodeError struct {
+	MessageType string
+	Reason      string
+	Err         error
+}
+
+func (e *DecodeError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("malformed %q message: %s: %s", e.MessageType, e.Reason, e.Err.Error())
+	}
+	return fmt.Sprintf("malformed %q message: %s", e.MessageType, e.Reason)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// productOf returns the product a raw message is about, or "" when it cannot be told, for example
+// from a message that is not valid JSON.
+func productOf(message []byte) string {
+	var header struct {
+		ProductID string `json:"product_id"`
+	}
+	if err := json.Unmarshal(message, &header); err != nil {
+		return ""
+	}
+	return header.ProductID
+}
+
+// decodeCoinbaseMessage converts a raw Coinbase Pro message into an Event. Messages that carry no
+// orderbook information return a nil Event and no error, malformed messages return a *DecodeError.
+// Snapshots and heartbeats carry no exchange time, so they are stamped with `receivedAt`.
+func decodeCoinbaseMessage(message []byte, receivedAt time.Time) (*Event, error) {
+	var wsType feed.WebsocketType
+	if err := json.Unmarshal(message, &wsType); err != nil {
+		return nil, &DecodeError{Reason: "invalid JSON", Err: err}
+	}
+
+	switch wsType.Type {
+	case "snapshot":
+		var snapshot feed.L2SnapshotMessage
+		if err := json.Unmarshal(message, &snapshot); err != nil {
+			return nil, &DecodeError{MessageType: wsType.Type, Reason: "unexpected fields", Err: err}
+		}
+		if snapshot.ProductID == "" {
+			return nil, &DecodeError{MessageType: wsType.Type, Reason: "missing product_id"}
+		}
+		bids, err := decodeLevels(wsType.Type, snapshot.Bids)
+		if err != nil {
+			return nil, err
+		}
+		asks, err := decodeLevels(wsType.Type, snapshot.Asks)
+		if err != nil {
+			return nil, err
+		}
+		return &Event{
+			Type:    SNAPSHOT_EVENT,
+			Product: snapshot.ProductID,
+			Time:    receivedAt,
+			Bids:    bids,
+			Asks:    asks,
+		}, nil
+	case "l2update":
+		var update feed.L2UpdateMessage
+		if err := json.Unmarshal(message, &update); err != nil {
+			return nil, &DecodeError{MessageType: wsType.Type, Reason: "unexpected fields", Err: err}
+		}
+		if update.ProductID == "" {
+			return nil, &DecodeError{MessageType: wsType.Type, Reason: "missing product_id"}
+		}
+		if update.Time.IsZero() {
+			return nil, &DecodeError{MessageType: wsType.Type, Reason: "missing time"}
+		}
+		var bids []*feed.Update
+		var asks []*feed.Update
+		for _, change := range update.Changes {
+			if len(change) != 3 {
+				return nil, &DecodeError{
+					MessageType: wsType.Type,
+					Reason:      fmt.Sprintf("change has %d elements, expected side, price and size", len(change)),
+				}
+			}
+			level := &feed.Update{Price: change[1], Size: change[2]}
+			switch change[0] {
+			case "buy":
+				bids = append(bids, level)
+			case "sell":
+				asks = append(asks, level)
+			default:
+				return nil, &DecodeError{MessageType: wsType.Type, Reason: fmt.Sprintf("unknown side %q", change[0])}
+			}
+		}
+		return &Event{
+			Type:    UPDATE_EVENT,
+			Product: update.ProductID,
+			Time:    update.Time,
+			Bids:    bids,
+			Asks:    asks,
+		}, nil
+	case "heartbeat":
+		var heartbeat feed.HeartbeatMessage
+		if err := json.Unmarshal(message, &heartbeat); err != nil {
+			return nil, &DecodeError{MessageType: wsType.Type, Reason: "unexpected fields", Err: err}
+		}
+		if heartbeat.ProductID == "" {
+			return nil, &DecodeError{MessageType: wsType.Type, Reason: "missing product_id"}
+		}
+		return &Event{
+			Type:    HEARTBEAT_EVENT,
+			Product: heartbeat.ProductID,
+			Time:    receivedAt,
+		}, nil
+	case feed.ORDER_RECEIVED, feed.ORDER_OPEN, feed.ORDER_DONE, feed.ORDER_MATCH, feed.ORDER_CHANGE:
+		return decodeFullChannelMessage(wsType.Type, message)
+	case "last_match":
+		// Sent once when subscribing to the matches channel, the resting order is long gone
+		event, err := decodeFullChannelMessage(wsType.Type, message)
+		if event != nil {
+			event.Orders = nil
+		}
+		return event, err
+	case "error":
+		var errorMessage feed.ErrorMessage
+		if err := json.Unmarshal(message, &errorMessage); err != nil {
+			return nil, &DecodeError{MessageType: wsType.Type, Reason: "unexpected fields", Err: err}
+		}
+		log.WithField("message", errorMessage.Message).WithField("reason", errorMessage.Reason).Errorln("Received an error from the exchange")
+	case "subscriptions":
+	case "":
+		return nil, &DecodeError{Reason: "missing type"}
+	default:
+		log.WithField("messageType", wsType.Type).Warningln("Received an unexpected message")
+	}
+	return nil, nil
+}
+
+// sides maps the side of a Coinbase Pro order to the side of the book it rests on.
+var sides = map[string]string{
+	"buy":  feed.BIDS,
+	"sell": feed.ASKS,
+}
+
+// takerSides maps the side of the resting order of a match to the side of the taker.
+var takerSides = map[string]string{
+	"buy":  feed.TRADE_SELL,
+	"sell": feed.TRADE_BUY,
+}
+
+// decodeFullChannelMessage converts a message of the full channel into an ORDER_EVENT, and a match
+// of either the full or the matches channel into a TRADE_EVENT.
+func decodeFullChannelMessage(messageType string, message []byte) (*Event, error) {
+	var fullMessage feed.FullChannelMessage
+	if err := json.Unmarshal(message, &fullMessage); err != nil {
+		return nil, &DecodeError{MessageType: messageType, Reason: "unexpected fields", Err: err}
+	}
+	if fullMessage.ProductID == "" {
+		return nil, &DecodeError{MessageType: messageType, Reason: "missing product_id"}
+	}
+	if fullMessage.Sequence <= 0 {
+		return nil, &DecodeError{MessageType: messageType, Reason: "missing sequence"}
+	}
+	if fullMessage.Time.IsZero() {
+		return nil, &DecodeError{MessageType: messageType, Reason: "missing time"}
+	}
+	side, ok := sides[fullMessage.Side]
+	if !ok {
+		return nil, &DecodeError{MessageType: messageType, Reason: fmt.Sprintf("unknown side %q", fullMessage.Side)}
+	}
+	update := &feed.OrderUpdate{
+		Type:     messageType,
+		Sequence: fullMessage.Sequence,
+		OrderID:  fullMessage.OrderID,
+		Side:     side,
+		Price:    fullMessage.Price,
+	}
+	switch messageType {
+	case feed.ORDER_RECEIVED:
+		update.Size = fullMessage.Size
+	case feed.ORDER_OPEN, feed.ORDER_DONE:
+		update.Size = fullMessage.RemainingSize
+	case feed.ORDER_MATCH, "last_match":
+		// The order on the book is the maker, the taker never rests
+		update.Type = feed.ORDER_MATCH
+		update.OrderID = fullMessage.MakerOrderID
+		update.Size = fullMessage.Size
+	case feed.ORDER_CHANGE:
+		update.Size = fullMessage.NewSize
+	}
+	if update.OrderID == "" {
+		return nil, &DecodeError{MessageType: messageType, Reason: "missing order id"}
+	}
+	if update.Type == feed.ORDER_MATCH {
+		trade, err := decodeTrade(messageType, &fullMessage)
+		if err != nil {
+			return nil, err
+		}
+		return &Event{
+			Type:    TRADE_EVENT,
+			Product: fullMessage.ProductID,
+			Time:    fullMessage.Time,
+			Orders:  []*feed.OrderUpdate{update},
+			Trades:  []*feed.Trade{trade},
+		}, nil
+	}
+	return &Event{
+		Type:    ORDER_EVENT,
+		Product: fullMessage.ProductID,
+		Time:    fullMessage.Time,
+		Orders:  []*feed.OrderUpdate{update},
+	}, nil
+}
+
+func decodeTrade(messageType string, match *feed.FullChannelMessage) (*feed.Trade, error) {
+	if match.TradeID <= 0 {
+		return nil, &DecodeError{MessageType: messageType, Reason: "missing trade_id"}
+	}
+	price, err := decimal.NewFromString(match.Price)
+	if err != nil {
+		return nil, &DecodeError{MessageType: messageType, Reason: "invalid price", Err: err}
+	}
+	size, err := decimal.NewFromString(match.Size)
+	if err != nil {
+		return nil, &DecodeError{MessageType: messageType, Reason: "invalid size", Err: err}
+	}
+	return &feed.Trade{
+		TradeID: match.TradeID,
+		Side:    takerSides[match.Side],
+		Price:   price,
+		Size:    size,
+		Time:    match.Time,
+	}, nil
+}
+
+func decodeLevels(messageType string, levels [][]string) ([]*feed.Update, error) {
+	updates := make([]*feed.Update, len(levels))
+	for idx, level := range levels {
+		if len(level) != 2 {
+			return nil, &DecodeError{
+				MessageType: messageType,
+				Reason:      fmt.Sprintf("level has %d elements, expected price and size", len(level)),
+			}
+		}
+		updates[idx] = &feed.Update{Price: level[0], Size: level[1]}
+	}
+	return updates, nil
+}
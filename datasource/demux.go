@@ -0,0 +1,115 @@
+package datasource
+
+import (
+	"context"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+var demuxDroppedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name:      "demuxDroppedEvents",
+	Help:      "Shows the amount of events dropped because a product consumer was not keeping up",
+	Namespace: "feed",
+}, []string{"market"})
+
+// MultiProductSource is a Source that emits events for several products and can
+// request a snapshot for a single one of them.
+type MultiProductSource interface {
+	Source
+	RequestProductSnapshot(product string)
+}
+
+// Demultiplexer shares a single MultiProductSource between several consumers, one per product.
+// Each consumer gets a Source of its own that only emits the events for its product.
+type Demultiplexer struct {
+	ctx       context.Context
+	source    MultiProductSource
+	startOnce sync.Once
+	startErr  error
+	products  map[string]*productSource
+}
+
+// NewDemultiplexer wraps `source`. Call `.Source(product)` for every product before starting
+// any of the returned sources, the underlying source is started along with the first one.
+func NewDemultiplexer(ctx context.Context, source MultiProductSource) *Demultiplexer {
+	return &Demultiplexer{
+		ctx:      ctx,
+		source:   source,
+		products: make(map[string]*productSource),
+	}
+}
+
+// Source returns the Source for a single product.
+func (dm *Demultiplexer) Source(product string) Source {
+	ps, ok := dm.products[product]
+	if !ok {
+		ps = &productSource{
+			demux:   dm,
+			product: product,
+			outChan: make(chan (*Event), CHANNEL_BUFFER_SIZE),
+		}
+		dm.products[product] = ps
+	}
+	return ps
+}
+
+func (dm *Demultiplexer) start() error {
+	dm.startOnce.Do(func() {
+		dm.startErr = dm.source.Start()
+		if dm.startErr == nil {
+			go dm.runLoop()
+		}
+	})
+	return dm.startErr
+}
+
+func (dm *Demultiplexer) runLoop() {
+	for {
+		select {
+		case <-dm.ctx.Done():
+			return
+		case event := <-dm.source.Events():
+			ps, ok := dm.products[event.Product]
+			if !ok {
+				log.WithField("product", event.Product).Warningln("Received an event for a product with no consumer")
+				continue
+			}
+			if event.Type == SOURCE_FAILED_EVENT {
+				// Nothing follows a failure, so it cannot be recovered from by a resync
+				select {
+				case ps.outChan <- event:
+				case <-dm.ctx.Done():
+					return
+				}
+				continue
+			}
+			select {
+			case ps.outChan <- event:
+			default:
+				// The consumer will see a gap in the sequence and resync
+				demuxDroppedCounter.WithLabelValues(event.Product).Inc()
+			}
+		}
+	}
+}
+
+type productSource struct {
+	demux   *Demultiplexer
+	product string
+	outChan chan (*Event)
+}
+
+func (ps *productSource) Start() error {
+	return ps.demux.start()
+}
+
+func (ps *productSource) Events() <-chan *Event {
+	return ps.outChan
+}
+
+func (ps *productSource) RequestSnapshot() {
+	ps.demux.source.RequestProductSnapshot(ps.product)
+}
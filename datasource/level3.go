@@ -0,0 +1,109 @@
+package datasource
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"pirosb3/real_feed/feed"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	COINBASE_PRO_REST_URL = "https://api.pro.coinbase.com"
+	// ORDER_SNAPSHOT_TIMEOUT bounds the request for a level 3 snapshot, which can hold tens of thousands of orders
+	ORDER_SNAPSHOT_TIMEOUT = 10 * time.Second
+)
+
+// NewCoinbaseProFullChannelWebsocket creates a websocket subscribed to the full channel instead of
+// level2, which emits every order placed, matched, changed and cancelled as an ORDER_EVENT. The full
+// channel sends no snapshot, so once subscribed, and whenever a snapshot is requested, the level 3
+// book is fetched from the REST API at `restURL`, usually `COINBASE_PRO_REST_URL`, and emitted as an
+// ORDER_SNAPSHOT_EVENT. Order events received meanwhile are not held back, consumers should keep
+// those that follow the ExchangeSequence of the snapshot.
+func NewCoinbaseProFullChannelWebsocket(
+	ctx context.Context,
+	url string,
+	restURL string,
+	products ...string,
+) *CoinbaseProWebsocket {
+	ws := NewCoinbaseProWebsocket(ctx, url, products...)
+	ws.channels = []string{"full", "heartbeat"}
+	ws.restURL = restURL
+	return ws
+}
+
+// fetchOrderSnapshot requests the level 3 book of `product` and queues it to be emitted by the
+// connection. Failures are logged, the consumer keeps waiting and requests a snapshot again on the
+// next gap.
+func (ws *CoinbaseProWebsocket) fetchOrderSnapshot(product string) {
+	ctx, cancelFn := context.WithTimeout(ws.ctx, ORDER_SNAPSHOT_TIMEOUT)
+	defer cancelFn()
+	event, err := fetchCoinbaseOrderSnapshot(ctx, ws.restURL, product)
+	if err != nil {
+		log.WithField("product", product).WithField("err", err.Error()).Errorln("Failed to fetch the level 3 snapshot")
+		return
+	}
+	select {
+	case ws.orderSnapshots <- event:
+	default:
+		log.WithField("product", product).Warningln("Too many level 3 snapshots pending, dropping the snapshot")
+	}
+}
+
+// fetchCoinbaseOrderSnapshot requests the level 3 book of `product` from the Coinbase Pro REST API
+// and converts it into an ORDER_SNAPSHOT_EVENT.
+func fetchCoinbaseOrderSnapshot(ctx context.Context, restURL string, product string) (*Event, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/products/%s/book?level=3", restURL, product), nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", response.StatusCode)
+	}
+	receivedAt := time.Now()
+
+	var snapshot feed.L3SnapshotMessage
+	if err := json.NewDecoder(response.Body).Decode(&snapshot); err != nil {
+		return nil, &DecodeError{MessageType: ORDER_SNAPSHOT_EVENT, Reason: "unexpected fields", Err: err}
+	}
+	if snapshot.Sequence <= 0 {
+		return nil, &DecodeError{MessageType: ORDER_SNAPSHOT_EVENT, Reason: "missing sequence"}
+	}
+	orders := make([]*feed.OrderUpdate, 0, len(snapshot.Bids)+len(snapshot.Asks))
+	for _, side := range []struct {
+		name   string
+		orders [][]string
+	}{{feed.BIDS, snapshot.Bids}, {feed.ASKS, snapshot.Asks}} {
+		for _, order := range side.orders {
+			if len(order) != 3 {
+				return nil, &DecodeError{
+					MessageType: ORDER_SNAPSHOT_EVENT,
+					Reason:      fmt.Sprintf("order has %d elements, expected price, size and order id", len(order)),
+				}
+			}
+			orders = append(orders, &feed.OrderUpdate{
+				Type:     feed.ORDER_OPEN,
+				Sequence: snapshot.Sequence,
+				OrderID:  order[2],
+				Side:     side.name,
+				Price:    order[0],
+				Size:     order[1],
+			})
+		}
+	}
+	return &Event{
+		Type:             ORDER_SNAPSHOT_EVENT,
+		Product:          product,
+		Time:             receivedAt,
+		Orders:           orders,
+		ExchangeSequence: snapshot.Sequence,
+	}, nil
+}
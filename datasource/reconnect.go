@@ -0,0 +1,76 @@
+package datasource
+
+import (
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Connection states of a CoinbaseProWebsocket. A websocket moves from connecting to subscribed once
+// the subscription is sent, and to live once the first message arrives. If no message arrives within
+// the heartbeat TTL it becomes stale, and it is reconnecting while it waits to dial again.
+const (
+	STATE_CONNECTING   = "connecting"
+	STATE_SUBSCRIBED   = "subscribed"
+	STATE_LIVE         = "live"
+	STATE_STALE        = "stale"
+	STATE_RECONNECTING = "reconnecting"
+	// STATE_FAILED is final, the reconnect policy ran out of attempts
+	STATE_FAILED = "failed"
+	// STATE_CLOSED is final, the context of the websocket was cancelled
+	STATE_CLOSED = "closed"
+)
+
+var (
+	connectionStateGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "connectionState",
+		Help:      "Is 1 for the current connection state of the websocket, 0 for every other state",
+		Namespace: "feed",
+	}, []string{"uuid", "market", "state"})
+
+	reconnectsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "reconnects",
+		Help:      "Shows the frequency of websocket reconnection attempts",
+		Namespace: "feed",
+	}, []string{"uuid", "market"})
+)
+
+// ReconnectPolicy decides how long a websocket waits before each reconnection attempt. The first
+// attempt waits InitialBackoff, and every further attempt waits Multiplier times longer, up to
+// MaxBackoff. Each wait is then spread randomly by up to Jitter (a fraction, 0.2 is ±20%) so that
+// several processes do not reconnect in lockstep. After MaxAttempts consecutive attempts that do
+// not get a single message through, the websocket gives up; a MaxAttempts of 0 retries forever.
+type ReconnectPolicy struct {
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	Jitter         float64
+	MaxAttempts    int
+}
+
+// DefaultReconnectPolicy retries forever, backing off from half a second up to 30 seconds.
+var DefaultReconnectPolicy = ReconnectPolicy{
+	InitialBackoff: 500 * time.Millisecond,
+	MaxBackoff:     30 * time.Second,
+	Multiplier:     2,
+	Jitter:         0.2,
+	MaxAttempts:    0,
+}
+
+// backoff returns how long to wait before reconnection `attempt`, starting from 1.
+func (rp ReconnectPolicy) backoff(attempt int) time.Duration {
+	backoff := float64(rp.InitialBackoff) * math.Pow(rp.Multiplier, float64(attempt-1))
+	if backoff > float64(rp.MaxBackoff) {
+		backoff = float64(rp.MaxBackoff)
+	}
+	backoff *= 1 + rp.Jitter*(2*rand.Float64()-1)
+	return time.Duration(backoff)
+}
+
+// exhausted returns true when `attempt` exceeds the policy's MaxAttempts.
+func (rp ReconnectPolicy) exhausted(attempt int) bool {
+	return rp.MaxAttempts > 0 && attempt > rp.MaxAttempts
+}
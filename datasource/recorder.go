@@ -0,0 +1,83 @@
+package datasource
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// RecordedMessage is a single line of a recording: a raw websocket message and the time it was received.
+// Raw holds the message exactly as received, base64 encoded, so that frames that are not valid JSON
+// are recorded too. Recordings made before Raw was added hold the message in Message instead.
+type RecordedMessage struct {
+	ReceivedAt time.Time       `json:"received_at"`
+	Raw        []byte          `json:"raw,omitempty"`
+	Message    json.RawMessage `json:"message,omitempty"`
+}
+
+// payload returns the message as received.
+func (rm *RecordedMessage) payload() []byte {
+	if rm.Raw != nil {
+		return rm.Raw
+	}
+	return rm.Message
+}
+
+// RECORDER_FLUSH_INTERVAL bounds how much of a recording is lost if the process dies without closing it.
+const RECORDER_FLUSH_INTERVAL = time.Second
+
+// Recorder writes raw websocket messages to a gzip compressed JSONL file, one RecordedMessage per line.
+// Recordings can be played back with a ReplaySource.
+type Recorder struct {
+	lock       sync.Mutex
+	file       *os.File
+	gzipWriter *gzip.Writer
+	encoder    *json.Encoder
+	lastFlush  time.Time
+}
+
+// NewRecorder creates, or truncates, the recording at `path`. Call `.Close()` to flush the recording.
+func NewRecorder(path string) (*Recorder, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	gzipWriter := gzip.NewWriter(file)
+	return &Recorder{
+		file:       file,
+		gzipWriter: gzipWriter,
+		encoder:    json.NewEncoder(gzipWriter),
+		lastFlush:  time.Now(),
+	}, nil
+}
+
+// Record appends a message to the recording.
+func (r *Recorder) Record(receivedAt time.Time, message []byte) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	err := r.encoder.Encode(&RecordedMessage{
+		ReceivedAt: receivedAt,
+		Raw:        message,
+	})
+	if err != nil {
+		return err
+	}
+	if time.Since(r.lastFlush) > RECORDER_FLUSH_INTERVAL {
+		r.lastFlush = time.Now()
+		return r.gzipWriter.Flush()
+	}
+	return nil
+}
+
+// Close flushes the compressed stream and closes the file.
+func (r *Recorder) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err := r.gzipWriter.Close(); err != nil {
+		r.file.Close()
+		return err
+	}
+	return r.file.Close()
+}
@@ -0,0 +1,155 @@
+package datasource
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// REPLAY_AS_FAST_AS_POSSIBLE plays a recording back without waiting between messages.
+const REPLAY_AS_FAST_AS_POSSIBLE = 0
+
+// ReplaySource is a Source that plays back a recording made by a Recorder. Replayed event times
+// are moved onto the replay clock, so that books driven by a replay are not considered stale.
+type ReplaySource struct {
+	ctx       context.Context
+	path      string
+	speed     float64
+	startLock sync.Mutex
+	running   bool
+	sequences map[string]int64
+	trades    map[string]int64
+	outChan   chan (*Event)
+}
+
+// NewReplaySource creates a source that replays the recording at `path`. A `speed` of 1 plays
+// the recording back at the original speed, 10 ten times faster, and REPLAY_AS_FAST_AS_POSSIBLE
+// does not wait at all. Unlike a live websocket a replay never drops events, it waits for the
+// consumer instead. To stop the replay, cancel the context passed in as first argument.
+func NewReplaySource(ctx context.Context, path string, speed float64) *ReplaySource {
+	return &ReplaySource{
+		ctx:       ctx,
+		path:      path,
+		speed:     speed,
+		sequences: make(map[string]int64),
+		trades:    make(map[string]int64),
+		outChan:   make(chan (*Event), CHANNEL_BUFFER_SIZE),
+	}
+}
+
+func (rs *ReplaySource) Events() <-chan *Event {
+	return rs.outChan
+}
+
+// RequestSnapshot is not supported by recordings, only the snapshots in the recording are replayed.
+func (rs *ReplaySource) RequestSnapshot() {
+	log.WithField("path", rs.path).Warningln("Snapshots cannot be requested from a replay")
+}
+
+func (rs *ReplaySource) RequestProductSnapshot(product string) {
+	rs.RequestSnapshot()
+}
+
+// Start opens the recording and starts the replay. The function call does not block.
+func (rs *ReplaySource) Start() error {
+	rs.startLock.Lock()
+	defer rs.startLock.Unlock()
+
+	if rs.running {
+		return errors.New("Replay was already running. Cancel the context for the replay to close down")
+	}
+	file, err := os.Open(rs.path)
+	if err != nil {
+		return err
+	}
+	gzipReader, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rs.running = true
+	go func() {
+		defer file.Close()
+		rs.runReplay(gzipReader)
+	}()
+	return nil
+}
+
+// replayTime maps the time a message was recorded at onto the replay clock.
+func (rs *ReplaySource) replayTime(recordedAt, firstRecordedAt, replayStart time.Time) time.Time {
+	if rs.speed == REPLAY_AS_FAST_AS_POSSIBLE {
+		return time.Now()
+	}
+	return replayStart.Add(time.Duration(float64(recordedAt.Sub(firstRecordedAt)) / rs.speed))
+}
+
+func (rs *ReplaySource) runReplay(gzipReader *gzip.Reader) {
+	scanner := bufio.NewScanner(gzipReader)
+	// Snapshots of busy books are much larger than the default buffer
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+
+	replayStart := time.Now()
+	var firstRecordedAt time.Time
+	for scanner.Scan() {
+		var recorded RecordedMessage
+		if err := json.Unmarshal(scanner.Bytes(), &recorded); err != nil {
+			log.WithField("err", err.Error()).Errorln("Skipped recorded line that is not valid JSON")
+			continue
+		}
+		if firstRecordedAt.IsZero() {
+			firstRecordedAt = recorded.ReceivedAt
+		}
+
+		// Wait until the message is due
+		playAt := rs.replayTime(recorded.ReceivedAt, firstRecordedAt, replayStart)
+		if wait := time.Until(playAt); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-rs.ctx.Done():
+				return
+			}
+		}
+
+		message := recorded.payload()
+		event, err := decodeCoinbaseMessage(message, recorded.ReceivedAt)
+		if err != nil {
+			log.WithField("err", err.Error()).Errorln("Skipped malformed recorded message")
+			// Consumers see a gap where the message was skipped, as with a live websocket
+			if product := productOf(message); rs.sequences[product] > 0 {
+				rs.sequences[product]++
+			} else {
+				for product := range rs.sequences {
+					rs.sequences[product]++
+				}
+			}
+			continue
+		}
+		if event == nil {
+			continue
+		}
+		event.Time = rs.replayTime(event.Time, firstRecordedAt, replayStart)
+		rs.sequences[event.Product]++
+		event.Sequence = rs.sequences[event.Product]
+		if event.Type == TRADE_EVENT {
+			rs.trades[event.Product]++
+		}
+		event.TradeSequence = rs.trades[event.Product]
+		select {
+		case rs.outChan <- event:
+		case <-rs.ctx.Done():
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.WithField("err", err.Error()).Errorln("Replay stopped due to error")
+		return
+	}
+	log.WithField("path", rs.path).Infoln("Replay finished")
+}
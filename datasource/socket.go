@@ -5,7 +5,9 @@ import (
 	"errors"
 	"net/http"
 	"pirosb3/real_feed/feed"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -15,15 +17,14 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-const heartbeatTTLSeconds = 4
+const (
+	heartbeatTTLSeconds = 4
 
-var (
-	pricingProm = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name:      "pricing",
-		Help:      "Orderbook visualization for 50 ETH",
-		Namespace: "feed",
-	}, []string{"uuid", "market"})
+	COINBASE_PRO_URL = "wss://ws-feed.pro.coinbase.com"
+	TS_LAYOUT        = "2006-01-02T15:04:05.000000Z"
+)
 
+var (
 	updatesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name:      "updates",
 		Help:      "Shows the frequency of orderbook updates coming out of the websocket",
@@ -41,6 +42,11 @@ var (
 		Help:      "Shows the frequency of timeouts",
 		Namespace: "feed",
 	}, []string{"uuid", "market"})
+	malformedMessagesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name:      "malformedMessages",
+		Help:      "Shows the amount of websocket messages skipped because they could not be decoded",
+		Namespace: "feed",
+	}, []string{"uuid", "market"})
 	wsLatency = promauto.NewSummaryVec(prometheus.SummaryOpts{
 		Name:      "websocketUpdateFrequency",
 		Help:      "Shows the frequency of websocket responses",
@@ -48,122 +54,355 @@ var (
 	}, []string{"uuid", "market"})
 )
 
+// CoinbaseProWebsocket is a Source backed by the Coinbase Pro level2 and matches websocket channels, or
+// by the full channel. A single websocket can subscribe to several products, use a Demultiplexer to
+// split its events per product.
 type CoinbaseProWebsocket struct {
-	uuid                string
-	startLock           sync.Mutex
-	websocketConn       *websocket.Conn
-	product             string
-	running             bool
-	ctx                 context.Context
-	outChan             chan (map[string]interface{})
-	inChan              chan (interface{})
-	outInternalChan     chan (map[string]interface{})
-	timeoutInternalChan chan (bool)
+	uuid            string
+	startLock       sync.Mutex
+	stateLock       sync.Mutex
+	state           string
+	url             string
+	products        []string
+	market          string
+	running         bool
+	sequences       map[string]*int64
+	tradeSequences  map[string]*int64
+	ctx             context.Context
+	outChan         chan (*Event)
+	inChan          chan (interface{})
+	recorder        *Recorder
+	heartbeatTTL    time.Duration
+	reconnectPolicy ReconnectPolicy
+	channels        []string
+	restURL         string
+	orderSnapshots  chan (*Event)
 }
 
 // NewCoinbaseProWebsocket creates a new Coinbase Pro websocket feed. The feed will only start running once `.Start()` is called on the websocket.
-// The `product` should be a Coinbase Pro ticket (example: "ETH-USD"), the `outChan` and `inChan` passed in allow the feed to send / receive messages
-// and allow any external component to interact with the websocket service.
-// This websocket is also fault-tolerant, if an update is not received within `heartbeatTTLSeconds` seconds, the websocket is automatically re-created.
+// The `url` is the websocket endpoint, usually `COINBASE_PRO_URL`, and the `products` should be Coinbase Pro tickets (example: "ETH-USD").
+// Normalized events are available through `.Events()`, sequence numbers are contiguous per product.
+// This websocket is also fault-tolerant, if an update is not received within `heartbeatTTLSeconds` seconds, the websocket is
+// re-created following the DefaultReconnectPolicy, see `.SetReconnectPolicy()`.
 // To shutdown the websocket, simply cancel the context passed in as first argument.
 func NewCoinbaseProWebsocket(
 	ctx context.Context,
-	product string,
-	outChan chan (map[string]interface{}),
-	inChan chan (interface{}),
+	url string,
+	products ...string,
 ) *CoinbaseProWebsocket {
 	aUUID, _ := uuid.NewUUID()
+	sequences := make(map[string]*int64)
+	tradeSequences := make(map[string]*int64)
+	for _, product := range products {
+		sequences[product] = new(int64)
+		tradeSequences[product] = new(int64)
+	}
 	return &CoinbaseProWebsocket{
-		uuid:                aUUID.String(),
-		product:             product,
-		running:             false,
-		ctx:                 ctx,
-		inChan:              inChan,
-		outChan:             outChan,
-		outInternalChan:     make(chan (map[string]interface{})),
-		timeoutInternalChan: make(chan bool),
+		uuid:            aUUID.String(),
+		url:             url,
+		products:        products,
+		market:          strings.Join(products, ","),
+		sequences:       sequences,
+		tradeSequences:  tradeSequences,
+		running:         false,
+		ctx:             ctx,
+		inChan:          make(chan (interface{}), CHANNEL_BUFFER_SIZE),
+		outChan:         make(chan (*Event), CHANNEL_BUFFER_SIZE),
+		heartbeatTTL:    time.Second * heartbeatTTLSeconds,
+		reconnectPolicy: DefaultReconnectPolicy,
+		channels:        []string{"level2", "heartbeat", "matches"},
+		orderSnapshots:  make(chan (*Event), CHANNEL_BUFFER_SIZE),
 	}
 }
 
-func (ws *CoinbaseProWebsocket) makeSubscriptionMessage() feed.MessageSubscription {
+// Events returns the channel on which normalized events are emitted.
+func (ws *CoinbaseProWebsocket) Events() <-chan *Event {
+	return ws.outChan
+}
+
+func (ws *CoinbaseProWebsocket) makeSubscriptionMessage(messageType string, products []string) feed.MessageSubscription {
 	subscription := feed.MessageSubscription{
 		WebsocketType: feed.WebsocketType{
-			Type: "subscribe",
-		},
-		ProductIds: []string{
-			ws.product,
-		},
-		Channels: []interface{}{
-			"level2",
-			"heartbeat",
+			Type: messageType,
 		},
+		ProductIds: products,
+	}
+	for _, channel := range ws.channels {
+		subscription.Channels = append(subscription.Channels, channel)
 	}
 	return subscription
 }
 
+// State returns the current connection state, one of the STATE_ constants.
+func (ws *CoinbaseProWebsocket) State() string {
+	ws.stateLock.Lock()
+	defer ws.stateLock.Unlock()
+	return ws.state
+}
+
+func (ws *CoinbaseProWebsocket) setState(state string) {
+	ws.stateLock.Lock()
+	previousState := ws.state
+	ws.state = state
+	ws.stateLock.Unlock()
+	if previousState == state {
+		return
+	}
+	if previousState != "" {
+		connectionStateGauge.WithLabelValues(ws.uuid, ws.market, previousState).Set(0)
+	}
+	connectionStateGauge.WithLabelValues(ws.uuid, ws.market, state).Set(1)
+	log.WithField("uuid", ws.uuid).WithField("market", ws.market).
+		WithField("previousState", previousState).WithField("state", state).Infoln("Websocket state changed")
+}
+
+// runLoop is the reconnect state machine. It owns the connection, and is the only goroutine writing to it.
 func (ws *CoinbaseProWebsocket) runLoop() {
+	attempt := 0
+	for {
+		ws.setState(STATE_CONNECTING)
+		connection, _, err := websocket.DefaultDialer.DialContext(ws.ctx, ws.url, http.Header{})
+		if err != nil {
+			log.WithField("err", err.Error()).WithField("attempt", attempt).Errorln("error in dialling connection")
+		} else {
+			if ws.serve(connection) {
+				// At least one message got through, so the next failure starts a fresh backoff
+				attempt = 0
+			}
+			connection.Close()
+		}
+		if ws.ctx.Err() != nil {
+			ws.setState(STATE_CLOSED)
+			return
+		}
+
+		attempt++
+		if ws.reconnectPolicy.exhausted(attempt) {
+			ws.setState(STATE_FAILED)
+			log.WithField("attempts", attempt-1).Errorln("Websocket gave up reconnecting")
+			ws.emitFailed()
+			return
+		}
+		ws.setState(STATE_RECONNECTING)
+		reconnectsCounter.WithLabelValues(ws.uuid, ws.market).Inc()
+		if !ws.wait(ws.reconnectPolicy.backoff(attempt)) {
+			ws.setState(STATE_CLOSED)
+			return
+		}
+	}
+}
+
+// wait waits for `backoff`, returning false if the context was cancelled meanwhile. Messages
+// written to the websocket while it is disconnected are skipped, a new connection subscribes anyway.
+// Level 3 snapshots fetched meanwhile stay queued and are emitted once reconnected, along with the
+// snapshots the new connection fetches.
+func (ws *CoinbaseProWebsocket) wait(backoff time.Duration) bool {
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
 	for {
 		select {
 		case <-ws.ctx.Done():
-			// Parent context wants us to shut down. Simply stop websocket
-			ws.timeoutInternalChan <- true
-			return
-		case msgIn := <-ws.inChan:
-			// Some other process is trying to write a message to the websocket
-			if ws.websocketConn == nil {
-				log.Fatalln("Configured websocket does not exist, this should never happen. Message was skipped")
-			}
-			ws.websocketConn.WriteJSON(msgIn)
-		case msgOut := <-ws.outInternalChan:
-			// A message should be broadcasted to the outside. Writes the message to an outbound queue without blocking
-			updatesCounter.WithLabelValues(ws.uuid, ws.product).Inc()
-			select {
-			case ws.outChan <- msgOut:
-			default:
-				log.Warningln("Websocket has no consumer for outgoing messages, dropping the message.")
-				droppedPacketsCounter.WithLabelValues(ws.uuid, ws.product).Inc()
-			}
-		case <-time.After(time.Second * heartbeatTTLSeconds):
-			// Something is wrong, websocket has not been responding for a fair amount of time. We should recreate the websocket
-			timeoutsCounter.WithLabelValues(ws.uuid, ws.product).Inc()
-			ws.timeoutInternalChan <- true
-			go ws.setupWebsocket()
+			return false
+		case <-ws.inChan:
+			log.Warningln("Websocket is reconnecting, message was skipped")
+		case <-timer.C:
+			return true
 		}
 	}
 }
 
-func (ws *CoinbaseProWebsocket) setupWebsocket() {
-	var connection *websocket.Conn
+type receivedMessage struct {
+	message    []byte
+	receivedAt time.Time
+}
+
+// serve subscribes on `connection` and forwards its events until the connection breaks, goes
+// stale or the context is cancelled. Returns true if any message was received.
+func (ws *CoinbaseProWebsocket) serve(connection *websocket.Conn) bool {
+	if err := connection.WriteJSON(ws.makeSubscriptionMessage("subscribe", ws.products)); err != nil {
+		log.WithField("err", err.Error()).Errorln("error in subscribing")
+		return false
+	}
+	ws.setState(STATE_SUBSCRIBED)
+	if ws.restURL != "" {
+		// The full channel sends no snapshot, the level 3 book is fetched once messages are flowing
+		for _, product := range ws.products {
+			go ws.fetchOrderSnapshot(product)
+		}
+	}
+
+	messages := make(chan *receivedMessage)
+	readErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
 	go func() {
 		for {
-			<-ws.timeoutInternalChan
-			log.Warningln("Connection was intentionally closed due to a timeout or due to parent context closing")
-			if connection != nil {
-				connection.Close()
+			_, message, err := connection.ReadMessage()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			select {
+			case messages <- &receivedMessage{message: message, receivedAt: time.Now()}:
+			case <-done:
+				return
 			}
-			return
 		}
 	}()
 
-	connection, _, err := websocket.DefaultDialer.Dial("wss://ws-feed.pro.coinbase.com", http.Header{})
+	received := false
+	lastReceivedAt := time.Now()
+	staleTimer := time.NewTimer(ws.heartbeatTTL)
+	defer staleTimer.Stop()
+	for {
+		select {
+		case <-ws.ctx.Done():
+			// Parent context wants us to shut down
+			return received
+		case msgIn := <-ws.inChan:
+			// Some other process is trying to write a message to the websocket
+			if err := connection.WriteJSON(msgIn); err != nil {
+				log.WithField("err", err.Error()).Errorln("error in writing to websocket")
+			}
+		case err := <-readErr:
+			log.WithField("err", err.Error()).Errorln("Websocket connection broke")
+			return received
+		case <-staleTimer.C:
+			// Something is wrong, websocket has not been responding for a fair amount of time. We should recreate the websocket
+			timeoutsCounter.WithLabelValues(ws.uuid, ws.market).Inc()
+			ws.setState(STATE_STALE)
+			return received
+		case msg := <-messages:
+			if !received {
+				received = true
+				ws.setState(STATE_LIVE)
+			}
+			if !staleTimer.Stop() {
+				<-staleTimer.C
+			}
+			staleTimer.Reset(ws.heartbeatTTL)
+			wsLatency.WithLabelValues(ws.uuid, ws.market).Observe(msg.receivedAt.Sub(lastReceivedAt).Seconds())
+			lastReceivedAt = msg.receivedAt
+			ws.handleMessage(msg)
+		case event := <-ws.orderSnapshots:
+			ws.emit(event)
+		}
+	}
+}
+
+func (ws *CoinbaseProWebsocket) handleMessage(msg *receivedMessage) {
+	if ws.recorder != nil {
+		if err := ws.recorder.Record(msg.receivedAt, msg.message); err != nil {
+			log.WithField("err", err.Error()).Errorln("Failed to record message")
+		}
+	}
+	event, err := decodeCoinbaseMessage(msg.message, msg.receivedAt)
 	if err != nil {
-		log.WithField("err", err.Error()).Errorln("error in dialling initial connection")
+		log.WithField("err", err.Error()).Errorln("Skipped malformed message")
+		malformedMessagesCounter.WithLabelValues(ws.uuid, ws.market).Inc()
+		ws.skipSequence(productOf(msg.message))
 		return
 	}
-	ws.websocketConn = connection
-	connection.WriteJSON(ws.makeSubscriptionMessage())
-	for {
-		start := time.Now().Unix()
-		var wsType map[string]interface{}
-		err := connection.ReadJSON(&wsType)
-		if err != nil {
-			log.Errorln(err.Error())
-			ws.websocketConn = nil
+	if event == nil {
+		return
+	}
+	ws.emit(event)
+}
+
+// skipSequence consumes a sequence number of `product`, or of every product when it is not known, so
+// that consumers see a gap where a message was skipped.
+func (ws *CoinbaseProWebsocket) skipSequence(product string) {
+	if sequence, ok := ws.sequences[product]; ok {
+		atomic.AddInt64(sequence, 1)
+		return
+	}
+	for _, sequence := range ws.sequences {
+		atomic.AddInt64(sequence, 1)
+	}
+}
+
+// emit numbers `event` and writes it to the outbound queue without blocking.
+func (ws *CoinbaseProWebsocket) emit(event *Event) {
+	sequence, ok := ws.sequences[event.Product]
+	if !ok {
+		log.WithField("product", event.Product).Warningln("Received an event for a product that was not subscribed")
+		return
+	}
+	event.Sequence = atomic.AddInt64(sequence, 1)
+	if event.Type == TRADE_EVENT {
+		event.TradeSequence = atomic.AddInt64(ws.tradeSequences[event.Product], 1)
+	} else {
+		event.TradeSequence = atomic.LoadInt64(ws.tradeSequences[event.Product])
+	}
+
+	// Writes the event to an outbound queue without blocking
+	updatesCounter.WithLabelValues(ws.uuid, event.Product).Inc()
+	select {
+	case ws.outChan <- event:
+	default:
+		log.Warningln("Websocket has no consumer for outgoing messages, dropping the message.")
+		droppedPacketsCounter.WithLabelValues(ws.uuid, event.Product).Inc()
+	}
+}
+
+// emitFailed tells the consumers of every product that the websocket gave up. Unlike other
+// events these are never dropped, as nothing else would follow them.
+func (ws *CoinbaseProWebsocket) emitFailed() {
+	for _, product := range ws.products {
+		event := &Event{
+			Type:          SOURCE_FAILED_EVENT,
+			Sequence:      atomic.AddInt64(ws.sequences[product], 1),
+			TradeSequence: atomic.LoadInt64(ws.tradeSequences[product]),
+			Product:       product,
+			Time:          time.Now(),
+		}
+		select {
+		case ws.outChan <- event:
+		case <-ws.ctx.Done():
+			return
+		}
+	}
+}
+
+// SetReconnectPolicy replaces the DefaultReconnectPolicy. It must be called before `.Start()`.
+func (ws *CoinbaseProWebsocket) SetReconnectPolicy(policy ReconnectPolicy) {
+	ws.reconnectPolicy = policy
+}
+
+// SetRecorder records every raw message received by the websocket. It must be called before `.Start()`.
+func (ws *CoinbaseProWebsocket) SetRecorder(recorder *Recorder) {
+	ws.recorder = recorder
+}
+
+// RequestSnapshot asks Coinbase Pro to unsubscribe and subscribe all products again, which causes
+// fresh snapshots to be sent. The messages are queued on the websocket input channel. On the full
+// channel, level 3 snapshots are fetched from the REST API instead.
+func (ws *CoinbaseProWebsocket) RequestSnapshot() {
+	if ws.restURL != "" {
+		for _, product := range ws.products {
+			go ws.fetchOrderSnapshot(product)
+		}
+		return
+	}
+	ws.resubscribe(ws.products)
+}
+
+// RequestProductSnapshot is like RequestSnapshot, but only for a single product.
+func (ws *CoinbaseProWebsocket) RequestProductSnapshot(product string) {
+	if ws.restURL != "" {
+		go ws.fetchOrderSnapshot(product)
+		return
+	}
+	ws.resubscribe([]string{product})
+}
+
+func (ws *CoinbaseProWebsocket) resubscribe(products []string) {
+	for _, messageType := range []string{"unsubscribe", "subscribe"} {
+		select {
+		case ws.inChan <- ws.makeSubscriptionMessage(messageType, products):
+		case <-ws.ctx.Done():
 			return
 		}
-		ws.outInternalChan <- wsType
-		end := time.Now().Unix()
-		wsLatency.WithLabelValues(ws.uuid, ws.product).Observe(float64(end - start))
 	}
 }
 
@@ -178,10 +417,7 @@ func (ws *CoinbaseProWebsocket) Start() error {
 	}
 	ws.running = true
 
-	// Start websocket internal component
-	go ws.setupWebsocket()
-
-	// Start context manager
+	// Start the reconnect state machine, which owns the websocket connection
 	go ws.runLoop()
 
 	return nil
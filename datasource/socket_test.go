@@ -1,27 +1,498 @@
 package datasource
 
 import (
+	"compress/gzip"
 	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"pirosb3/real_feed/datasource/coinbasetest"
+	"pirosb3/real_feed/feed"
 	"testing"
 	"time"
 )
 
+func makeFakeServer() *coinbasetest.Server {
+	server := coinbasetest.NewServer()
+	server.SetSnapshot("ETH-USD", [][]string{{"333.2", "0.5"}}, [][]string{{"335.12", "0.5"}})
+	return server
+}
+
+// nextEvent returns the next event of `eventType`, skipping any other event.
+func nextEvent(t *testing.T, source Source, eventType string) *Event {
+	timeout := time.After(time.Second * 2)
+	for {
+		select {
+		case event := <-source.Events():
+			if event.Type == eventType {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("Timed out waiting for %s event", eventType)
+		}
+	}
+}
+
 func TestContextShutsDown(t *testing.T) {
-	outChan := make(chan (map[string]interface{}))
-	inChan := make(chan (interface{}))
+	server := makeFakeServer()
+	defer server.Close()
 
 	ctx, cancelFn := context.WithCancel(context.Background())
 	ws := NewCoinbaseProWebsocket(
-		ctx, "ETH-USD", outChan, inChan,
+		ctx, server.URL, "ETH-USD",
 	)
 	ws.Start()
-	<-outChan
-	if ws.websocketConn == nil {
-		t.Error("Websocket was supposed to exist")
+	<-ws.Events()
+	if ws.State() != STATE_LIVE {
+		t.Errorf("Websocket was supposed to be live, got %s", ws.State())
 	}
 	cancelFn()
-	time.Sleep(time.Millisecond * 20)
-	if ws.websocketConn != nil {
-		t.Error("Cancel should have cleared up websocket context")
+	if !coinbasetest.WaitFor(time.Second, func() bool { return ws.State() == STATE_CLOSED }) {
+		t.Errorf("Cancel should have closed the websocket, got %s", ws.State())
+	}
+}
+
+func TestReconnectsWhenHeartbeatsStop(t *testing.T) {
+	server := makeFakeServer()
+	defer server.Close()
+
+	ctx, cancelFn := context.WithCancel(context.Background())
+	defer cancelFn()
+	ws := NewCoinbaseProWebsocket(ctx, server.URL, "ETH-USD")
+	ws.heartbeatTTL = time.Millisecond * 300
+	ws.Start()
+	nextEvent(t, ws, SNAPSHOT_EVENT)
+	nextEvent(t, ws, HEARTBEAT_EVENT)
+
+	server.SetHeartbeats(false)
+	if !coinbasetest.WaitFor(time.Second*2, func() bool { return server.Connections() == 2 }) {
+		t.Fatalf("Expected the websocket to reconnect, got %d connections", server.Connections())
+	}
+	server.SetHeartbeats(true)
+	event := nextEvent(t, ws, SNAPSHOT_EVENT)
+	if event.Product != "ETH-USD" || len(event.Bids) != 1 {
+		t.Errorf("Expected a fresh ETH-USD snapshot after reconnecting, got %v", event)
+	}
+}
+
+func TestBackoffIsCappedAndJittered(t *testing.T) {
+	policy := ReconnectPolicy{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+		Multiplier:     2,
+		Jitter:         0.2,
+	}
+	expected := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for idx, expectedMillis := range expected {
+		backoff := policy.backoff(idx + 1)
+		lowest := expectedMillis * time.Millisecond * 8 / 10
+		highest := expectedMillis * time.Millisecond * 12 / 10
+		if backoff < lowest || backoff > highest {
+			t.Errorf("Expected attempt %d to wait between %s and %s, got %s", idx+1, lowest, highest, backoff)
+		}
+	}
+	if policy.exhausted(1000) {
+		t.Error("Expected a policy without MaxAttempts to retry forever")
+	}
+	policy.MaxAttempts = 3
+	if policy.exhausted(3) || !policy.exhausted(4) {
+		t.Error("Expected the policy to give up after 3 attempts")
+	}
+}
+
+func TestGivesUpAfterMaxAttempts(t *testing.T) {
+	server := makeFakeServer()
+	url := server.URL
+	server.Close()
+
+	ctx, cancelFn := context.WithCancel(context.Background())
+	defer cancelFn()
+	ws := NewCoinbaseProWebsocket(ctx, url, "ETH-USD", "BTC-USD")
+	ws.SetReconnectPolicy(ReconnectPolicy{
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     10 * time.Millisecond,
+		Multiplier:     2,
+		MaxAttempts:    3,
+	})
+	ws.Start()
+	failed := map[string]bool{}
+	for len(failed) < 2 {
+		event := nextEvent(t, ws, SOURCE_FAILED_EVENT)
+		failed[event.Product] = true
+	}
+	if ws.State() != STATE_FAILED {
+		t.Errorf("Expected the websocket to have failed, got %s", ws.State())
+	}
+}
+
+func TestReconnectsWhenConnectionCloses(t *testing.T) {
+	server := makeFakeServer()
+	defer server.Close()
+
+	ctx, cancelFn := context.WithCancel(context.Background())
+	defer cancelFn()
+	ws := NewCoinbaseProWebsocket(ctx, server.URL, "ETH-USD")
+	ws.heartbeatTTL = time.Millisecond * 300
+	ws.Start()
+	nextEvent(t, ws, SNAPSHOT_EVENT)
+
+	server.CloseConnections()
+	nextEvent(t, ws, SNAPSHOT_EVENT)
+	if server.Connections() != 2 {
+		t.Errorf("Expected 2 connections, got %d", server.Connections())
+	}
+}
+
+func TestMalformedMessagesAreSkipped(t *testing.T) {
+	server := makeFakeServer()
+	defer server.Close()
+	server.SetHeartbeats(false)
+
+	ctx, cancelFn := context.WithCancel(context.Background())
+	defer cancelFn()
+	ws := NewCoinbaseProWebsocket(ctx, server.URL, "ETH-USD")
+	ws.Start()
+	snapshot := nextEvent(t, ws, SNAPSHOT_EVENT)
+
+	server.SendRaw(`{"type": "l2update", "product_id": `)
+	server.SendUpdate("ETH-USD", time.Now(), [][]string{{"sell", "335.12", "0"}})
+	update := nextEvent(t, ws, UPDATE_EVENT)
+	if update.Sequence != snapshot.Sequence+2 || len(update.Asks) != 1 {
+		t.Errorf("Expected the update following the malformed message after a gap, got %v", update)
+	}
+}
+
+func TestRequestProductSnapshotResubscribes(t *testing.T) {
+	server := makeFakeServer()
+	defer server.Close()
+
+	ctx, cancelFn := context.WithCancel(context.Background())
+	defer cancelFn()
+	ws := NewCoinbaseProWebsocket(ctx, server.URL, "ETH-USD")
+	ws.Start()
+	nextEvent(t, ws, SNAPSHOT_EVENT)
+
+	ws.RequestProductSnapshot("ETH-USD")
+	nextEvent(t, ws, SNAPSHOT_EVENT)
+	var messageTypes []interface{}
+	for _, message := range server.Received() {
+		messageTypes = append(messageTypes, message["type"])
+	}
+	if len(messageTypes) != 3 || messageTypes[1] != "unsubscribe" || messageTypes[2] != "subscribe" {
+		t.Errorf("Expected subscribe, unsubscribe and subscribe, got %v", messageTypes)
+	}
+}
+
+func TestDateParsingWorks(t *testing.T) {
+	event, err := decodeCoinbaseMessage([]byte(`{
+		"type": "l2update",
+		"product_id": "ETH-USD",
+		"time": "2020-10-11T20:50:02.941691Z",
+		"changes": [["buy", "333.2", "1.5"]]
+	}`), time.Now())
+	if err != nil {
+		t.Fatalf("Expected the update to decode, got %s", err.Error())
+	}
+	expectedResult := int64(1602449402)
+	if event.Time.Unix() != expectedResult {
+		t.Errorf("Expected %d but got %d", expectedResult, event.Time.Unix())
+	}
+	if len(event.Bids) != 1 || len(event.Asks) != 0 {
+		t.Errorf("Expected a single bid, got %d bids and %d asks", len(event.Bids), len(event.Asks))
+	}
+}
+
+func TestMalformedMessagesReturnDecodeErrors(t *testing.T) {
+	messages := []string{
+		`{"type": "l2update", "product_id": `,
+		`{"product_id": "ETH-USD"}`,
+		`{"type": "snapshot", "product_id": "ETH-USD", "bids": "none", "asks": []}`,
+		`{"type": "snapshot", "product_id": "ETH-USD", "bids": [["333.2"]], "asks": []}`,
+		`{"type": "snapshot", "bids": [], "asks": []}`,
+		`{"type": "l2update", "product_id": "ETH-USD", "time": "yesterday", "changes": []}`,
+		`{"type": "l2update", "product_id": "ETH-USD", "changes": [["buy", "333.2", "1"]]}`,
+		`{"type": "l2update", "product_id": "ETH-USD", "time": "2020-10-11T20:50:02.941691Z", "changes": [["buy", 333.2, 1]]}`,
+		`{"type": "l2update", "product_id": "ETH-USD", "time": "2020-10-11T20:50:02.941691Z", "changes": [["hold", "333.2", "1"]]}`,
+		`{"type": "heartbeat", "product_id": 3}`,
+	}
+	for _, message := range messages {
+		event, err := decodeCoinbaseMessage([]byte(message), time.Now())
+		var decodeErr *DecodeError
+		if !errors.As(err, &decodeErr) || event != nil {
+			t.Errorf("Expected a decode error for %s, got %v and %v", message, event, err)
+		}
+	}
+
+	event, err := decodeCoinbaseMessage([]byte(`{"type": "subscriptions", "channels": []}`), time.Now())
+	if event != nil || err != nil {
+		t.Errorf("Expected subscriptions to be ignored, got %v and %v", event, err)
+	}
+}
+
+func TestFullChannelMessagesDecode(t *testing.T) {
+	event, err := decodeCoinbaseMessage([]byte(`{
+		"type": "match",
+		"product_id": "ETH-USD",
+		"sequence": 51,
+		"trade_id": 7,
+		"time": "2020-10-11T20:50:02.941691Z",
+		"side": "sell",
+		"maker_order_id": "maker",
+		"taker_order_id": "taker",
+		"price": "335.12",
+		"size": "0.2"
+	}`), time.Now())
+	if err != nil {
+		t.Fatalf("Expected the match to decode, got %s", err.Error())
+	}
+	order := event.Orders[0]
+	if event.Type != TRADE_EVENT || order.Type != feed.ORDER_MATCH || order.OrderID != "maker" || order.Side != feed.ASKS || order.Size != "0.2" || order.Sequence != 51 {
+		t.Errorf("Unexpected match %v", order)
+	}
+	// The resting order sold, so the taker bought
+	if trade := event.Trades[0]; trade.TradeID != 7 || trade.Side != feed.TRADE_BUY || trade.Price.String() != "335.12" {
+		t.Errorf("Unexpected trade %v", trade)
+	}
+
+	event, _ = decodeCoinbaseMessage([]byte(`{
+		"type": "open",
+		"product_id": "ETH-USD",
+		"sequence": 52,
+		"time": "2020-10-11T20:50:02.941691Z",
+		"side": "buy",
+		"order_id": "bid",
+		"price": "333.2",
+		"remaining_size": "1.5"
+	}`), time.Now())
+	if order := event.Orders[0]; order.Side != feed.BIDS || order.Size != "1.5" || order.Price != "333.2" {
+		t.Errorf("Unexpected open %v", order)
+	}
+
+	_, err = decodeCoinbaseMessage([]byte(`{"type": "done", "product_id": "ETH-USD", "time": "2020-10-11T20:50:02.941691Z", "side": "buy", "order_id": "bid"}`), time.Now())
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) {
+		t.Errorf("Expected a decode error without a sequence, got %v", err)
+	}
+}
+
+func TestMatchesAreEmittedAsTrades(t *testing.T) {
+	server := makeFakeServer()
+	defer server.Close()
+
+	ctx, cancelFn := context.WithCancel(context.Background())
+	defer cancelFn()
+	ws := NewCoinbaseProWebsocket(ctx, server.URL, "ETH-USD")
+	ws.Start()
+	snapshot := nextEvent(t, ws, SNAPSHOT_EVENT)
+	server.SendMatch("ETH-USD", 42, "buy", "333.2", "0.25")
+	event := nextEvent(t, ws, TRADE_EVENT)
+	if trade := event.Trades[0]; trade.TradeID != 42 || trade.Side != feed.TRADE_SELL || trade.Size.String() != "0.25" {
+		t.Errorf("Unexpected trade %v", trade)
+	}
+	if snapshot.TradeSequence != 0 || event.TradeSequence != 1 {
+		t.Errorf("Expected trades to be counted on their own, got %d and %d", snapshot.TradeSequence, event.TradeSequence)
+	}
+	if channels := server.Received()[0]["channels"].([]interface{}); len(channels) != 3 || channels[2] != "matches" {
+		t.Errorf("Expected a subscription to the matches channel, got %v", channels)
+	}
+}
+
+func TestFullChannelFetchesOrderSnapshots(t *testing.T) {
+	server := coinbasetest.NewServer()
+	defer server.Close()
+	server.SetOrders("ETH-USD", 50, [][]string{{"333.2", "0.5", "bid"}}, [][]string{{"335.12", "0.5", "ask-1"}, {"335.12", "1", "ask-2"}})
+
+	ctx, cancelFn := context.WithCancel(context.Background())
+	defer cancelFn()
+	ws := NewCoinbaseProFullChannelWebsocket(ctx, server.URL, server.RESTURL, "ETH-USD")
+	ws.Start()
+	event := nextEvent(t, ws, ORDER_SNAPSHOT_EVENT)
+	if event.ExchangeSequence != 50 || len(event.Orders) != 3 || event.Orders[2].OrderID != "ask-2" || event.Orders[2].Side != feed.ASKS {
+		t.Errorf("Unexpected snapshot %v", event)
+	}
+	if channels := server.Received()[0]["channels"].([]interface{}); channels[0] != "full" {
+		t.Errorf("Expected a subscription to the full channel, got %v", channels)
+	}
+
+	ws.RequestProductSnapshot("ETH-USD")
+	nextEvent(t, ws, ORDER_SNAPSHOT_EVENT)
+	if len(server.Received()) != 1 {
+		t.Errorf("Expected level 3 snapshots to be fetched without resubscribing, got %v", server.Received())
+	}
+}
+
+func TestFullChannelFetchesOrderSnapshotsAfterReconnecting(t *testing.T) {
+	server := coinbasetest.NewServer()
+	defer server.Close()
+	server.SetOrders("ETH-USD", 50, [][]string{{"333.2", "0.5", "bid"}}, [][]string{{"335.12", "0.5", "ask"}})
+
+	ctx, cancelFn := context.WithCancel(context.Background())
+	defer cancelFn()
+	ws := NewCoinbaseProFullChannelWebsocket(ctx, server.URL, server.RESTURL, "ETH-USD")
+	ws.heartbeatTTL = time.Millisecond * 300
+	ws.Start()
+	nextEvent(t, ws, ORDER_SNAPSHOT_EVENT)
+
+	// A snapshot fetched while disconnected is kept until the websocket is back
+	server.SetOrders("ETH-USD", 60, [][]string{{"333.2", "0.5", "bid"}}, nil)
+	server.SetHeartbeats(false)
+	if !coinbasetest.WaitFor(time.Second*2, func() bool { return ws.State() == STATE_RECONNECTING }) {
+		t.Fatalf("Expected the websocket to reconnect, got %s", ws.State())
+	}
+	ws.RequestProductSnapshot("ETH-USD")
+	server.SetHeartbeats(true)
+	for _, expected := range []int64{60, 60} {
+		if event := nextEvent(t, ws, ORDER_SNAPSHOT_EVENT); event.ExchangeSequence != expected {
+			t.Errorf("Expected the snapshot at sequence %d, got %d", expected, event.ExchangeSequence)
+		}
+	}
+	if server.Connections() != 2 {
+		t.Errorf("Expected 2 connections, got %d", server.Connections())
+	}
+}
+
+// fakeMultiProductSource is a MultiProductSource driven by the test.
+type fakeMultiProductSource struct {
+	events           chan *Event
+	snapshotRequests []string
+}
+
+func (fs *fakeMultiProductSource) Start() error          { return nil }
+func (fs *fakeMultiProductSource) Events() <-chan *Event { return fs.events }
+func (fs *fakeMultiProductSource) RequestSnapshot()      {}
+func (fs *fakeMultiProductSource) RequestProductSnapshot(product string) {
+	fs.snapshotRequests = append(fs.snapshotRequests, product)
+}
+
+func TestDemultiplexerRoutesEventsPerProduct(t *testing.T) {
+	ctx, cancelFn := context.WithCancel(context.Background())
+	defer cancelFn()
+	source := &fakeMultiProductSource{events: make(chan *Event, CHANNEL_BUFFER_SIZE)}
+	demux := NewDemultiplexer(ctx, source)
+	ethSource := demux.Source("ETH-USD")
+	btcSource := demux.Source("BTC-USD")
+	ethSource.Start()
+	btcSource.Start()
+
+	source.events <- &Event{Type: SNAPSHOT_EVENT, Product: "BTC-USD", Sequence: 1}
+	source.events <- &Event{Type: SNAPSHOT_EVENT, Product: "ETH-USD", Sequence: 1}
+	source.events <- &Event{Type: SNAPSHOT_EVENT, Product: "LTC-USD", Sequence: 1}
+	source.events <- &Event{Type: UPDATE_EVENT, Product: "ETH-USD", Sequence: 2}
+
+	for _, expected := range []int64{1, 2} {
+		select {
+		case event := <-ethSource.Events():
+			if event.Product != "ETH-USD" || event.Sequence != expected {
+				t.Errorf("Expected ETH-USD event %d, got %s event %d", expected, event.Product, event.Sequence)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for ETH-USD event")
+		}
+	}
+	select {
+	case event := <-btcSource.Events():
+		if event.Product != "BTC-USD" {
+			t.Errorf("Expected BTC-USD event, got %s", event.Product)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for BTC-USD event")
+	}
+
+	btcSource.RequestSnapshot()
+	if len(source.snapshotRequests) != 1 || source.snapshotRequests[0] != "BTC-USD" {
+		t.Errorf("Expected a snapshot request for BTC-USD, got %v", source.snapshotRequests)
+	}
+}
+
+func TestRecordingCanBeReplayed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recording.jsonl.gz")
+	recorder, err := NewRecorder(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	recordedAt := time.Date(2020, 10, 11, 20, 50, 0, 0, time.UTC)
+	messages := []string{
+		`{"type":"subscriptions","channels":[]}`,
+		`{"type":"snapshot","product_id":"ETH-USD","bids":[["333.2","0.5"]],"asks":[["335.12","0.5"]]}`,
+		`{"type":"l2update","product_id":"ETH-USD","time":"2020-10-11T20:50:02.941691Z","changes":[["buy","333.2","1.5"]]}`,
+		`{"type":"l2update","product_id":"ETH-USD",`,
+		`{"type":"heartbeat","product_id":"ETH-USD"}`,
+	}
+	for idx, message := range messages {
+		if err := recorder.Record(recordedAt.Add(time.Duration(idx)*time.Second), []byte(message)); err != nil {
+			t.Fatalf("Expected every frame to be recorded, got %s", err.Error())
+		}
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ctx, cancelFn := context.WithCancel(context.Background())
+	defer cancelFn()
+	replay := NewReplaySource(ctx, path, REPLAY_AS_FAST_AS_POSSIBLE)
+	if err := replay.Start(); err != nil {
+		t.Fatal(err.Error())
+	}
+	var lastTime time.Time
+	// The malformed update is replayed as a gap before the heartbeat
+	sequences := []int64{1, 2, 4}
+	for idx, expectedType := range []string{SNAPSHOT_EVENT, UPDATE_EVENT, HEARTBEAT_EVENT} {
+		select {
+		case event := <-replay.Events():
+			if event.Type != expectedType || event.Product != "ETH-USD" || event.Sequence != sequences[idx] {
+				t.Errorf("Expected %s event %d for ETH-USD, got %s event %d for %s", expectedType, sequences[idx], event.Type, event.Sequence, event.Product)
+			}
+			// Replayed events are moved onto the replay clock
+			if time.Since(event.Time) > time.Second || event.Time.Before(lastTime) {
+				t.Errorf("Expected event time to be recent and increasing, got %s", event.Time)
+			}
+			lastTime = event.Time
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for %s event", expectedType)
+		}
+	}
+}
+
+func TestReplayReadsRecordingsOfJSONMessages(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recording.jsonl.gz")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	gzipWriter := gzip.NewWriter(file)
+	gzipWriter.Write([]byte(`{"received_at":"2020-10-11T20:50:00Z","message":{"type":"heartbeat","product_id":"ETH-USD"}}` + "\n"))
+	gzipWriter.Close()
+	file.Close()
+
+	replay := NewReplaySource(context.Background(), path, REPLAY_AS_FAST_AS_POSSIBLE)
+	if err := replay.Start(); err != nil {
+		t.Fatal(err.Error())
+	}
+	select {
+	case event := <-replay.Events():
+		if event.Type != HEARTBEAT_EVENT || event.Product != "ETH-USD" {
+			t.Errorf("Expected a heartbeat for ETH-USD, got %s for %s", event.Type, event.Product)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the recorded heartbeat")
+	}
+}
+
+func TestReplayKeepsOriginalPace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recording.jsonl.gz")
+	recorder, _ := NewRecorder(path)
+	recordedAt := time.Now()
+	recorder.Record(recordedAt, []byte(`{"type":"heartbeat","product_id":"ETH-USD"}`))
+	recorder.Record(recordedAt.Add(time.Second), []byte(`{"type":"heartbeat","product_id":"ETH-USD"}`))
+	recorder.Close()
+
+	// At 10x the second heartbeat is due after 100ms
+	replay := NewReplaySource(context.Background(), path, 10)
+	replay.Start()
+	start := time.Now()
+	<-replay.Events()
+	<-replay.Events()
+	if elapsed := time.Since(start); elapsed < time.Millisecond*80 || elapsed > time.Millisecond*500 {
+		t.Errorf("Expected replay to take about 100ms, took %s", elapsed)
 	}
 }
@@ -0,0 +1,52 @@
+package datasource
+
+import (
+	"pirosb3/real_feed/feed"
+	"time"
+)
+
+const (
+	SNAPSHOT_EVENT  = "snapshot"
+	UPDATE_EVENT    = "update"
+	HEARTBEAT_EVENT = "heartbeat"
+	// ORDER_SNAPSHOT_EVENT and ORDER_EVENT carry the orders of a level 3 book, see NewCoinbaseProFullChannelWebsocket
+	ORDER_SNAPSHOT_EVENT = "orderSnapshot"
+	ORDER_EVENT          = "order"
+	// TRADE_EVENT carries a trade of the matches channel. On the full channel it also carries the
+	// update of the resting order that traded
+	TRADE_EVENT = "trade"
+	// SOURCE_FAILED_EVENT is the last event of a source that gave up, no further events will follow
+	SOURCE_FAILED_EVENT = "sourceFailed"
+
+	CHANNEL_BUFFER_SIZE = 20
+)
+
+// Event is a venue-independent message emitted by a Source.
+// Sequence numbers are contiguous and assigned before an event can be dropped, so a consumer
+// that sees a gap in the sequence knows that its view of the feed is incomplete.
+// Time is the exchange time of the event when the venue provides one, otherwise the time it was received.
+// TradeSequence counts the TRADE_EVENTs of the product up to and including the event, so a consumer
+// can tell a gap made up of dropped trades only from one that dropped updates of the book.
+// Level 3 events carry Orders instead of Bids and Asks, a single one for ORDER_EVENT. ExchangeSequence
+// is the venue's own sequence number of an ORDER_SNAPSHOT_EVENT, each order update carries its own.
+type Event struct {
+	Type             string
+	Sequence         int64
+	TradeSequence    int64
+	Product          string
+	Time             time.Time
+	Bids             []*feed.Update
+	Asks             []*feed.Update
+	Orders           []*feed.OrderUpdate
+	Trades           []*feed.Trade
+	ExchangeSequence int64
+}
+
+// Source is a stream of orderbook events for a single product. Implementations start emitting
+// once `Start()` is called and are shut down by cancelling the context they were created with.
+type Source interface {
+	Start() error
+	Events() <-chan *Event
+	// RequestSnapshot asks the source to emit a fresh snapshot, used to recover after a gap.
+	RequestSnapshot()
+}
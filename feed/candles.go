@@ -0,0 +1,177 @@
+package feed
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// candleSeries is the candles of a single interval, the one being built and those already closed.
+type candleSeries struct {
+	interval time.Duration
+	current  *Candle
+	closed   []*Candle
+}
+
+// CandleAggregator builds candles of several intervals out of trades and samples of the book mid.
+// Candles are aligned on multiples of their interval since the Unix epoch, and close once a trade,
+// a sample or `Advance` reaches the end of their interval. At most `maxCandles` closed candles are
+// kept per interval.
+type CandleAggregator struct {
+	ProductID  string
+	series     []*candleSeries
+	maxCandles int
+	updateLock *sync.RWMutex
+}
+
+// NewCandleAggregator creates an aggregator of candles for each of `intervals`.
+func NewCandleAggregator(productID string, intervals []time.Duration, maxCandles int) *CandleAggregator {
+	series := make([]*candleSeries, len(intervals))
+	for idx, interval := range intervals {
+		series[idx] = &candleSeries{interval: interval}
+	}
+	return &CandleAggregator{
+		ProductID:  productID,
+		series:     series,
+		maxCandles: maxCandles,
+		updateLock: &sync.RWMutex{},
+	}
+}
+
+// advance closes the current candle, and the flat candles of the intervals without any data, until
+// the candle containing `now` is current. Returns the candles closed, oldest first.
+func (cs *candleSeries) advance(now time.Time, maxCandles int) []*Candle {
+	if cs.current == nil {
+		return nil
+	}
+	var closed []*Candle
+	for !now.Before(cs.current.Start.Add(cs.interval)) {
+		previous := cs.current
+		closed = append(closed, previous)
+		next := &Candle{
+			Interval: cs.interval,
+			Start:    previous.Start.Add(cs.interval),
+			Open:     previous.Close,
+			High:     previous.Close,
+			Low:      previous.Close,
+			Close:    previous.Close,
+			MidOpen:  previous.MidClose,
+			MidHigh:  previous.MidClose,
+			MidLow:   previous.MidClose,
+			MidClose: previous.MidClose,
+		}
+		// After a long quiet spell, only the flat candles that can be kept are built
+		if gaps := int64(now.Sub(next.Start) / cs.interval); gaps > int64(maxCandles) {
+			next.Start = next.Start.Add(time.Duration(gaps-int64(maxCandles)) * cs.interval)
+		}
+		cs.current = next
+	}
+	cs.closed = append(cs.closed, closed...)
+	if len(cs.closed) > maxCandles {
+		cs.closed = cs.closed[len(cs.closed)-maxCandles:]
+	}
+	return closed
+}
+
+// candleAt returns the current candle if it contains `at`, starting the first candle if needed.
+// Data older than the current candle returns nil, the candle it belonged to was already closed.
+func (cs *candleSeries) candleAt(at time.Time) *Candle {
+	if cs.current == nil {
+		cs.current = &Candle{Interval: cs.interval, Start: at.Truncate(cs.interval)}
+	}
+	if at.Before(cs.current.Start) {
+		return nil
+	}
+	return cs.current
+}
+
+// AddTrade adds `trade` to the current candle of every interval. A trade older than the current
+// candle of an interval only misses that interval, whose candle already closed. Returns the candles
+// closed by the time of the trade, oldest first.
+func (ca *CandleAggregator) AddTrade(trade *Trade) []*Candle {
+	ca.updateLock.Lock()
+	defer ca.updateLock.Unlock()
+
+	var closed []*Candle
+	for _, series := range ca.series {
+		closed = append(closed, series.advance(trade.Time, ca.maxCandles)...)
+		candle := series.candleAt(trade.Time)
+		if candle == nil {
+			continue
+		}
+		if candle.Trades == 0 {
+			candle.Open, candle.High, candle.Low = trade.Price, trade.Price, trade.Price
+		}
+		candle.High = decimal.Max(candle.High, trade.Price)
+		candle.Low = decimal.Min(candle.Low, trade.Price)
+		candle.Close = trade.Price
+		candle.Volume = candle.Volume.Add(trade.Size)
+		candle.Notional = candle.Notional.Add(trade.Size.Mul(trade.Price))
+		candle.Trades++
+	}
+	return closed
+}
+
+// AddMid samples the book `mid` at time `at`. Returns the candles closed by then, oldest first.
+func (ca *CandleAggregator) AddMid(at time.Time, mid decimal.Decimal) []*Candle {
+	ca.updateLock.Lock()
+	defer ca.updateLock.Unlock()
+
+	var closed []*Candle
+	for _, series := range ca.series {
+		closed = append(closed, series.advance(at, ca.maxCandles)...)
+		candle := series.candleAt(at)
+		if candle == nil {
+			continue
+		}
+		if candle.MidOpen.IsZero() {
+			candle.MidOpen, candle.MidHigh, candle.MidLow = mid, mid, mid
+		}
+		candle.MidHigh = decimal.Max(candle.MidHigh, mid)
+		candle.MidLow = decimal.Min(candle.MidLow, mid)
+		candle.MidClose = mid
+	}
+	return closed
+}
+
+// Advance closes the candles that ended by `now`, even if no trade or sample followed them. Returns
+// the candles closed, oldest first.
+func (ca *CandleAggregator) Advance(now time.Time) []*Candle {
+	ca.updateLock.Lock()
+	defer ca.updateLock.Unlock()
+
+	var closed []*Candle
+	for _, series := range ca.series {
+		closed = append(closed, series.advance(now, ca.maxCandles)...)
+	}
+	return closed
+}
+
+// Candles returns up to `limit` closed candles of `interval`, oldest first, or every candle kept if
+// limit is 0. With `includeOpen`, the candle being built is added last.
+func (ca *CandleAggregator) Candles(interval time.Duration, limit int, includeOpen bool) ([]*Candle, error) {
+	ca.updateLock.RLock()
+	defer ca.updateLock.RUnlock()
+
+	if limit < 0 {
+		return nil, ErrInvalidDepth
+	}
+	for _, series := range ca.series {
+		if series.interval != interval {
+			continue
+		}
+		closed := series.closed
+		if limit > 0 && limit < len(closed) {
+			closed = closed[len(closed)-limit:]
+		}
+		candles := append([]*Candle{}, closed...)
+		if includeOpen && series.current != nil {
+			current := *series.current
+			candles = append(candles, &current)
+		}
+		return candles, nil
+	}
+	return nil, fmt.Errorf("%w: no candles of %s", ErrInvalidWindow, interval)
+}
@@ -0,0 +1,246 @@
+package feed
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/shopspring/decimal"
+)
+
+// LevelSource is the size a single venue rests at a price of a consolidated book.
+type LevelSource struct {
+	Venue string
+	Size  decimal.Decimal
+}
+
+// ConsolidatedLevel is a price level of a consolidated book. Size is the total of Sources, which
+// are sorted by venue. Crossed is set when the price crosses the best price of the other side, a bid
+// at or above the best ask or an ask at or below the best bid, which happens when the venues disagree.
+type ConsolidatedLevel struct {
+	Price   decimal.Decimal
+	Size    decimal.Decimal
+	Sources []*LevelSource
+	Crossed bool
+}
+
+// ConsolidatedDepth is a view of the price levels of a consolidated book, best price first.
+// Mid is zero if either side of the book is empty. Crossed is set when the best bid of a venue is at
+// or above the best ask of another, the crossing levels are flagged and the mid is still the average
+// of the best bid and ask.
+type ConsolidatedDepth struct {
+	Bids, Asks []*ConsolidatedLevel
+	Mid        decimal.Decimal
+	Crossed    bool
+}
+
+// VenueStatus tells whether a venue's book is part of a consolidated book. Err is nil when it is,
+// otherwise the reason it was left out, for example ErrStaleBook.
+type VenueStatus struct {
+	Venue       string
+	LastUpdated int64
+	Err         error
+}
+
+// ConsolidatedOrderbook merges the books several venues keep for the same product into a single
+// view. Each venue is checked on its own, a venue without a snapshot or with a stale book is left
+// out of the view instead of failing every query, which only fail once no venue is valid.
+//
+// The merged view is kept until a venue's book changes, or a venue joins or leaves the view, so
+// queries between two updates share the same view.
+type ConsolidatedOrderbook struct {
+	ProductID string
+	venues    []string
+	books     map[string]*OrderbookFeed
+	viewLock  *sync.Mutex
+	cached    *consolidatedView
+}
+
+// venueVersion is the version of a venue's book a view was built from, and whether it was included.
+type venueVersion struct {
+	version uint64
+	valid   bool
+}
+
+// consolidatedView is a copy of the valid venues' books merged into one, along with the venues
+// resting at each price. lastEpochSeen of the merged book is the most recent of those venues.
+// Views are never modified once built.
+type consolidatedView struct {
+	book     *OrderbookFeed
+	sources  map[string]map[string][]*LevelSource
+	versions []venueVersion
+	crossed  bool
+	err      error
+}
+
+// NewConsolidatedOrderbook creates a consolidated book for `productID` over `books`, keyed by venue.
+// The books keep being updated by their own feeds, queries see their current state.
+func NewConsolidatedOrderbook(productID string, books map[string]*OrderbookFeed) *ConsolidatedOrderbook {
+	venues := make([]string, 0, len(books))
+	for venue := range books {
+		venues = append(venues, venue)
+	}
+	sort.Strings(venues)
+	return &ConsolidatedOrderbook{
+		ProductID: productID,
+		venues:    venues,
+		books:     books,
+		viewLock:  &sync.Mutex{},
+	}
+}
+
+// mergeSide adds the levels of `side` to `merged`, keyed by price.
+func mergeSide(venue string, side *bookSide, merged map[string]*ConsolidatedLevel) {
+	side.ascend(func(level *priceLevel) bool {
+		key := level.Price.String()
+		consolidated, ok := merged[key]
+		if !ok {
+			consolidated = &ConsolidatedLevel{Price: level.Price}
+			merged[key] = consolidated
+		}
+		consolidated.Size = consolidated.Size.Add(level.Size)
+		consolidated.Sources = append(consolidated.Sources, &LevelSource{Venue: venue, Size: level.Size})
+		return true
+	})
+}
+
+// versions returns the version of every venue's book and whether it can be quoted, along with the
+// status of every venue.
+func (co *ConsolidatedOrderbook) versions() ([]venueVersion, []*VenueStatus) {
+	versions := make([]venueVersion, len(co.venues))
+	statuses := make([]*VenueStatus, len(co.venues))
+	for idx, venue := range co.venues {
+		book := co.books[venue]
+		book.updateLock.RLock()
+		err := book.checkValid()
+		versions[idx] = venueVersion{version: book.version, valid: err == nil}
+		statuses[idx] = &VenueStatus{Venue: venue, LastUpdated: book.lastEpochSeen, Err: err}
+		book.updateLock.RUnlock()
+	}
+	return versions, statuses
+}
+
+func sameVersions(a, b []venueVersion) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for idx := range a {
+		if a[idx] != b[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+// view returns the merge of the venues that are currently valid, along with the status of every
+// venue. The view is only rebuilt when a venue changed since the last one. If no venue is valid, the
+// error of the first venue is returned.
+func (co *ConsolidatedOrderbook) view() (*consolidatedView, []*VenueStatus, error) {
+	co.viewLock.Lock()
+	defer co.viewLock.Unlock()
+
+	versions, statuses := co.versions()
+	if co.cached == nil || !sameVersions(co.cached.versions, versions) {
+		co.cached = co.merge()
+	}
+	return co.cached, statuses, co.cached.err
+}
+
+// merge builds a view of the venues that are currently valid.
+func (co *ConsolidatedOrderbook) merge() *consolidatedView {
+	view := &consolidatedView{
+		book:     NewOrderbookFeed(co.ProductID),
+		sources:  map[string]map[string][]*LevelSource{BIDS: {}, ASKS: {}},
+		versions: make([]venueVersion, len(co.venues)),
+	}
+	merged := map[string]map[string]*ConsolidatedLevel{BIDS: {}, ASKS: {}}
+	var firstErr error
+	for idx, venue := range co.venues {
+		book := co.books[venue]
+		book.updateLock.RLock()
+		err := book.checkValid()
+		view.versions[idx] = venueVersion{version: book.version, valid: err == nil}
+		if err == nil {
+			mergeSide(venue, book.bids, merged[BIDS])
+			mergeSide(venue, book.asks, merged[ASKS])
+			if book.lastEpochSeen > view.book.lastEpochSeen {
+				view.book.lastEpochSeen = book.lastEpochSeen
+			}
+			view.book.snapshotWasSet = true
+		} else if firstErr == nil {
+			firstErr = err
+		}
+		book.updateLock.RUnlock()
+	}
+	if !view.book.snapshotWasSet {
+		if firstErr == nil {
+			firstErr = ErrNoSnapshot
+		}
+		view.err = firstErr
+		return view
+	}
+	for side, levels := range merged {
+		for key, level := range levels {
+			view.book.selectSide(side).set(level.Price, level.Size)
+			view.sources[side][key] = level.Sources
+		}
+	}
+	bestBid, bestAsk := view.book.bids.best(), view.book.asks.best()
+	view.crossed = bestBid != nil && bestAsk != nil && bestBid.Price.GreaterThanOrEqual(bestAsk.Price)
+	return view
+}
+
+func (view *consolidatedView) tag(levels []*Level, side string) []*ConsolidatedLevel {
+	consolidated := make([]*ConsolidatedLevel, len(levels))
+	for idx, level := range levels {
+		consolidated[idx] = &ConsolidatedLevel{
+			Price:   level.Price,
+			Size:    level.Size,
+			Sources: view.sources[side][level.Price.String()],
+		}
+		if !view.crossed {
+			continue
+		}
+		if side == BIDS {
+			consolidated[idx].Crossed = level.Price.GreaterThanOrEqual(view.book.asks.best().Price)
+		} else {
+			consolidated[idx].Crossed = level.Price.LessThanOrEqual(view.book.bids.best().Price)
+		}
+	}
+	return consolidated
+}
+
+// Statuses returns whether each venue is currently part of the consolidated book, sorted by venue.
+func (co *ConsolidatedOrderbook) Statuses() []*VenueStatus {
+	_, statuses := co.versions()
+	return statuses
+}
+
+// GetDepth returns the merged levels of the valid venues, tagged with the venues resting at each
+// price. `depth` and `withinPercent` behave as for OrderbookFeed.GetDepth.
+func (co *ConsolidatedOrderbook) GetDepth(depth int, withinPercent decimal.Decimal) (*ConsolidatedDepth, []*VenueStatus, int64, error) {
+	view, statuses, err := co.view()
+	if err != nil {
+		return nil, statuses, view.book.lastEpochSeen, err
+	}
+	orderbookDepth, lastUpdated, err := view.book.GetDepth(depth, withinPercent)
+	if err != nil {
+		return nil, statuses, lastUpdated, err
+	}
+	return &ConsolidatedDepth{
+		Bids:    view.tag(orderbookDepth.Bids, BIDS),
+		Asks:    view.tag(orderbookDepth.Asks, ASKS),
+		Mid:     orderbookDepth.Mid,
+		Crossed: view.crossed,
+	}, statuses, lastUpdated, nil
+}
+
+// Quote simulates one of the four market operations against the merged levels of the valid venues,
+// as if they were a single book, along with the status of every venue.
+func (co *ConsolidatedOrderbook) Quote(operation string, amount decimal.Decimal) (*Quote, []*VenueStatus, int64, error) {
+	view, statuses, err := co.view()
+	if err != nil {
+		return nil, statuses, view.book.lastEpochSeen, err
+	}
+	quote, lastUpdated, err := view.book.Quote(operation, amount)
+	return quote, statuses, lastUpdated, err
+}
@@ -1,13 +1,13 @@
 package feed
 
 import (
-	"errors"
+	"fmt"
 	"sort"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/shopspring/decimal"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -16,18 +16,31 @@ const (
 	INSUFFICIENT_LIQUIDITY = "INSUFFICIENT_LIQUIDITY"
 	BIDS                   = "BIDS"
 	ASKS                   = "ASKS"
+
+	BUY_BASE   = "BUY_BASE"
+	SELL_BASE  = "SELL_BASE"
+	BUY_QUOTE  = "BUY_QUOTE"
+	SELL_QUOTE = "SELL_QUOTE"
+
+	// DIVISION_PRECISION is the number of decimal places kept when converting a
+	// quote amount into a base amount, the only operation that cannot be exact.
+	DIVISION_PRECISION = 16
+	SLIPPAGE_PRECISION = 4
 )
 
+var invalidAmount = decimal.NewFromInt(-1)
+
 // OrderbookFeed is the primary struct responsible for storage and access of the bids and asks.
 // Use this class alongside a websocket feed to keep an up-to-date orderbook, or  you can also
 // use this class for one-off orderbook queries.
 type OrderbookFeed struct {
-	ProductID                string
-	bids, asks               sortByOrderbookPrice
-	bidsSizeMap, asksSizeMap map[string]float64
-	lastEpochSeen            int64
-	updateLock               *sync.RWMutex
-	snapshotWasSet           bool
+	ProductID      string
+	bids, asks     *bookSide
+	lastEpochSeen  int64
+	updateLock     *sync.RWMutex
+	snapshotWasSet bool
+	// version changes every time the book is written to or invalidated
+	version uint64
 }
 
 // GetProduct returns the base and quote assets.
@@ -41,211 +54,578 @@ func (of *OrderbookFeed) GetProduct() (string, string) {
 
 // BuyQuote simulates a market buy of a certain amount. For example, in a
 // BTC-USD book, BuyQuote(usdAmount) will return btcToSell.
-func (of *OrderbookFeed) BuyQuote(amount float64) (float64, int64, error) {
-	return of.performMarketOperationOnQuote(amount, of.bids, of.bidsSizeMap)
+func (of *OrderbookFeed) BuyQuote(amount decimal.Decimal) (decimal.Decimal, int64, error) {
+	return of.quoteAmount(BUY_QUOTE, amount)
 }
 
 // SellQuote simulates a market sell of a certain amount. For example, in a
 // BTC-USD book, SellQuote(usdAmount) will return btcToBuy.
-func (of *OrderbookFeed) SellQuote(amount float64) (float64, int64, error) {
-	return of.performMarketOperationOnQuote(amount, of.asks, of.asksSizeMap)
+func (of *OrderbookFeed) SellQuote(amount decimal.Decimal) (decimal.Decimal, int64, error) {
+	return of.quoteAmount(SELL_QUOTE, amount)
 }
 
-// CleanUpOrderbook performs housekeeping on the books, by merging and removing
-// orders that have no size.
-func (of *OrderbookFeed) CleanUpOrderbook() {
-	of.updateLock.Lock()
-	defer of.updateLock.Unlock()
+func (of *OrderbookFeed) selectSide(side string) *bookSide {
+	if side == BIDS {
+		return of.bids
+	} else if side == ASKS {
+		return of.asks
+	}
+	panic("Unsupported side: " + side)
+}
 
-	// Process bids
-	var newBids, newAsks []*orderbookSortedKey
-	for _, bid := range of.bids {
-		bidSize := of.bidsSizeMap[bid.Key]
-		if bidSize > 0 {
-			newBids = append(newBids, bid)
-		}
+func (of *OrderbookFeed) checkValid() error {
+	if !of.snapshotWasSet {
+		return ErrNoSnapshot
+	}
+	if (time.Now().Unix() - of.lastEpochSeen) > TIMEOUT_STALE_BOOK {
+		return ErrStaleBook
+	}
+	return nil
+}
+
+func (of *OrderbookFeed) checkQuoteable(amount decimal.Decimal) error {
+	if err := of.checkValid(); err != nil {
+		return err
+	}
+	if amount.Sign() <= 0 {
+		return ErrInvalidAmount
 	}
-	for _, ask := range of.asks {
-		askSize := of.asksSizeMap[ask.Key]
-		if askSize > 0 {
-			newAsks = append(newAsks, ask)
+	return nil
+}
+
+// GetTopOfBook returns the best bid and ask, along with the mid price and spread.
+func (of *OrderbookFeed) GetTopOfBook() (*TopOfBook, int64, error) {
+	of.updateLock.RLock()
+	defer of.updateLock.RUnlock()
+	topOfBook, err := of.topOfBook()
+	return topOfBook, of.lastEpochSeen, err
+}
+
+// GetTopOfBookWithQuotes returns the top of the book along with the results of `requests`, all read
+// from the same version of the book under a single read lock. Requests are not priced when the top
+// of the book cannot be read.
+func (of *OrderbookFeed) GetTopOfBookWithQuotes(requests []*QuoteRequest) (*TopOfBook, []*QuoteResult, int64, error) {
+	of.updateLock.RLock()
+	defer of.updateLock.RUnlock()
+	topOfBook, err := of.topOfBook()
+	if err != nil {
+		return nil, nil, of.lastEpochSeen, err
+	}
+	return topOfBook, of.batchQuote(requests), of.lastEpochSeen, nil
+}
+
+// topOfBook reads the best bid and ask, the caller must hold the read lock.
+func (of *OrderbookFeed) topOfBook() (*TopOfBook, error) {
+	if err := of.checkValid(); err != nil {
+		return nil, err
+	}
+	mid, ok := of.mid()
+	if !ok {
+		return nil, &InsufficientLiquidityError{MaxFillable: decimal.Zero}
+	}
+	bestBid := of.bids.best()
+	bestAsk := of.asks.best()
+	return &TopOfBook{
+		BidPrice: bestBid.Price,
+		BidSize:  bestBid.Size,
+		AskPrice: bestAsk.Price,
+		AskSize:  bestAsk.Size,
+		Mid:      mid,
+		Spread:   bestAsk.Price.Sub(bestBid.Price),
+	}, nil
+}
+
+func (of *OrderbookFeed) mid() (decimal.Decimal, bool) {
+	bestBid := of.bids.best()
+	bestAsk := of.asks.best()
+	if bestBid == nil || bestAsk == nil {
+		return decimal.Zero, false
+	}
+	return bestBid.Price.Add(bestAsk.Price).Div(decimal.NewFromInt(2)), true
+}
+
+func collectLevels(side *bookSide, depth int, inRange func(price decimal.Decimal) bool) []*Level {
+	var levels []*Level
+	side.ascend(func(level *priceLevel) bool {
+		if depth > 0 && len(levels) >= depth {
+			return false
+		}
+		if !inRange(level.Price) {
+			return false
 		}
+		levels = append(levels, &Level{Price: level.Price, Size: level.Size})
+		return true
+	})
+	return levels
+}
+
+// GetLevelsCovering returns the best levels of `side`, BIDS or ASKS, until their sizes add up to at
+// least `size`, or the whole side if it holds less. These are all the levels a market operation of
+// `size` could consume.
+func (of *OrderbookFeed) GetLevelsCovering(side string, size decimal.Decimal) ([]*Level, int64, error) {
+	of.updateLock.RLock()
+	defer of.updateLock.RUnlock()
+
+	if err := of.checkValid(); err != nil {
+		return nil, of.lastEpochSeen, err
+	}
+	if side != BIDS && side != ASKS {
+		return nil, of.lastEpochSeen, fmt.Errorf("%w: %s", ErrUnsupportedOperation, side)
 	}
-	of.bids = newBids
-	of.asks = newAsks
+	var levels []*Level
+	covered := decimal.Zero
+	of.selectSide(side).ascend(func(level *priceLevel) bool {
+		levels = append(levels, &Level{Price: level.Price, Size: level.Size})
+		covered = covered.Add(level.Size)
+		return covered.LessThan(size)
+	})
+	return levels, of.lastEpochSeen, nil
 }
 
-func (of *OrderbookFeed) performMarketOperationOnQuote(amount float64, book sortByOrderbookPrice, sizeMap map[string]float64) (float64, int64, error) {
-	if !of.snapshotWasSet {
-		return -1, of.lastEpochSeen, errors.New("A snapshot was never set, therefore the orderbook is inaccurate")
+// GetDepth returns up to `depth` price levels per side, best price first, or every level if depth is 0.
+// If `withinPercent` is positive, only levels priced within that percentage of the mid are returned.
+func (of *OrderbookFeed) GetDepth(depth int, withinPercent decimal.Decimal) (*OrderbookDepth, int64, error) {
+	of.updateLock.RLock()
+	defer of.updateLock.RUnlock()
+
+	if err := of.checkValid(); err != nil {
+		return nil, of.lastEpochSeen, err
 	}
-	if (time.Now().Unix() - of.lastEpochSeen) > TIMEOUT_STALE_BOOK {
-		return -1, of.lastEpochSeen, errors.New("Orderbook is stale")
+	if depth < 0 || withinPercent.Sign() < 0 {
+		return nil, of.lastEpochSeen, ErrInvalidDepth
 	}
-	if amount <= 0 {
-		return -1, of.lastEpochSeen, errors.New("Amount invalid")
+	mid, hasMid := of.mid()
+	if withinPercent.Sign() > 0 && !hasMid {
+		return nil, of.lastEpochSeen, &InsufficientLiquidityError{MaxFillable: decimal.Zero}
 	}
 
-	remaining := amount
-	baseAmountToPay := 0.0
-	for _, orderSet := range book {
+	bidsInRange := func(price decimal.Decimal) bool { return true }
+	asksInRange := bidsInRange
+	if withinPercent.Sign() > 0 {
+		distance := mid.Mul(withinPercent).Div(decimal.NewFromInt(100))
+		lowest, highest := mid.Sub(distance), mid.Add(distance)
+		bidsInRange = func(price decimal.Decimal) bool { return price.GreaterThanOrEqual(lowest) }
+		asksInRange = func(price decimal.Decimal) bool { return price.LessThanOrEqual(highest) }
+	}
+	return &OrderbookDepth{
+		Bids: collectLevels(of.bids, depth, bidsInRange),
+		Asks: collectLevels(of.asks, depth, asksInRange),
+		Mid:  mid,
+	}, of.lastEpochSeen, nil
+}
+
+// GetLiquidityCurve returns how much of each side of the book can be executed within each of
+// `distancesBps` from mid, for example 10, 25, 50 and 100. Points are sorted by distance.
+func (of *OrderbookFeed) GetLiquidityCurve(distancesBps []decimal.Decimal) (*LiquidityCurve, int64, error) {
+	of.updateLock.RLock()
+	defer of.updateLock.RUnlock()
+
+	if err := of.checkValid(); err != nil {
+		return nil, of.lastEpochSeen, err
+	}
+	sortedDistances := make([]decimal.Decimal, len(distancesBps))
+	copy(sortedDistances, distancesBps)
+	sort.Slice(sortedDistances, func(i, j int) bool { return sortedDistances[i].LessThan(sortedDistances[j]) })
+	if len(sortedDistances) > 0 && sortedDistances[0].Sign() < 0 {
+		return nil, of.lastEpochSeen, ErrInvalidDepth
+	}
+	mid, ok := of.mid()
+	if !ok {
+		return nil, of.lastEpochSeen, &InsufficientLiquidityError{MaxFillable: decimal.Zero}
+	}
+	return &LiquidityCurve{
+		Mid:  mid,
+		Bids: of.liquidityCurve(BIDS, mid, sortedDistances),
+		Asks: of.liquidityCurve(ASKS, mid, sortedDistances),
+	}, of.lastEpochSeen, nil
+}
+
+// liquidityCurve walks a side of the book once, best price first, closing a point every time
+// the walk goes past the next distance.
+func (of *OrderbookFeed) liquidityCurve(side string, mid decimal.Decimal, sortedDistances []decimal.Decimal) []*LiquidityPoint {
+	points := make([]*LiquidityPoint, len(sortedDistances))
+	limits := make([]decimal.Decimal, len(sortedDistances))
+	for idx, distance := range sortedDistances {
+		offset := mid.Mul(distance).Div(decimal.NewFromInt(10000))
+		if side == BIDS {
+			limits[idx] = mid.Sub(offset)
+		} else {
+			limits[idx] = mid.Add(offset)
+		}
+	}
+	withinLimit := func(price, limit decimal.Decimal) bool {
+		if side == BIDS {
+			return price.GreaterThanOrEqual(limit)
+		}
+		return price.LessThanOrEqual(limit)
+	}
 
-		if remaining <= 0 {
-			break
+	size := decimal.Zero
+	notional := decimal.Zero
+	next := 0
+	closePoint := func() {
+		point := &LiquidityPoint{
+			DistanceBps: sortedDistances[next],
+			LimitPrice:  limits[next],
+			Size:        size,
+			Notional:    notional,
+		}
+		if size.Sign() > 0 {
+			point.AveragePrice = notional.DivRound(size, DIVISION_PRECISION)
+		}
+		points[next] = point
+		next++
+	}
+	of.selectSide(side).ascend(func(level *priceLevel) bool {
+		for next < len(sortedDistances) && !withinLimit(level.Price, limits[next]) {
+			closePoint()
 		}
+		if next == len(sortedDistances) {
+			return false
+		}
+		size = size.Add(level.Size)
+		notional = notional.Add(level.Size.Mul(level.Price))
+		return true
+	})
+	for next < len(sortedDistances) {
+		closePoint()
+	}
+	return points
+}
 
-		of.updateLock.RLock()
-		size, ok := sizeMap[orderSet.Key]
-		of.updateLock.RUnlock()
-		if !ok {
-			log.WithField("key", orderSet.Key).Errorln("Key cannot be found in lookup table.")
-			continue
+// GetMaxFillableAtPrice returns how much base can be bought without paying more than `limitPrice`,
+// and how much can be sold without receiving less than `limitPrice`, on any single fill.
+func (of *OrderbookFeed) GetMaxFillableAtPrice(limitPrice decimal.Decimal) (*MaxFillable, int64, error) {
+	of.updateLock.RLock()
+	defer of.updateLock.RUnlock()
+
+	if err := of.checkValid(); err != nil {
+		return nil, of.lastEpochSeen, err
+	}
+	if limitPrice.Sign() <= 0 {
+		return nil, of.lastEpochSeen, ErrInvalidAmount
+	}
+	return &MaxFillable{
+		Buy: of.walkFillable(ASKS, func(level *priceLevel, size, notional decimal.Decimal) decimal.Decimal {
+			if level.Price.GreaterThan(limitPrice) {
+				return decimal.Zero
+			}
+			return level.Size
+		}),
+		Sell: of.walkFillable(BIDS, func(level *priceLevel, size, notional decimal.Decimal) decimal.Decimal {
+			if level.Price.LessThan(limitPrice) {
+				return decimal.Zero
+			}
+			return level.Size
+		}),
+	}, of.lastEpochSeen, nil
+}
+
+// GetMaxFillableWithinSlippage returns how much base can be bought and sold while keeping the slippage
+// of the whole execution, its VWAP measured from mid as in Quote.SlippageBps, within `maxSlippageBps`.
+// The last level is usually taken partially, at the size that brings the VWAP exactly to the limit.
+func (of *OrderbookFeed) GetMaxFillableWithinSlippage(maxSlippageBps decimal.Decimal) (*MaxFillable, int64, error) {
+	of.updateLock.RLock()
+	defer of.updateLock.RUnlock()
+
+	if err := of.checkValid(); err != nil {
+		return nil, of.lastEpochSeen, err
+	}
+	if maxSlippageBps.Sign() < 0 {
+		return nil, of.lastEpochSeen, ErrInvalidAmount
+	}
+	mid, ok := of.mid()
+	if !ok {
+		return nil, of.lastEpochSeen, &InsufficientLiquidityError{MaxFillable: decimal.Zero}
+	}
+	offset := mid.Mul(maxSlippageBps).Div(decimal.NewFromInt(10000))
+	maxBuyVWAP := mid.Add(offset)
+	minSellVWAP := mid.Sub(offset)
+
+	// A level past the limit can be taken until the VWAP reaches the limit, that is x in
+	// (notional + x * price) / (size + x) = limit
+	partialSize := func(level *priceLevel, numerator, denominator decimal.Decimal) decimal.Decimal {
+		taken := numerator.DivRound(denominator, DIVISION_PRECISION+1).Truncate(DIVISION_PRECISION)
+		if taken.Sign() < 0 {
+			return decimal.Zero
 		}
-		maxQuoteAmount := orderSet.Value * size
+		if taken.GreaterThan(level.Size) {
+			return level.Size
+		}
+		return taken
+	}
+	return &MaxFillable{
+		Buy: of.walkFillable(ASKS, func(level *priceLevel, size, notional decimal.Decimal) decimal.Decimal {
+			if level.Price.LessThanOrEqual(maxBuyVWAP) {
+				return level.Size
+			}
+			return partialSize(level, maxBuyVWAP.Mul(size).Sub(notional), level.Price.Sub(maxBuyVWAP))
+		}),
+		Sell: of.walkFillable(BIDS, func(level *priceLevel, size, notional decimal.Decimal) decimal.Decimal {
+			if level.Price.GreaterThanOrEqual(minSellVWAP) {
+				return level.Size
+			}
+			return partialSize(level, notional.Sub(minSellVWAP.Mul(size)), minSellVWAP.Sub(level.Price))
+		}),
+	}, of.lastEpochSeen, nil
+}
+
+// walkFillable walks a side of the book best price first, taking from each level the size returned
+// by `take` given the size and notional taken so far. The walk stops at the first partially taken level.
+func (of *OrderbookFeed) walkFillable(side string, take func(level *priceLevel, size, notional decimal.Decimal) decimal.Decimal) *Fillable {
+	fillable := &Fillable{
+		Size:     decimal.Zero,
+		Notional: decimal.Zero,
+	}
+	of.selectSide(side).ascend(func(level *priceLevel) bool {
+		taken := take(level, fillable.Size, fillable.Notional)
+		if taken.Sign() > 0 {
+			fillable.Size = fillable.Size.Add(taken)
+			fillable.Notional = fillable.Notional.Add(taken.Mul(level.Price))
+			fillable.WorstPrice = level.Price
+		}
+		return taken.Equal(level.Size)
+	})
+	if fillable.Size.Sign() > 0 {
+		fillable.AveragePrice = fillable.Notional.DivRound(fillable.Size, DIVISION_PRECISION)
+	}
+	return fillable
+}
+
+func (of *OrderbookFeed) performMarketOperationOnQuote(amount decimal.Decimal, side string) (*Quote, error) {
+	remaining := amount
+	baseAmountToPay := decimal.Zero
+	var fills []*Fill
+	of.selectSide(side).ascend(func(level *priceLevel) bool {
+		maxQuoteAmount := level.Price.Mul(level.Size)
 		amountToPurchase := maxQuoteAmount
-		if amountToPurchase > remaining {
+		if amountToPurchase.GreaterThan(remaining) {
 			amountToPurchase = remaining
 		}
 
-		// Perform the transaction
-		remaining -= amountToPurchase
-		baseAmountToPay += amountToPurchase / orderSet.Value
-	}
-	if remaining == 0 {
-		return baseAmountToPay, of.lastEpochSeen, nil
+		// Perform the transaction. Consuming a full level is exact, only partial
+		// levels need to be divided back into base.
+		remaining = remaining.Sub(amountToPurchase)
+		baseAmount := level.Size
+		if !amountToPurchase.Equal(maxQuoteAmount) {
+			baseAmount = amountToPurchase.DivRound(level.Price, DIVISION_PRECISION)
+		}
+		baseAmountToPay = baseAmountToPay.Add(baseAmount)
+		fills = append(fills, &Fill{Price: level.Price, Size: baseAmount})
+		return remaining.Sign() > 0
+	})
+	if remaining.IsZero() {
+		return of.makeQuote(baseAmountToPay, baseAmountToPay, amount, fills, side), nil
 	}
 
-	return -1, of.lastEpochSeen, errors.New(INSUFFICIENT_LIQUIDITY)
+	return nil, &InsufficientLiquidityError{Side: side, MaxFillable: amount.Sub(remaining)}
 }
 
 // BuyBase simulates a market buy of a certain amount. For example, in a
 // BTC-USD book, BuyBase(btcToBuy) will return usdSold.
-func (of *OrderbookFeed) BuyBase(amount float64) (float64, int64, error) {
-	return of.performMarketOperationOnBase(amount, of.asks, of.asksSizeMap)
+func (of *OrderbookFeed) BuyBase(amount decimal.Decimal) (decimal.Decimal, int64, error) {
+	return of.quoteAmount(BUY_BASE, amount)
 }
 
 // SellBase simulates a market buy of a certain amount. For example, in a
 // BTC-USD book, SellBase(btcToSell) will return usdPurchased.
-func (of *OrderbookFeed) SellBase(amount float64) (float64, int64, error) {
-	return of.performMarketOperationOnBase(amount, of.bids, of.bidsSizeMap)
+func (of *OrderbookFeed) SellBase(amount decimal.Decimal) (decimal.Decimal, int64, error) {
+	return of.quoteAmount(SELL_BASE, amount)
 }
 
-func (of *OrderbookFeed) performMarketOperationOnBase(amount float64, book sortByOrderbookPrice, sizeMap map[string]float64) (float64, int64, error) {
-	if !of.snapshotWasSet {
-		return -1, of.lastEpochSeen, errors.New("A snapshot was never set, therefore the orderbook is inaccurate")
+func (of *OrderbookFeed) performMarketOperationOnBase(amount decimal.Decimal, side string) (*Quote, error) {
+	remainingAmt := amount
+	profitMade := decimal.Zero
+	var fills []*Fill
+	of.selectSide(side).ascend(func(level *priceLevel) bool {
+		amountToConsume := level.Size
+		if remainingAmt.LessThanOrEqual(amountToConsume) {
+			amountToConsume = remainingAmt
+		}
+		remainingAmt = remainingAmt.Sub(amountToConsume)
+		profitMade = profitMade.Add(amountToConsume.Mul(level.Price))
+		fills = append(fills, &Fill{Price: level.Price, Size: amountToConsume})
+		return remainingAmt.Sign() > 0
+	})
+	if remainingAmt.IsZero() {
+		return of.makeQuote(profitMade, amount, profitMade, fills, side), nil
 	}
-	if (time.Now().Unix() - of.lastEpochSeen) > TIMEOUT_STALE_BOOK {
-		return -1, of.lastEpochSeen, errors.New("Orderbook is stale")
+	return nil, &InsufficientLiquidityError{Side: side, MaxFillable: amount.Sub(remainingAmt)}
+}
+
+// makeQuote computes the execution statistics of a walk that exchanged `baseAmount` for `quoteAmount`.
+func (of *OrderbookFeed) makeQuote(amount, baseAmount, quoteAmount decimal.Decimal, fills []*Fill, side string) *Quote {
+	quote := &Quote{
+		Amount:     amount,
+		Fills:      fills,
+		VWAP:       quoteAmount.DivRound(baseAmount, DIVISION_PRECISION),
+		WorstPrice: fills[len(fills)-1].Price,
 	}
-	if amount <= 0 {
-		return -1, of.lastEpochSeen, errors.New("Amount invalid")
+	// Slippage is positive when the execution is worse than mid, for either side
+	if mid, ok := of.mid(); ok {
+		slippage := quote.VWAP.Sub(mid)
+		if side == BIDS {
+			slippage = slippage.Neg()
+		}
+		quote.SlippageBps = slippage.Mul(decimal.NewFromInt(10000)).DivRound(mid, SLIPPAGE_PRECISION)
 	}
-	remainingAmt := amount
-	profitMade := 0.0
-	for _, orderSet := range book {
+	return quote
+}
 
-		of.updateLock.RLock()
-		orderSize := sizeMap[orderSet.Key]
-		of.updateLock.RUnlock()
+// Quote simulates one of the four market operations, returning the amount along with
+// the levels consumed and the execution statistics.
+func (of *OrderbookFeed) Quote(operation string, amount decimal.Decimal) (*Quote, int64, error) {
+	of.updateLock.RLock()
+	defer of.updateLock.RUnlock()
+	quote, err := of.quote(operation, amount)
+	return quote, of.lastEpochSeen, err
+}
 
-		amountToConsume := orderSize
-		if remainingAmt <= amountToConsume {
-			amountToConsume = remainingAmt
-		}
-		remainingAmt -= amountToConsume
-		profitMade += amountToConsume * orderSet.Value
+// BatchQuote simulates several market operations against the same version of the book, under a single
+// read lock. Results are in the order of `requests`, and a failed operation does not affect the others.
+func (of *OrderbookFeed) BatchQuote(requests []*QuoteRequest) ([]*QuoteResult, int64) {
+	of.updateLock.RLock()
+	defer of.updateLock.RUnlock()
+	return of.batchQuote(requests), of.lastEpochSeen
+}
 
-		if remainingAmt < 0 {
-			return -1, of.lastEpochSeen, errors.New("Implementation error")
-		}
+// batchQuote prices every request, the caller must hold the read lock.
+func (of *OrderbookFeed) batchQuote(requests []*QuoteRequest) []*QuoteResult {
+	results := make([]*QuoteResult, len(requests))
+	for idx, request := range requests {
+		quote, err := of.quoteWithFee(request.Operation, request.Amount, request.FeeBps)
+		results[idx] = &QuoteResult{Quote: quote, Err: err}
+	}
+	return results
+}
 
-		if remainingAmt <= 0 {
-			break
-		}
+// QuoteWithFee is like Quote, but the amount returned is net of a taker fee of `feeBps`, charged in
+// quote currency on the quote amount traded:
+//   - BUY_BASE returns the quote paid including the fee, and SELL_BASE the quote received after the fee
+//   - BUY_QUOTE returns the base to sell to receive `amount` after the fee, and SELL_QUOTE the base
+//     bought when `amount` has to cover the fee as well
+func (of *OrderbookFeed) QuoteWithFee(operation string, amount, feeBps decimal.Decimal) (*Quote, int64, error) {
+	of.updateLock.RLock()
+	defer of.updateLock.RUnlock()
+	quote, err := of.quoteWithFee(operation, amount, feeBps)
+	return quote, of.lastEpochSeen, err
+}
 
+// quoteWithFee performs a market operation net of fees, the caller must hold the read lock.
+func (of *OrderbookFeed) quoteWithFee(operation string, amount, feeBps decimal.Decimal) (*Quote, error) {
+	if feeBps.Sign() < 0 || feeBps.GreaterThanOrEqual(decimal.NewFromInt(10000)) {
+		return nil, ErrInvalidAmount
 	}
-	if remainingAmt == 0 {
-		return profitMade, of.lastEpochSeen, nil
+	if feeBps.IsZero() {
+		return of.quote(operation, amount)
 	}
-	return -1, of.lastEpochSeen, errors.New(INSUFFICIENT_LIQUIDITY)
+	feeRate := feeBps.Div(decimal.NewFromInt(10000))
+	switch operation {
+	case BUY_BASE, SELL_BASE:
+		quote, err := of.quote(operation, amount)
+		if err != nil {
+			return nil, err
+		}
+		quote.Fee = quote.Amount.Mul(feeRate)
+		if operation == BUY_BASE {
+			quote.Amount = quote.Amount.Add(quote.Fee)
+		} else {
+			quote.Amount = quote.Amount.Sub(quote.Fee)
+		}
+		return quote, nil
+	case BUY_QUOTE:
+		// Sell enough base for the proceeds to still be `amount` after the fee
+		grossAmount := amount.DivRound(decimal.NewFromInt(1).Sub(feeRate), DIVISION_PRECISION)
+		quote, err := of.quote(operation, grossAmount)
+		if err != nil {
+			return nil, err
+		}
+		quote.Fee = grossAmount.Sub(amount)
+		return quote, nil
+	case SELL_QUOTE:
+		// The fee is taken out of `amount`, the rest buys base
+		grossAmount := amount.DivRound(decimal.NewFromInt(1).Add(feeRate), DIVISION_PRECISION)
+		quote, err := of.quote(operation, grossAmount)
+		if err != nil {
+			return nil, err
+		}
+		quote.Fee = amount.Sub(grossAmount)
+		return quote, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedOperation, operation)
 }
 
-func (of *OrderbookFeed) writeUpdate(updates []*Update, side string) bool {
-	var selectedBookPtr *sortByOrderbookPrice
-	var selectedMap map[string]float64
-	if side == BIDS {
-		selectedBookPtr = &of.bids
-		selectedMap = of.bidsSizeMap
-	} else if side == ASKS {
-		selectedBookPtr = &of.asks
-		selectedMap = of.asksSizeMap
-	} else {
-		panic("Unsupported side: " + side)
+func (of *OrderbookFeed) quoteAmount(operation string, amount decimal.Decimal) (decimal.Decimal, int64, error) {
+	quote, lastEpochSeen, err := of.Quote(operation, amount)
+	if err != nil {
+		return invalidAmount, lastEpochSeen, err
+	}
+	return quote.Amount, lastEpochSeen, nil
+}
+
+// quote performs a market operation, the caller must hold the read lock.
+func (of *OrderbookFeed) quote(operation string, amount decimal.Decimal) (*Quote, error) {
+	if err := of.checkQuoteable(amount); err != nil {
+		return nil, err
 	}
+	switch operation {
+	case BUY_BASE:
+		return of.performMarketOperationOnBase(amount, ASKS)
+	case SELL_BASE:
+		return of.performMarketOperationOnBase(amount, BIDS)
+	case BUY_QUOTE:
+		return of.performMarketOperationOnQuote(amount, BIDS)
+	case SELL_QUOTE:
+		return of.performMarketOperationOnQuote(amount, ASKS)
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedOperation, operation)
+}
 
-	performedInsert := false
+func (of *OrderbookFeed) writeUpdate(updates []*Update, side string) {
+	selectedSide := of.selectSide(side)
 	for _, update := range updates {
-		parsedSize, err := strconv.ParseFloat(update.Size, 64)
+		parsedSize, err := decimal.NewFromString(update.Size)
 		if err != nil {
 			log.WithField("msg", err.Error()).Errorln("Skipped update due to error")
 			continue
 		}
-		_, ok := selectedMap[update.Price]
-		selectedMap[update.Price] = parsedSize
-		if !ok {
-			parsedPrice, err := strconv.ParseFloat(update.Price, 64)
-			if err != nil {
-				log.WithField("msg", err.Error()).Errorln("Skipped update due to error")
-				continue
-			}
-			*selectedBookPtr = append(*selectedBookPtr, &orderbookSortedKey{
-				Key:   update.Price,
-				Value: parsedPrice,
-			})
-			performedInsert = true
+		parsedPrice, err := decimal.NewFromString(update.Price)
+		if err != nil {
+			log.WithField("msg", err.Error()).Errorln("Skipped update due to error")
+			continue
 		}
+		selectedSide.set(parsedPrice, parsedSize)
 	}
-	return performedInsert
 }
 
-// GetBookCount returns the count of bids and asks.
-// NOTE: some of these bids and asks can be a size of 0.
+// GetBookCount returns the count of bids and asks. Levels are removed as soon
+// as their size drops to 0, so every counted level has liquidity.
 func (of *OrderbookFeed) GetBookCount() (int, int) {
-	return len(of.bids), len(of.asks)
+	of.updateLock.RLock()
+	defer of.updateLock.RUnlock()
+	return of.bids.len(), of.asks.len()
 }
 
 func (of *OrderbookFeed) setData(epoch int64, bids []*Update, asks []*Update, recreate bool) bool {
+	of.updateLock.Lock()
+	defer of.updateLock.Unlock()
+
 	if epoch < of.lastEpochSeen {
 		log.WithField("lastEpochSeen", of.lastEpochSeen).WithField("newEpoch", epoch).Warningln("Skipping update due to race condition")
 		return false
 	}
 	of.lastEpochSeen = epoch
+	of.version++
 
 	if recreate {
-		// Re-create all maps and structs
-		of.bids = nil
-		of.asks = nil
-		of.asksSizeMap = make(map[string]float64)
-		of.bidsSizeMap = make(map[string]float64)
+		// Re-create both sides of the book
+		of.bids = newBookSide(true)
+		of.asks = newBookSide(false)
 	}
 
 	// Write a fresh batch of updates
-	of.updateLock.Lock()
-	containsNewInsertsBids := of.writeUpdate(bids, BIDS)
-	containsNewInsertsAsks := of.writeUpdate(asks, ASKS)
-	of.updateLock.Unlock()
-
-	// Sort the results after the update was written
-	if containsNewInsertsBids {
-		sort.Slice(of.bids, func(i, j int) bool {
-			return of.bids[i].Value > of.bids[j].Value
-		})
-	}
-	if containsNewInsertsAsks {
-		sort.Slice(of.asks, func(i, j int) bool {
-			return of.asks[i].Value < of.asks[j].Value
-		})
-	}
+	of.writeUpdate(bids, BIDS)
+	of.writeUpdate(asks, ASKS)
 	return true
 }
 
@@ -254,11 +634,30 @@ func (of *OrderbookFeed) setData(epoch int64, bids []*Update, asks []*Update, re
 func (of *OrderbookFeed) SetSnapshot(epoch int64, bids []*Update, asks []*Update) bool {
 	result := of.setData(epoch, bids, asks, true)
 	if result {
+		of.updateLock.Lock()
 		of.snapshotWasSet = true
+		of.updateLock.Unlock()
 	}
 	return result
 }
 
+// CheckValid returns nil when the orderbook can be quoted, otherwise the reason it cannot:
+// a snapshot was never set, the book was invalidated, or the book is stale.
+func (of *OrderbookFeed) CheckValid() error {
+	of.updateLock.RLock()
+	defer of.updateLock.RUnlock()
+	return of.checkValid()
+}
+
+// Invalidate marks the orderbook as out of sync. All quotes fail until a new
+// snapshot is set.
+func (of *OrderbookFeed) Invalidate() {
+	of.updateLock.Lock()
+	defer of.updateLock.Unlock()
+	of.snapshotWasSet = false
+	of.version++
+}
+
 // WriteUpdate performs an incremental update to bids and asks that already exist in the
 // orderbook.
 func (of *OrderbookFeed) WriteUpdate(epoch int64, bids []*Update, asks []*Update) bool {
@@ -271,7 +670,7 @@ func NewOrderbookFeed(ProductID string) *OrderbookFeed {
 		ProductID:     ProductID,
 		lastEpochSeen: -1,
 		updateLock:    &sync.RWMutex{},
-		asksSizeMap:   make(map[string]float64),
-		bidsSizeMap:   make(map[string]float64),
+		bids:          newBookSide(true),
+		asks:          newBookSide(false),
 	}
 }
@@ -2,10 +2,15 @@ package feed
 
 import (
 	"encoding/json"
-	"math"
+	"errors"
+	"io/ioutil"
+	"math/rand"
 	"net/http"
+	"path/filepath"
 	"testing"
 	"time"
+
+	"github.com/shopspring/decimal"
 )
 
 func transformToUpdate(input [][]interface{}) []*Update {
@@ -30,7 +35,7 @@ func TestCanInitialize(t *testing.T) {
 func TestFailsForGetPrice(t *testing.T) {
 	ob := NewOrderbookFeed("ETH-DAI")
 	ob.SetSnapshot(time.Now().Unix(), []*Update{}, []*Update{})
-	_, _, err := ob.SellBase(1.2)
+	_, _, err := ob.SellBase(decimal.RequireFromString("1.2"))
 	if err == nil {
 		t.Error("Expected error to exist, but it was nil")
 	}
@@ -59,12 +64,12 @@ func TestAddItem(t *testing.T) {
 		t.Errorf("Num bids expected as 3, but was %d. Num asks expected was 1, but was %d", numBids, numAsks)
 	}
 
-	result, _, err := ob.SellBase(0.6)
+	result, _, err := ob.SellBase(decimal.RequireFromString("0.6"))
 	if err != nil {
 		t.Error(err.Error())
 	}
-	if result != 198.6 {
-		t.Errorf("Expected 198.6 but got %f", result)
+	if !result.Equal(decimal.RequireFromString("198.6")) {
+		t.Errorf("Expected 198.6 but got %s", result)
 	}
 }
 
@@ -80,33 +85,33 @@ func TestUpdate(t *testing.T) {
 		&Update{Price: "333.2", Size: "0.5"},
 		&Update{Price: "310", Size: "1.5"},
 	}, []*Update{})
-	result, _, err := ob.SellBase(0.6)
+	result, _, err := ob.SellBase(decimal.RequireFromString("0.6"))
 	if err != nil {
 		t.Error(err.Error())
 	}
-	if result != 197.6 {
-		t.Errorf("Expected 197.6 but got %f", result)
+	if !result.Equal(decimal.RequireFromString("197.6")) {
+		t.Errorf("Expected 197.6 but got %s", result)
 	}
 	ob.WriteUpdate(time.Now().Unix(), []*Update{
 		&Update{Price: "320", Size: "0.5"},
 	}, []*Update{})
-	result, _, err = ob.SellBase(0.6)
+	result, _, err = ob.SellBase(decimal.RequireFromString("0.6"))
 	if err != nil {
 		t.Error(err.Error())
 	}
-	if result != 198.6 {
-		t.Errorf("Expected 198.6 but got %f", result)
+	if !result.Equal(decimal.RequireFromString("198.6")) {
+		t.Errorf("Expected 198.6 but got %s", result)
 	}
 
 	ob.WriteUpdate(time.Now().Unix(), []*Update{
 		&Update{Price: "333.2", Size: "1.5"},
 	}, []*Update{})
-	result, _, err = ob.SellBase(0.6)
+	result, _, err = ob.SellBase(decimal.RequireFromString("0.6"))
 	if err != nil {
 		t.Error(err.Error())
 	}
-	if result != 199.92 {
-		t.Errorf("Expected 199.92 but got %f", result)
+	if !result.Equal(decimal.RequireFromString("199.92")) {
+		t.Errorf("Expected 199.92 but got %s", result)
 	}
 
 }
@@ -123,12 +128,12 @@ func TestBuyBase(t *testing.T) {
 	}
 	timestamp := time.Now().Unix()
 	ob.SetSnapshot(timestamp, bids, asks)
-	result, _, err := ob.BuyBase(0.2)
+	result, _, err := ob.BuyBase(decimal.RequireFromString("0.2"))
 	if err != nil {
 		t.Error(err.Error())
 	}
-	if result != 67.024 {
-		t.Errorf("Expected 198.6 but got %f", result)
+	if !result.Equal(decimal.RequireFromString("67.024")) {
+		t.Errorf("Expected 198.6 but got %s", result)
 	}
 }
 
@@ -145,12 +150,12 @@ func TestBuyQuote(t *testing.T) {
 	timestamp := time.Now().Unix()
 	ob.SetSnapshot(timestamp, bids, asks)
 
-	result, _, err := ob.BuyQuote(200)
+	result, _, err := ob.BuyQuote(decimal.RequireFromString("200"))
 	if err != nil {
 		t.Error(err.Error())
 	}
-	if result != 0.604375 {
-		t.Errorf("Expected 0.604375 but got %f", result)
+	if !result.Equal(decimal.RequireFromString("0.604375")) {
+		t.Errorf("Expected 0.604375 but got %s", result)
 	}
 }
 
@@ -167,12 +172,12 @@ func TestSellQuote(t *testing.T) {
 	timestamp := time.Now().Unix()
 	ob.SetSnapshot(timestamp, bids, asks)
 
-	result, _, err := ob.SellQuote(50)
+	result, _, err := ob.SellQuote(decimal.RequireFromString("50"))
 	if err != nil {
 		t.Error(err.Error())
 	}
-	if result != 0.14920028646455 {
-		t.Errorf("Expected 0.14920028646455 but got %f", result)
+	if !result.Equal(decimal.RequireFromString("0.14920028646455")) {
+		t.Errorf("Expected 0.14920028646455 but got %s", result)
 	}
 }
 
@@ -181,8 +186,8 @@ func TestErrorWillReturnIfNoSnapshotWasEverSet(t *testing.T) {
 	ob.WriteUpdate(1, []*Update{
 		&Update{Price: "333.2", Size: "1.5"},
 	}, []*Update{})
-	_, _, err1 := ob.SellBase(0.6)
-	_, _, err2 := ob.BuyBase(0.6)
+	_, _, err1 := ob.SellBase(decimal.RequireFromString("0.6"))
+	_, _, err2 := ob.BuyBase(decimal.RequireFromString("0.6"))
 	if err1 == nil || err2 == nil {
 		t.Error("No orderbook operations should be allowed if a snapshot was never set")
 	}
@@ -190,10 +195,10 @@ func TestErrorWillReturnIfNoSnapshotWasEverSet(t *testing.T) {
 
 func TestEndToEnd(t *testing.T) {
 	response, err := http.Get(URL)
-	defer response.Body.Close()
 	if err != nil {
-		panic(err)
+		t.Skipf("Coinbase Pro is unreachable, skipping: %s", err.Error())
 	}
+	defer response.Body.Close()
 
 	var l2Data LevelTwoOrderbook
 	decoder := json.NewDecoder(response.Body)
@@ -204,12 +209,14 @@ func TestEndToEnd(t *testing.T) {
 	asks := transformToUpdate(l2Data.Asks)
 	ob.SetSnapshot(time.Now().Unix(), bids, asks)
 
+	// Buying quote rounds the division at every bid level crossed to DIVISION_PRECISION places
+	tolerance := decimal.New(int64(len(bids)), -DIVISION_PRECISION)
 	for i := 10; i < 400; i += 10 {
-		quoteObtained, _, _ := ob.SellBase(float64(i))
+		quoteObtained, _, _ := ob.SellBase(decimal.NewFromInt(int64(i)))
 		baseObtained, _, _ := ob.BuyQuote(quoteObtained)
 
-		if math.Round(baseObtained) != float64(i) {
-			t.Errorf("Expcted %d but got %f", i, baseObtained)
+		if baseObtained.Sub(decimal.NewFromInt(int64(i))).Abs().GreaterThan(tolerance) {
+			t.Errorf("Expcted %d but got %s", i, baseObtained)
 		}
 	}
 }
@@ -250,18 +257,18 @@ func TestSellQuoteWhenBookIsOld(t *testing.T) {
 	timestamp := time.Now().Unix() - 6
 	ob.SetSnapshot(timestamp, bids, asks)
 
-	_, _, err := ob.SellQuote(50)
+	_, _, err := ob.SellQuote(decimal.RequireFromString("50"))
 	if err == nil || err.Error() != "Orderbook is stale" {
 		t.Error("Orderbook is stale but no error was raised")
 	}
 
-	_, _, err = ob.SellBase(50)
+	_, _, err = ob.SellBase(decimal.RequireFromString("50"))
 	if err == nil || err.Error() != "Orderbook is stale" {
 		t.Error("Orderbook is stale but no error was raised")
 	}
 }
 
-func TestOrderbookCleanup(t *testing.T) {
+func TestZeroSizeLevelsAreRemoved(t *testing.T) {
 	ob := NewOrderbookFeed("ETH-DAI")
 	bids := []*Update{
 		&Update{Price: "333.2", Size: "0.5"},
@@ -273,28 +280,762 @@ func TestOrderbookCleanup(t *testing.T) {
 	}
 	ob.SetSnapshot(time.Now().Unix(), bids, asks)
 
-	// Set price to 0
+	// Set size to 0, the level should be dropped immediately
 	bids = []*Update{
 		&Update{Price: "333.2", Size: "0"},
 	}
-	ob.WriteUpdate(time.Now().Unix(), bids, asks)
-
-	// Rows should still return 3 count
-	p1, _, _ := ob.SellQuote(50)
-	numBids, _ := ob.GetBookCount()
-	if numBids != 3 {
-		t.Errorf("Expected 3 bids, got %d", numBids)
+	ob.WriteUpdate(time.Now().Unix(), bids, []*Update{})
+	numBids, numAsks := ob.GetBookCount()
+	if numBids != 2 || numAsks != 1 {
+		t.Errorf("Expected 2 bids and 1 ask, got %d and %d", numBids, numAsks)
+	}
+	result, _, err := ob.SellBase(decimal.RequireFromString("0.6"))
+	if err != nil {
+		t.Error(err.Error())
+	}
+	if !result.Equal(decimal.RequireFromString("191")) {
+		t.Errorf("Expected 191 but got %s", result)
 	}
 
-	// Clean up orderboo
-	ob.CleanUpOrderbook()
+	// Removing a level that does not exist is a no-op
+	ob.WriteUpdate(time.Now().Unix(), []*Update{&Update{Price: "1", Size: "0"}}, []*Update{})
 	numBids, _ = ob.GetBookCount()
 	if numBids != 2 {
 		t.Errorf("Expected 2 bids, got %d", numBids)
 	}
-	p2, _, _ := ob.SellQuote(50)
-	if p2 != p1 {
-		t.Fail()
+}
+
+func TestEquivalentPricesShareALevel(t *testing.T) {
+	ob := NewOrderbookFeed("ETH-DAI")
+	ob.SetSnapshot(time.Now().Unix(), []*Update{
+		&Update{Price: "333.20", Size: "0.5"},
+	}, []*Update{})
+	ob.WriteUpdate(time.Now().Unix(), []*Update{
+		&Update{Price: "333.2", Size: "1"},
+	}, []*Update{})
+	numBids, _ := ob.GetBookCount()
+	if numBids != 1 {
+		t.Errorf("Expected 1 bid, got %d", numBids)
+	}
+}
+
+func TestExactDecimalArithmetic(t *testing.T) {
+	ob := NewOrderbookFeed("ETH-DAI")
+	bids := []*Update{
+		&Update{Price: "1.1", Size: "0.1"},
+		&Update{Price: "1.0", Size: "0.2"},
+	}
+	ob.SetSnapshot(time.Now().Unix(), bids, []*Update{})
+
+	// 0.1 + 0.2 cannot be represented as a float64, the whole book must still be fillable
+	result, _, err := ob.SellBase(decimal.RequireFromString("0.3"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if result.String() != "0.31" {
+		t.Errorf("Expected 0.31 but got %s", result)
+	}
+
+	result, _, err = ob.BuyQuote(result)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if result.String() != "0.3" {
+		t.Errorf("Expected 0.3 but got %s", result)
+	}
+}
+
+func makeBenchmarkBook(numLevels int) *OrderbookFeed {
+	bids := make([]*Update, numLevels)
+	asks := make([]*Update, numLevels)
+	for i := 0; i < numLevels; i++ {
+		bids[i] = &Update{Price: decimal.New(int64(100000-i), -2).String(), Size: "1.5"}
+		asks[i] = &Update{Price: decimal.New(int64(100001+i), -2).String(), Size: "1.5"}
+	}
+	ob := NewOrderbookFeed("BTC-USD")
+	ob.SetSnapshot(time.Now().Unix(), bids, asks)
+	return ob
+}
+
+func benchmarkWriteUpdate(b *testing.B, numLevels int) {
+	ob := makeBenchmarkBook(numLevels)
+	rng := rand.New(rand.NewSource(42))
+	epoch := time.Now().Unix()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Mix of size changes, removals and brand new levels inside the spread
+		price := decimal.New(int64(100000-rng.Intn(numLevels*2)), -2).String()
+		size := "0"
+		if i%3 != 0 {
+			size = "2.25"
+		}
+		ob.WriteUpdate(epoch, []*Update{&Update{Price: price, Size: size}}, nil)
+	}
+}
+
+func BenchmarkWriteUpdate1k(b *testing.B)   { benchmarkWriteUpdate(b, 1000) }
+func BenchmarkWriteUpdate10k(b *testing.B)  { benchmarkWriteUpdate(b, 10000) }
+func BenchmarkWriteUpdate100k(b *testing.B) { benchmarkWriteUpdate(b, 100000) }
+
+func BenchmarkSellBase(b *testing.B) {
+	ob := makeBenchmarkBook(10000)
+	amount := decimal.NewFromInt(50)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ob.SellBase(amount)
+	}
+}
+
+func TestTopOfBook(t *testing.T) {
+	ob := NewOrderbookFeed("ETH-DAI")
+	if _, _, err := ob.GetTopOfBook(); err == nil {
+		t.Error("Expected an error before a snapshot was set")
+	}
+	bids := []*Update{
+		&Update{Price: "320", Size: "0.5"},
+		&Update{Price: "333.2", Size: "0.5"},
+	}
+	asks := []*Update{
+		&Update{Price: "335.12", Size: "0.25"},
+		&Update{Price: "340", Size: "2"},
+	}
+	ob.SetSnapshot(time.Now().Unix(), bids, asks)
+	topOfBook, _, err := ob.GetTopOfBook()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if topOfBook.BidPrice.String() != "333.2" || topOfBook.AskPrice.String() != "335.12" || topOfBook.AskSize.String() != "0.25" {
+		t.Errorf("Unexpected top of book %s@%s / %s@%s", topOfBook.BidSize, topOfBook.BidPrice, topOfBook.AskSize, topOfBook.AskPrice)
+	}
+	if topOfBook.Mid.String() != "334.16" || topOfBook.Spread.String() != "1.92" {
+		t.Errorf("Expected mid 334.16 and spread 1.92, got %s and %s", topOfBook.Mid, topOfBook.Spread)
+	}
+
+	ob.WriteUpdate(time.Now().Unix(), []*Update{}, []*Update{&Update{Price: "335.12", Size: "0"}, &Update{Price: "340", Size: "0"}})
+	if _, _, err := ob.GetTopOfBook(); err == nil || err.Error() != INSUFFICIENT_LIQUIDITY {
+		t.Error("Expected an error when one side of the book is empty")
+	}
+}
+
+func TestGetDepth(t *testing.T) {
+	ob := NewOrderbookFeed("ETH-DAI")
+	bids := []*Update{
+		&Update{Price: "99", Size: "1"},
+		&Update{Price: "98", Size: "2"},
+		&Update{Price: "90", Size: "3"},
+	}
+	asks := []*Update{
+		&Update{Price: "101", Size: "1"},
+		&Update{Price: "103", Size: "2"},
+		&Update{Price: "110", Size: "3"},
+	}
+	ob.SetSnapshot(time.Now().Unix(), bids, asks)
+
+	depth, _, err := ob.GetDepth(2, decimal.Zero)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(depth.Bids) != 2 || len(depth.Asks) != 2 {
+		t.Fatalf("Expected 2 levels per side, got %d bids and %d asks", len(depth.Bids), len(depth.Asks))
+	}
+	if depth.Bids[0].Price.String() != "99" || depth.Bids[1].Price.String() != "98" || depth.Asks[1].Size.String() != "2" {
+		t.Error("Levels should be ordered best price first")
+	}
+	if depth.Mid.String() != "100" {
+		t.Errorf("Expected mid 100, got %s", depth.Mid)
+	}
+
+	// Within 3% of 100, 90 and 110 are excluded
+	depth, _, err = ob.GetDepth(0, decimal.RequireFromString("3"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(depth.Bids) != 2 || len(depth.Asks) != 2 {
+		t.Errorf("Expected 2 levels per side within 3%%, got %d bids and %d asks", len(depth.Bids), len(depth.Asks))
+	}
+
+	depth, _, _ = ob.GetDepth(0, decimal.Zero)
+	if len(depth.Bids) != 3 || len(depth.Asks) != 3 {
+		t.Errorf("Expected every level, got %d bids and %d asks", len(depth.Bids), len(depth.Asks))
+	}
+}
+
+func TestGetLevelsCovering(t *testing.T) {
+	ob := NewOrderbookFeed("ETH-DAI")
+	if _, _, err := ob.GetLevelsCovering(ASKS, decimal.NewFromInt(1)); !errors.Is(err, ErrNoSnapshot) {
+		t.Errorf("Expected ErrNoSnapshot, got %v", err)
+	}
+	bids := []*Update{
+		&Update{Price: "99", Size: "1"},
+		&Update{Price: "98", Size: "2"},
+	}
+	asks := []*Update{
+		&Update{Price: "101", Size: "1"},
+		&Update{Price: "103", Size: "2"},
+		&Update{Price: "110", Size: "3"},
+	}
+	ob.SetSnapshot(time.Now().Unix(), bids, asks)
+
+	// 1.5 ETH reaches into the second ask, but not the third
+	levels, _, err := ob.GetLevelsCovering(ASKS, decimal.RequireFromString("1.5"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(levels) != 2 || levels[0].Price.String() != "101" || levels[1].Price.String() != "103" {
+		t.Errorf("Expected the asks at 101 and 103, got %v", levels)
+	}
+	levels, _, _ = ob.GetLevelsCovering(BIDS, decimal.NewFromInt(10))
+	if len(levels) != 2 || levels[0].Price.String() != "99" {
+		t.Errorf("Expected every bid, best first, got %v", levels)
+	}
+	if _, _, err := ob.GetLevelsCovering("MIDDLE", decimal.NewFromInt(1)); !errors.Is(err, ErrUnsupportedOperation) {
+		t.Errorf("Expected ErrUnsupportedOperation, got %v", err)
+	}
+}
+
+func TestQuoteBreakdown(t *testing.T) {
+	ob := NewOrderbookFeed("ETH-DAI")
+	bids := []*Update{
+		&Update{Price: "333.2", Size: "0.5"},
+		&Update{Price: "320", Size: "0.5"},
+		&Update{Price: "310", Size: "1.5"},
+	}
+	asks := []*Update{
+		&Update{Price: "335.12", Size: "0.5"},
+	}
+	ob.SetSnapshot(time.Now().Unix(), bids, asks)
+
+	quote, _, err := ob.Quote(SELL_BASE, decimal.RequireFromString("0.6"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if quote.Amount.String() != "198.6" {
+		t.Errorf("Expected 198.6 but got %s", quote.Amount)
+	}
+	if len(quote.Fills) != 2 || quote.Fills[0].Size.String() != "0.5" || quote.Fills[1].Price.String() != "320" || quote.Fills[1].Size.String() != "0.1" {
+		t.Errorf("Unexpected fills %v", quote.Fills)
+	}
+	if quote.VWAP.String() != "331" || quote.WorstPrice.String() != "320" {
+		t.Errorf("Expected VWAP 331 and worst price 320, got %s and %s", quote.VWAP, quote.WorstPrice)
+	}
+	if quote.SlippageBps.String() != "94.5655" {
+		t.Errorf("Expected 94.5655 bps of slippage, got %s", quote.SlippageBps)
+	}
+
+	// Buying above mid is also positive slippage
+	quote, _, _ = ob.Quote(BUY_BASE, decimal.RequireFromString("0.2"))
+	if quote.VWAP.String() != "335.12" || quote.SlippageBps.String() != "28.7288" {
+		t.Errorf("Expected VWAP 335.12 and 28.7288 bps, got %s and %s", quote.VWAP, quote.SlippageBps)
+	}
+
+	// Quote side walks report the base taken from each level
+	quote, _, _ = ob.Quote(BUY_QUOTE, decimal.RequireFromString("200"))
+	if len(quote.Fills) != 2 || quote.Fills[0].Size.String() != "0.5" || quote.Fills[1].Size.String() != "0.104375" {
+		t.Errorf("Unexpected fills %v", quote.Fills)
+	}
+
+	if _, _, err := ob.Quote("BUY_EVERYTHING", decimal.RequireFromString("1")); err == nil {
+		t.Error("Expected an error for an unsupported operation")
+	}
+}
+
+func TestBatchQuote(t *testing.T) {
+	ob := NewOrderbookFeed("ETH-DAI")
+	bids := []*Update{
+		&Update{Price: "333.2", Size: "0.5"},
+		&Update{Price: "320", Size: "0.5"},
+	}
+	asks := []*Update{
+		&Update{Price: "335.12", Size: "0.5"},
+	}
+	epoch := time.Now().Unix()
+	ob.SetSnapshot(epoch, bids, asks)
+
+	results, lastUpdated := ob.BatchQuote([]*QuoteRequest{
+		&QuoteRequest{Operation: SELL_BASE, Amount: decimal.RequireFromString("0.6")},
+		&QuoteRequest{Operation: SELL_BASE, Amount: decimal.RequireFromString("5")},
+		&QuoteRequest{Operation: BUY_BASE, Amount: decimal.RequireFromString("0.5")},
+		&QuoteRequest{Operation: BUY_BASE, Amount: decimal.RequireFromString("-1")},
+	})
+	if lastUpdated != epoch || len(results) != 4 {
+		t.Fatalf("Expected 4 results as of %d, got %d as of %d", epoch, len(results), lastUpdated)
+	}
+	if results[0].Err != nil || results[0].Quote.Amount.String() != "198.6" {
+		t.Errorf("Expected 198.6, got %v", results[0])
+	}
+	var liquidityErr *InsufficientLiquidityError
+	if !errors.As(results[1].Err, &liquidityErr) || liquidityErr.MaxFillable.String() != "1" {
+		t.Errorf("Expected insufficient liquidity with 1 fillable, got %v", results[1].Err)
+	}
+	if results[2].Err != nil || results[2].Quote.Amount.String() != "167.56" {
+		t.Errorf("Expected 167.56, got %v", results[2])
+	}
+	if !errors.Is(results[3].Err, ErrInvalidAmount) {
+		t.Errorf("Expected an invalid amount, got %v", results[3].Err)
+	}
+}
+
+func TestLiquidityCurve(t *testing.T) {
+	ob := NewOrderbookFeed("ETH-DAI")
+	bids := []*Update{
+		&Update{Price: "333.2", Size: "0.5"},
+		&Update{Price: "320", Size: "0.5"},
+		&Update{Price: "310", Size: "1.5"},
+	}
+	asks := []*Update{
+		&Update{Price: "335.12", Size: "0.5"},
+		&Update{Price: "340", Size: "1"},
+	}
+	ob.SetSnapshot(time.Now().Unix(), bids, asks)
+
+	distances := []decimal.Decimal{decimal.NewFromInt(500), decimal.NewFromInt(10), decimal.NewFromInt(100)}
+	curve, _, err := ob.GetLiquidityCurve(distances)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if curve.Mid.String() != "334.16" || len(curve.Bids) != 3 || len(curve.Asks) != 3 {
+		t.Fatalf("Unexpected curve %v", curve)
+	}
+	expectedBids := [][]string{{"10", "333.82584", "0", "0"}, {"100", "330.8184", "0.5", "333.2"}, {"500", "317.452", "1", "326.6"}}
+	expectedAsks := [][]string{{"10", "334.49416", "0", "0"}, {"100", "337.5016", "0.5", "335.12"}, {"500", "350.868", "1.5", "338.3733333333333333"}}
+	check := func(points []*LiquidityPoint, expected [][]string) {
+		for idx, point := range points {
+			actual := []string{point.DistanceBps.String(), point.LimitPrice.String(), point.Size.String(), point.AveragePrice.String()}
+			for field := range actual {
+				if actual[field] != expected[idx][field] {
+					t.Errorf("Expected point %v, got %v", expected[idx], actual)
+					break
+				}
+			}
+		}
+	}
+	check(curve.Bids, expectedBids)
+	check(curve.Asks, expectedAsks)
+	if curve.Asks[2].Notional.String() != "507.56" {
+		t.Errorf("Expected 507.56 notional, got %s", curve.Asks[2].Notional)
+	}
+
+	if _, _, err := ob.GetLiquidityCurve([]decimal.Decimal{decimal.NewFromInt(-1)}); !errors.Is(err, ErrInvalidDepth) {
+		t.Errorf("Expected negative distances to be rejected, got %v", err)
+	}
+}
+
+func TestMaxFillable(t *testing.T) {
+	ob := NewOrderbookFeed("ETH-DAI")
+	bids := []*Update{
+		&Update{Price: "333.2", Size: "0.5"},
+		&Update{Price: "320", Size: "0.5"},
+		&Update{Price: "310", Size: "1.5"},
+	}
+	asks := []*Update{
+		&Update{Price: "335.12", Size: "0.5"},
+		&Update{Price: "340", Size: "1"},
+	}
+	ob.SetSnapshot(time.Now().Unix(), bids, asks)
+
+	check := func(fillable *Fillable, size, notional, worstPrice string) {
+		if fillable.Size.String() != size || fillable.Notional.String() != notional || fillable.WorstPrice.String() != worstPrice {
+			t.Errorf("Expected %s for %s at worst %s, got %s for %s at worst %s",
+				size, notional, worstPrice, fillable.Size, fillable.Notional, fillable.WorstPrice)
+		}
+	}
+
+	maxFillable, _, err := ob.GetMaxFillableAtPrice(decimal.RequireFromString("336"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	check(maxFillable.Buy, "0.5", "167.56", "335.12")
+	check(maxFillable.Sell, "0", "0", "0")
+	maxFillable, _, _ = ob.GetMaxFillableAtPrice(decimal.RequireFromString("320"))
+	check(maxFillable.Sell, "1", "326.6", "320")
+	if maxFillable.Sell.AveragePrice.String() != "326.6" {
+		t.Errorf("Expected an average of 326.6, got %s", maxFillable.Sell.AveragePrice)
+	}
+
+	// 50 bps around a mid of 334.16 allow a VWAP of 335.8308 buying and 332.4892 selling
+	maxFillable, _, err = ob.GetMaxFillableWithinSlippage(decimal.NewFromInt(50))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	check(maxFillable.Buy, "0.5852441715437014", "196.543018324858476", "340")
+	check(maxFillable.Sell, "0.5284565864907279", "175.706107677032928", "320")
+	quote, _, _ := ob.Quote(BUY_BASE, maxFillable.Buy.Size)
+	if quote.SlippageBps.GreaterThan(decimal.NewFromInt(50)) {
+		t.Errorf("Expected buying the fillable size to slip at most 50 bps, got %s", quote.SlippageBps)
+	}
+
+	if _, _, err := ob.GetMaxFillableWithinSlippage(decimal.NewFromInt(-1)); !errors.Is(err, ErrInvalidAmount) {
+		t.Errorf("Expected negative slippage to be rejected, got %v", err)
+	}
+}
+
+func TestQuoteWithFee(t *testing.T) {
+	ob := NewOrderbookFeed("ETH-DAI")
+	bids := []*Update{
+		&Update{Price: "333.2", Size: "0.5"},
+		&Update{Price: "320", Size: "0.5"},
+	}
+	asks := []*Update{
+		&Update{Price: "335.12", Size: "0.5"},
+	}
+	ob.SetSnapshot(time.Now().Unix(), bids, asks)
+	feeBps := decimal.NewFromInt(60)
+
+	expected := []struct {
+		operation, amount, netAmount, fee string
+	}{
+		{SELL_BASE, "0.5", "165.6004", "0.9996"},
+		{BUY_BASE, "0.25", "84.28268", "0.50268"},
+		{SELL_QUOTE, "100.6", "0.2984005729291", "0.6"},
+		{BUY_QUOTE, "99.4", "0.3001200480192077", "0.6"},
+	}
+	for _, e := range expected {
+		quote, _, err := ob.QuoteWithFee(e.operation, decimal.RequireFromString(e.amount), feeBps)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if quote.Amount.String() != e.netAmount || quote.Fee.String() != e.fee {
+			t.Errorf("%s %s: expected %s and a fee of %s, got %s and %s", e.operation, e.amount, e.netAmount, e.fee, quote.Amount, quote.Fee)
+		}
+	}
+
+	// Without a fee the result is the gross amount
+	quote, _, _ := ob.QuoteWithFee(SELL_BASE, decimal.RequireFromString("0.5"), decimal.Zero)
+	if quote.Amount.String() != "166.6" || !quote.Fee.IsZero() {
+		t.Errorf("Expected 166.6 without fee, got %s and %s", quote.Amount, quote.Fee)
+	}
+}
+
+func TestFeeScheduleTiers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fees.json")
+	config := `{
+		"thirtyDayVolume": "25000",
+		"tiers": [
+			{"minVolume": "50000", "makerBps": "15", "takerBps": "25"},
+			{"minVolume": "0", "makerBps": "40", "takerBps": "60"},
+			{"minVolume": "10000", "makerBps": "25", "takerBps": "40"}
+		],
+		"products": {
+			"USDC-USD": [{"minVolume": "0", "makerBps": "0", "takerBps": "0"}]
+		}
+	}`
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	schedule, err := LoadFeeSchedule(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if tier := schedule.Tier("ETH-USD"); tier.TakerBps.String() != "40" || tier.MakerBps.String() != "25" {
+		t.Errorf("Expected the 10000 tier, got %v", tier)
+	}
+	if tier := schedule.Tier("USDC-USD"); !tier.TakerBps.IsZero() {
+		t.Errorf("Expected the USDC-USD override, got %v", tier)
+	}
+	schedule.ThirtyDayVolume = decimal.NewFromInt(50000)
+	if tier := schedule.Tier("ETH-USD"); tier.TakerBps.String() != "25" {
+		t.Errorf("Expected the 50000 tier, got %v", tier)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`{"tiers": [{"minVolume": "100", "takerBps": "10"}]}`), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := LoadFeeSchedule(path); err == nil {
+		t.Error("Expected a schedule without a tier for low volumes to be rejected")
+	}
+	for _, invalid := range []string{
+		`{"tiers": [{"minVolume": "0", "takerBps": "10000"}]}`,
+		`{"tiers": [{"minVolume": "0", "takerBps": "10"}], "products": {"USDC-USD": [{"minVolume": "0", "makerBps": "12000"}]}}`,
+		`{"tiers": [{"minVolume": "0", "takerBps": "10"}, {"minVolume": "0.0", "takerBps": "5"}]}`,
+	} {
+		if err := ioutil.WriteFile(path, []byte(invalid), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err := LoadFeeSchedule(path); err == nil {
+			t.Errorf("Expected %s to be rejected", invalid)
+		}
+	}
+}
+
+func TestConsolidatedOrderbook(t *testing.T) {
+	alpha := NewOrderbookFeed("ETH-USD")
+	alpha.SetSnapshot(time.Now().Unix(),
+		[]*Update{&Update{Price: "99", Size: "1"}},
+		[]*Update{&Update{Price: "101", Size: "1"}, &Update{Price: "102", Size: "2"}},
+	)
+	beta := NewOrderbookFeed("ETH-USD")
+	beta.SetSnapshot(time.Now().Unix(),
+		[]*Update{&Update{Price: "99.0", Size: "2"}},
+		[]*Update{&Update{Price: "100", Size: "1"}},
+	)
+	gamma := NewOrderbookFeed("ETH-USD")
+	gamma.SetSnapshot(time.Now().Unix()-TIMEOUT_STALE_BOOK-1,
+		[]*Update{&Update{Price: "120", Size: "10"}},
+		[]*Update{&Update{Price: "1", Size: "10"}},
+	)
+	book := NewConsolidatedOrderbook("ETH-USD", map[string]*OrderbookFeed{"alpha": alpha, "beta": beta, "gamma": gamma})
+
+	// The stale gamma book is left out rather than crossing the book
+	depth, statuses, _, err := book.GetDepth(0, decimal.Zero)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(statuses) != 3 || statuses[0].Err != nil || statuses[1].Err != nil || !errors.Is(statuses[2].Err, ErrStaleBook) {
+		t.Errorf("Expected only gamma to be left out, got %v", statuses)
+	}
+	if len(depth.Bids) != 1 || depth.Bids[0].Size.String() != "3" || len(depth.Bids[0].Sources) != 2 || depth.Bids[0].Sources[1].Venue != "beta" {
+		t.Errorf("Expected 3 ETH bid at 99 from alpha and beta, got %v", depth.Bids)
+	}
+	if len(depth.Asks) != 3 || depth.Asks[0].Price.String() != "100" || depth.Asks[0].Sources[0].Venue != "beta" || depth.Mid.String() != "99.5" {
+		t.Errorf("Expected the asks of alpha and beta, best first, got %v", depth.Asks)
+	}
+
+	// 2 ETH buys 1 at 100 on beta and 1 at 101 on alpha
+	quote, _, _, err := book.Quote(BUY_BASE, decimal.NewFromInt(2))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if quote.Amount.String() != "201" || len(quote.Fills) != 2 {
+		t.Errorf("Expected 201, got %s", quote.Amount)
 	}
 
+	// The merged view is kept until a venue changes
+	view, _, _ := book.view()
+	if again, _, _ := book.view(); again != view {
+		t.Error("Expected the view to be reused while no venue changed")
+	}
+	beta.WriteUpdate(time.Now().Unix(), nil, []*Update{&Update{Price: "100", Size: "0"}})
+	if depth, _, _, _ := book.GetDepth(1, decimal.Zero); depth.Asks[0].Price.String() != "101" {
+		t.Errorf("Expected the update of beta to be seen, got %v", depth.Asks)
+	}
+
+	alpha.Invalidate()
+	beta.Invalidate()
+	if _, _, _, err := book.Quote(BUY_BASE, decimal.NewFromInt(1)); !errors.Is(err, ErrNoSnapshot) {
+		t.Errorf("Expected ErrNoSnapshot once no venue is valid, got %v", err)
+	}
+}
+
+func TestConsolidatedOrderbookFlagsCrossedLevels(t *testing.T) {
+	alpha := NewOrderbookFeed("ETH-USD")
+	alpha.SetSnapshot(time.Now().Unix(),
+		[]*Update{&Update{Price: "101", Size: "1"}, &Update{Price: "99", Size: "1"}},
+		[]*Update{&Update{Price: "102", Size: "1"}},
+	)
+	beta := NewOrderbookFeed("ETH-USD")
+	beta.SetSnapshot(time.Now().Unix(),
+		[]*Update{&Update{Price: "98", Size: "1"}},
+		[]*Update{&Update{Price: "100", Size: "1"}, &Update{Price: "103", Size: "1"}},
+	)
+	book := NewConsolidatedOrderbook("ETH-USD", map[string]*OrderbookFeed{"alpha": alpha, "beta": beta})
+
+	// Alpha bids 101 while beta asks 100
+	depth, _, _, err := book.GetDepth(0, decimal.Zero)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !depth.Crossed || !depth.Bids[0].Crossed || depth.Bids[1].Crossed || !depth.Asks[0].Crossed || depth.Asks[1].Crossed {
+		t.Errorf("Expected the 101 bid and the 100 ask to be flagged, got %v and %v", depth.Bids, depth.Asks)
+	}
+	if depth.Mid.String() != "100.5" {
+		t.Errorf("Expected the mid of the best bid and ask, got %s", depth.Mid)
+	}
+
+	// Once alpha lowers its bid, the book is no longer crossed
+	alpha.WriteUpdate(time.Now().Unix(), []*Update{&Update{Price: "101", Size: "0"}}, nil)
+	depth, _, _, _ = book.GetDepth(0, decimal.Zero)
+	if depth.Crossed || depth.Bids[0].Crossed || depth.Asks[0].Crossed {
+		t.Errorf("Expected the book not to be crossed, got %v and %v", depth.Bids, depth.Asks)
+	}
+}
+
+func TestOrderbookL3(t *testing.T) {
+	ob := NewOrderbookL3("ETH-USD")
+	order := func(updateType string, sequence int64, orderID, side, price, size string) *OrderUpdate {
+		return &OrderUpdate{Type: updateType, Sequence: sequence, OrderID: orderID, Side: side, Price: price, Size: size}
+	}
+	if _, err := ob.Apply(time.Now().Unix(), order(ORDER_OPEN, 11, "late", BIDS, "99", "1")); !errors.Is(err, ErrNoSnapshot) {
+		t.Errorf("Expected ErrNoSnapshot, got %v", err)
+	}
+	ob.SetSnapshot(time.Now().Unix(), 10, []*OrderUpdate{
+		order(ORDER_OPEN, 10, "bid-1", BIDS, "99", "1"),
+		order(ORDER_OPEN, 10, "bid-2", BIDS, "99", "2"),
+		order(ORDER_OPEN, 10, "ask-1", ASKS, "101", "1"),
+	})
+
+	// Updates already part of the snapshot are skipped
+	if applied, err := ob.Apply(time.Now().Unix(), order(ORDER_DONE, 9, "bid-1", BIDS, "99", "0")); applied || err != nil {
+		t.Errorf("Expected an older update to be skipped, got %v and %v", applied, err)
+	}
+	updates := []*OrderUpdate{
+		order(ORDER_RECEIVED, 11, "bid-3", BIDS, "99", "4"),
+		order(ORDER_OPEN, 12, "bid-3", BIDS, "99", "4"),
+		order(ORDER_MATCH, 13, "bid-1", BIDS, "99", "0.4"),
+		order(ORDER_CHANGE, 14, "bid-2", BIDS, "99", "1.5"),
+	}
+	for _, update := range updates {
+		if _, err := ob.Apply(time.Now().Unix(), update); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	depth, _, err := ob.GetDepth(0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(depth.Bids) != 1 || depth.Bids[0].Orders != 3 || depth.Bids[0].Size.String() != "6.1" || depth.Mid.String() != "100" {
+		t.Errorf("Expected 3 bids for 6.1 at 99, got %v", depth.Bids[0])
+	}
+
+	// bid-3 opened last, behind the 0.6 left of bid-1 and the 1.5 of bid-2
+	position, _, err := ob.GetQueuePosition("bid-3")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if position.OrdersAhead != 2 || position.SizeAhead.String() != "2.1" || position.LevelOrders != 3 {
+		t.Errorf("Unexpected queue position %v", position)
+	}
+	ob.Apply(time.Now().Unix(), order(ORDER_DONE, 15, "bid-1", BIDS, "99", "0.6"))
+	position, _, _ = ob.GetQueuePosition("bid-3")
+	if position.OrdersAhead != 1 || position.SizeAhead.String() != "1.5" {
+		t.Errorf("Expected bid-3 to move up once bid-1 is done, got %v", position)
+	}
+	if _, _, err := ob.GetQueuePosition("bid-1"); !errors.Is(err, ErrUnknownOrder) {
+		t.Errorf("Expected ErrUnknownOrder, got %v", err)
+	}
+	if bids, asks := ob.GetOrderCount(); bids != 2 || asks != 1 {
+		t.Errorf("Expected 2 bids and 1 ask, got %d and %d", bids, asks)
+	}
+
+	position, _, _ = ob.EstimateQueuePosition(BIDS, decimal.NewFromInt(99))
+	if position.OrdersAhead != 2 || position.SizeAhead.String() != "5.5" {
+		t.Errorf("Expected a new bid to queue behind 5.5, got %v", position)
+	}
+	if _, _, err := ob.EstimateQueuePosition(BIDS, decimal.NewFromInt(101)); !errors.Is(err, ErrInvalidAmount) {
+		t.Errorf("Expected a crossing bid to be rejected, got %v", err)
+	}
+
+	if _, err := ob.Apply(time.Now().Unix(), order(ORDER_OPEN, 17, "ask-2", ASKS, "102", "1")); !errors.Is(err, ErrSequenceGap) {
+		t.Errorf("Expected ErrSequenceGap, got %v", err)
+	}
+}
+
+func TestTradeTape(t *testing.T) {
+	tape := NewTradeTape("ETH-USD", time.Hour, 3)
+	if _, err := tape.LastTrade(); !errors.Is(err, ErrNoTrades) {
+		t.Errorf("Expected ErrNoTrades, got %v", err)
+	}
+	now := time.Now()
+	trade := func(id int64, side, price, size string, age time.Duration) *Trade {
+		return &Trade{TradeID: id, Side: side, Price: decimal.RequireFromString(price), Size: decimal.RequireFromString(size), Time: now.Add(-age)}
+	}
+	tape.Add(trade(1, TRADE_BUY, "100", "1", 2*time.Hour))
+	tape.Add(trade(2, TRADE_BUY, "101", "1", 10*time.Minute))
+	tape.Add(trade(3, TRADE_SELL, "99", "2", 30*time.Second))
+	if tape.Add(trade(3, TRADE_SELL, "99", "2", 30*time.Second)) {
+		t.Error("Expected a trade seen before to be skipped")
+	}
+
+	// The first trade is older than the retention
+	trades, _ := tape.RecentTrades(0)
+	if len(trades) != 2 || trades[0].TradeID != 3 {
+		t.Fatalf("Expected trades 3 and 2, most recent first, got %v", trades)
+	}
+	stats, err := tape.Stats(time.Minute, now)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if stats.Trades != 1 || stats.SellVolume.String() != "2" || stats.VWAP.String() != "99" {
+		t.Errorf("Unexpected stats over a minute %v", stats)
+	}
+	stats, _ = tape.Stats(time.Hour, now)
+	if stats.Volume.String() != "3" || stats.VWAP.String() != "99.6666666666666667" || stats.High.String() != "101" || stats.Low.String() != "99" {
+		t.Errorf("Unexpected stats over an hour %v", stats)
+	}
+	if _, err := tape.Stats(2*time.Hour, now); !errors.Is(err, ErrInvalidWindow) {
+		t.Errorf("Expected a window over the retention to be rejected, got %v", err)
+	}
+
+	// Only the 3 most recent trades are kept
+	tape.Add(trade(4, TRADE_BUY, "100", "1", 0))
+	tape.Add(trade(5, TRADE_BUY, "100", "1", 0))
+	if trades, _ := tape.RecentTrades(10); len(trades) != 3 || trades[2].TradeID != 3 {
+		t.Errorf("Expected trades 5, 4 and 3, got %v", trades)
+	}
+	if last, _ := tape.LastTrade(); last.TradeID != 5 {
+		t.Errorf("Expected trade 5 to be the last, got %d", last.TradeID)
+	}
+
+	// In a quiet market trades fall out of the retention without another trade being added
+	quiet := NewTradeTape("ETH-USD", time.Hour, 3)
+	quiet.Add(trade(1, TRADE_BUY, "100", "1", 2*time.Hour))
+	quiet.Add(trade(2, TRADE_BUY, "101", "1", 90*time.Minute))
+	if _, err := quiet.LastTrade(); !errors.Is(err, ErrNoTrades) {
+		t.Errorf("Expected ErrNoTrades once every trade is older than the retention, got %v", err)
+	}
+	if trades, _ := quiet.RecentTrades(0); len(trades) != 0 {
+		t.Errorf("Expected no recent trades, got %v", trades)
+	}
+	if trades := quiet.Trades(now.Add(-3 * time.Hour)); len(trades) != 0 {
+		t.Errorf("Expected no trades older than the retention, got %v", trades)
+	}
+}
+
+func TestCandleAggregator(t *testing.T) {
+	candles := NewCandleAggregator("ETH-USD", []time.Duration{time.Minute, time.Hour}, 2)
+	start := time.Date(2021, 1, 1, 10, 0, 0, 0, time.UTC)
+	trade := func(id int64, price, size string, at time.Duration) *Trade {
+		return &Trade{TradeID: id, Side: TRADE_BUY, Price: decimal.RequireFromString(price), Size: decimal.RequireFromString(size), Time: start.Add(at)}
+	}
+	candles.AddMid(start.Add(5*time.Second), decimal.RequireFromString("100.5"))
+	candles.AddTrade(trade(1, "100", "1", 10*time.Second))
+	candles.AddTrade(trade(2, "102", "2", 20*time.Second))
+	candles.AddMid(start.Add(30*time.Second), decimal.RequireFromString("101.5"))
+	candles.AddTrade(trade(3, "101", "1", 40*time.Second))
+
+	// A trade in the next minute closes the first minute only
+	closed := candles.AddTrade(trade(4, "103", "1", 70*time.Second))
+	if len(closed) != 1 || closed[0].Interval != time.Minute || !closed[0].Start.Equal(start) {
+		t.Fatalf("Expected the first minute to close, got %v", closed)
+	}
+	first := closed[0]
+	if first.Open.String() != "100" || first.High.String() != "102" || first.Low.String() != "100" || first.Close.String() != "101" {
+		t.Errorf("Unexpected prices %v", first)
+	}
+	if first.Volume.String() != "4" || first.Notional.String() != "405" || first.Trades != 3 {
+		t.Errorf("Unexpected volume %v", first)
+	}
+	if first.MidOpen.String() != "100.5" || first.MidHigh.String() != "101.5" || first.MidClose.String() != "101.5" {
+		t.Errorf("Unexpected mid prices %v", first)
+	}
+
+	// Quiet minutes close flat at the previous close, only those that can be kept are built
+	closed = candles.Advance(start.Add(5 * time.Minute))
+	if len(closed) != 3 {
+		t.Fatalf("Expected the second minute and 2 flat ones to close, got %d", len(closed))
+	}
+	flat := closed[2]
+	if flat.Trades != 0 || flat.Open.String() != "103" || flat.Close.String() != "103" || flat.MidOpen.String() != "101.5" {
+		t.Errorf("Expected a flat candle, got %v", flat)
+	}
+	kept, err := candles.Candles(time.Minute, 0, true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(kept) != 3 || !kept[2].Start.Equal(start.Add(5*time.Minute)) {
+		t.Errorf("Expected 2 closed candles and the open one, got %v", kept)
+	}
+	hour, _ := candles.Candles(time.Hour, 0, true)
+	if len(hour) != 1 || hour[0].Volume.String() != "5" || hour[0].High.String() != "103" {
+		t.Errorf("Unexpected hourly candle %v", hour)
+	}
+
+	// Trades of a candle already closed are not counted
+	candles.AddTrade(trade(5, "90", "1", 30*time.Second))
+	if minutes, _ := candles.Candles(time.Minute, 0, true); minutes[2].Trades != 0 || minutes[1].Low.String() != "103" {
+		t.Errorf("Expected a late trade to be skipped, got %v", minutes)
+	}
+	if _, err := candles.Candles(5*time.Minute, 0, false); !errors.Is(err, ErrInvalidWindow) {
+		t.Errorf("Expected ErrInvalidWindow for an interval not aggregated, got %v", err)
+	}
 }
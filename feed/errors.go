@@ -0,0 +1,65 @@
+package feed
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/shopspring/decimal"
+)
+
+var (
+	// ErrNoSnapshot is returned until a snapshot is set, and again after the book is invalidated
+	ErrNoSnapshot = errors.New("A snapshot was never set, therefore the orderbook is inaccurate")
+	// ErrStaleBook is returned when the book was not updated for TIMEOUT_STALE_BOOK seconds
+	ErrStaleBook = errors.New("Orderbook is stale")
+	// ErrInvalidAmount is returned for amounts that are not positive
+	ErrInvalidAmount = errors.New("Amount invalid")
+	// ErrInvalidDepth is returned for a negative depth or percentage
+	ErrInvalidDepth = errors.New("Depth invalid")
+	// ErrUnsupportedOperation is returned for operations other than BUY_BASE, SELL_BASE, BUY_QUOTE and SELL_QUOTE
+	ErrUnsupportedOperation = errors.New("Unsupported operation")
+)
+
+// InsufficientLiquidityError is returned when a side of the book cannot fill an operation. MaxFillable
+// is the largest amount the side could fill, in the same unit as the amount requested.
+type InsufficientLiquidityError struct {
+	Side        string
+	MaxFillable decimal.Decimal
+}
+
+func (e *InsufficientLiquidityError) Error() string {
+	return INSUFFICIENT_LIQUIDITY
+}
+
+// UnknownProductError is returned when a product is requested that is not served.
+type UnknownProductError struct {
+	Product string
+}
+
+func (e *UnknownProductError) Error() string {
+	return fmt.Sprintf("Requested quote for feed '%s', but service is not serving this feed", e.Product)
+}
+
+// IsInsufficientLiquidity returns true if `err` is, or wraps, an InsufficientLiquidityError.
+func IsInsufficientLiquidity(err error) bool {
+	var liquidityErr *InsufficientLiquidityError
+	return errors.As(err, &liquidityErr)
+}
+
+// ErrNoRoute is returned when no chain of books converts one asset into another.
+var ErrNoRoute = errors.New("No route between the assets")
+
+var (
+	// ErrSequenceGap is returned when an order update skips exchange sequence numbers, the level 3 book
+	// then misses orders and needs a new snapshot
+	ErrSequenceGap = errors.New("Gap in the exchange sequence")
+	// ErrUnknownOrder is returned for an order that is not resting on the level 3 book
+	ErrUnknownOrder = errors.New("Order is not on the book")
+)
+
+var (
+	// ErrNoTrades is returned by a trade tape until the first trade is recorded
+	ErrNoTrades = errors.New("No trade was recorded yet")
+	// ErrInvalidWindow is returned for windows that are not positive or exceed the retention of the trade tape
+	ErrInvalidWindow = errors.New("Window invalid")
+)
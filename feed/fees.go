@@ -0,0 +1,110 @@
+package feed
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+
+	"github.com/shopspring/decimal"
+)
+
+// FeeTier holds the fees paid once the 30-day trading volume, in quote currency, reaches MinVolume.
+type FeeTier struct {
+	MinVolume decimal.Decimal `json:"minVolume"`
+	MakerBps  decimal.Decimal `json:"makerBps"`
+	TakerBps  decimal.Decimal `json:"takerBps"`
+}
+
+// FeeSchedule holds the fee tiers of a venue, along with the tiers of products that are charged
+// differently, and the 30-day volume that selects the tier. Market operations pay the taker fee.
+//
+// Schedules are loaded from JSON files such as:
+//
+//	{
+//	  "thirtyDayVolume": "25000",
+//	  "tiers": [
+//	    {"minVolume": "0", "makerBps": "40", "takerBps": "60"},
+//	    {"minVolume": "10000", "makerBps": "25", "takerBps": "40"}
+//	  ],
+//	  "products": {
+//	    "USDC-USD": [{"minVolume": "0", "makerBps": "0", "takerBps": "0"}]
+//	  }
+//	}
+type FeeSchedule struct {
+	ThirtyDayVolume decimal.Decimal       `json:"thirtyDayVolume"`
+	Tiers           []*FeeTier            `json:"tiers"`
+	Products        map[string][]*FeeTier `json:"products"`
+}
+
+// LoadFeeSchedule reads and validates the fee schedule at `path`.
+func LoadFeeSchedule(path string) (*FeeSchedule, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	schedule := &FeeSchedule{}
+	if err := json.NewDecoder(file).Decode(schedule); err != nil {
+		return nil, err
+	}
+	if err := schedule.validate(); err != nil {
+		return nil, err
+	}
+	return schedule, nil
+}
+
+func validateTiers(tiers []*FeeTier) error {
+	if len(tiers) == 0 {
+		return errors.New("Fee schedule has no tiers")
+	}
+	maxBps := decimal.NewFromInt(10000)
+	for _, tier := range tiers {
+		if tier.MinVolume.Sign() < 0 || tier.MakerBps.Sign() < 0 || tier.TakerBps.Sign() < 0 {
+			return errors.New("Fee tiers cannot be negative")
+		}
+		// A fee of the whole amount leaves nothing to quote
+		if tier.MakerBps.GreaterThanOrEqual(maxBps) || tier.TakerBps.GreaterThanOrEqual(maxBps) {
+			return errors.New("Fee tiers must be below 10000 bps")
+		}
+	}
+	// Lowest volume first, so that the last tier reached applies
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i].MinVolume.LessThan(tiers[j].MinVolume) })
+	if tiers[0].MinVolume.Sign() != 0 {
+		return errors.New("Fee schedule needs a tier starting at a volume of 0")
+	}
+	for idx := 1; idx < len(tiers); idx++ {
+		if tiers[idx].MinVolume.Equal(tiers[idx-1].MinVolume) {
+			return errors.New("Fee schedule has two tiers starting at the same volume")
+		}
+	}
+	return nil
+}
+
+func (fs *FeeSchedule) validate() error {
+	if err := validateTiers(fs.Tiers); err != nil {
+		return err
+	}
+	for _, tiers := range fs.Products {
+		if err := validateTiers(tiers); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Tier returns the tier of `product` at the schedule's 30-day volume.
+func (fs *FeeSchedule) Tier(product string) *FeeTier {
+	tiers, ok := fs.Products[product]
+	if !ok {
+		tiers = fs.Tiers
+	}
+	tier := tiers[0]
+	for _, candidate := range tiers[1:] {
+		if candidate.MinVolume.GreaterThan(fs.ThirtyDayVolume) {
+			break
+		}
+		tier = candidate
+	}
+	return tier
+}
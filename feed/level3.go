@@ -0,0 +1,387 @@
+package feed
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/btree"
+	"github.com/shopspring/decimal"
+	log "github.com/sirupsen/logrus"
+)
+
+// Order update types, named after the messages of the Coinbase Pro full channel.
+const (
+	ORDER_RECEIVED = "received"
+	ORDER_OPEN     = "open"
+	ORDER_DONE     = "done"
+	ORDER_MATCH    = "match"
+	ORDER_CHANGE   = "change"
+)
+
+// restingOrder is an order of a level 3 book, queued behind the orders that arrived before it at its price.
+type restingOrder struct {
+	id      string
+	side    string
+	size    decimal.Decimal
+	level   *orderLevel
+	element *list.Element
+}
+
+// orderLevel holds the orders resting at a single price, in arrival order.
+type orderLevel struct {
+	levelKey
+	Size   decimal.Decimal
+	orders *list.List
+}
+
+// orderSide is one side of a level 3 book. Levels are removed once their last order is, and the
+// number of orders resting on the side is kept as they are added and removed.
+type orderSide struct {
+	sortedSide
+	orderCount int
+}
+
+func newOrderSide(descending bool) *orderSide {
+	return &orderSide{sortedSide: newSortedSide(descending)}
+}
+
+// push queues `order` at the back of the level at `price`, creating the level if needed.
+func (sd *orderSide) push(order *restingOrder, price decimal.Decimal) {
+	level := sd.get(price)
+	if level == nil {
+		level = &orderLevel{levelKey: sd.keyAt(price), orders: list.New()}
+		sd.levels.ReplaceOrInsert(level)
+	}
+	order.level = level
+	order.element = level.orders.PushBack(order)
+	level.Size = level.Size.Add(order.size)
+	sd.orderCount++
+}
+
+// remove takes `order` out of its level, removing the level once it is empty.
+func (sd *orderSide) remove(order *restingOrder) {
+	level := order.level
+	level.orders.Remove(order.element)
+	level.Size = level.Size.Sub(order.size)
+	if level.orders.Len() == 0 {
+		sd.levels.Delete(level)
+	}
+	sd.orderCount--
+}
+
+// resize changes the size of `order` without changing its place in the queue.
+func (sd *orderSide) resize(order *restingOrder, size decimal.Decimal) {
+	order.level.Size = order.level.Size.Sub(order.size).Add(size)
+	order.size = size
+}
+
+func (sd *orderSide) get(price decimal.Decimal) *orderLevel {
+	item := sd.sortedSide.get(price)
+	if item == nil {
+		return nil
+	}
+	return item.(*orderLevel)
+}
+
+func (sd *orderSide) best() *orderLevel {
+	item := sd.bestItem()
+	if item == nil {
+		return nil
+	}
+	return item.(*orderLevel)
+}
+
+func (sd *orderSide) ascend(fn func(level *orderLevel) bool) {
+	sd.levels.Ascend(func(item btree.Item) bool {
+		return fn(item.(*orderLevel))
+	})
+}
+
+// OrderbookL3 is an order by order book, built from a snapshot and the updates that follow it in
+// exchange sequence. Unlike OrderbookFeed it knows every resting order, so it can tell how many
+// orders rest at a price and where an order stands in the queue.
+type OrderbookL3 struct {
+	ProductID      string
+	bids, asks     *orderSide
+	orders         map[string]*restingOrder
+	sequence       int64
+	lastEpochSeen  int64
+	updateLock     *sync.RWMutex
+	snapshotWasSet bool
+}
+
+// NewOrderbookL3 creates a new, empty, level 3 book.
+func NewOrderbookL3(productID string) *OrderbookL3 {
+	return &OrderbookL3{
+		ProductID:     productID,
+		bids:          newOrderSide(true),
+		asks:          newOrderSide(false),
+		orders:        make(map[string]*restingOrder),
+		lastEpochSeen: -1,
+		updateLock:    &sync.RWMutex{},
+	}
+}
+
+func (ob *OrderbookL3) selectSide(side string) *orderSide {
+	if side == BIDS {
+		return ob.bids
+	} else if side == ASKS {
+		return ob.asks
+	}
+	panic("Unsupported side: " + side)
+}
+
+func (ob *OrderbookL3) checkValid() error {
+	if !ob.snapshotWasSet {
+		return ErrNoSnapshot
+	}
+	if (time.Now().Unix() - ob.lastEpochSeen) > TIMEOUT_STALE_BOOK {
+		return ErrStaleBook
+	}
+	return nil
+}
+
+// open adds a new order at the back of the queue of its price.
+func (ob *OrderbookL3) open(update *OrderUpdate) {
+	if update.Side != BIDS && update.Side != ASKS {
+		log.WithField("side", update.Side).Errorln("Skipped order with an unknown side")
+		return
+	}
+	price, err := decimal.NewFromString(update.Price)
+	if err != nil {
+		log.WithField("msg", err.Error()).Errorln("Skipped order due to error")
+		return
+	}
+	size, err := decimal.NewFromString(update.Size)
+	if err != nil {
+		log.WithField("msg", err.Error()).Errorln("Skipped order due to error")
+		return
+	}
+	if previous, ok := ob.orders[update.OrderID]; ok {
+		ob.selectSide(previous.side).remove(previous)
+	}
+	if size.Sign() <= 0 {
+		delete(ob.orders, update.OrderID)
+		return
+	}
+	order := &restingOrder{id: update.OrderID, side: update.Side, size: size}
+	ob.selectSide(update.Side).push(order, price)
+	ob.orders[update.OrderID] = order
+}
+
+func (ob *OrderbookL3) remove(orderID string) {
+	if order, ok := ob.orders[orderID]; ok {
+		ob.selectSide(order.side).remove(order)
+		delete(ob.orders, orderID)
+	}
+}
+
+// resize sets the size of a resting order, removing it once nothing is left.
+func (ob *OrderbookL3) resize(orderID string, size decimal.Decimal) {
+	order, ok := ob.orders[orderID]
+	if !ok {
+		return
+	}
+	if size.Sign() <= 0 {
+		ob.remove(orderID)
+		return
+	}
+	ob.selectSide(order.side).resize(order, size)
+}
+
+// SetSnapshot resets the book with `orders`, in queue order, as of exchange `sequence`. Snapshots
+// older than the sequence already applied are skipped and return false, even once the book was
+// invalidated, since the updates that followed them are gone.
+func (ob *OrderbookL3) SetSnapshot(epoch, sequence int64, orders []*OrderUpdate) bool {
+	ob.updateLock.Lock()
+	defer ob.updateLock.Unlock()
+
+	if sequence <= ob.sequence {
+		log.WithField("sequence", ob.sequence).WithField("snapshotSequence", sequence).Warningln("Skipping an older level 3 snapshot")
+		return false
+	}
+	ob.bids = newOrderSide(true)
+	ob.asks = newOrderSide(false)
+	ob.orders = make(map[string]*restingOrder)
+	for _, order := range orders {
+		ob.open(order)
+	}
+	ob.sequence = sequence
+	if epoch > ob.lastEpochSeen {
+		ob.lastEpochSeen = epoch
+	}
+	ob.snapshotWasSet = true
+	return true
+}
+
+// Apply applies an update that follows the book in exchange sequence. Updates already part of the
+// book are skipped and return false. An update that skips sequence numbers is not applied and
+// returns ErrSequenceGap, the book then needs a new snapshot.
+func (ob *OrderbookL3) Apply(epoch int64, update *OrderUpdate) (bool, error) {
+	ob.updateLock.Lock()
+	defer ob.updateLock.Unlock()
+
+	if !ob.snapshotWasSet {
+		return false, ErrNoSnapshot
+	}
+	if update.Sequence <= ob.sequence {
+		return false, nil
+	}
+	if update.Sequence != ob.sequence+1 {
+		return false, fmt.Errorf("%w: expected %d, received %d", ErrSequenceGap, ob.sequence+1, update.Sequence)
+	}
+	ob.sequence = update.Sequence
+	if epoch > ob.lastEpochSeen {
+		ob.lastEpochSeen = epoch
+	}
+
+	switch update.Type {
+	case ORDER_OPEN:
+		ob.open(update)
+	case ORDER_DONE:
+		ob.remove(update.OrderID)
+	case ORDER_MATCH:
+		order, ok := ob.orders[update.OrderID]
+		if !ok {
+			return true, nil
+		}
+		size, err := decimal.NewFromString(update.Size)
+		if err != nil {
+			log.WithField("msg", err.Error()).Errorln("Skipped match due to error")
+			return true, nil
+		}
+		ob.resize(update.OrderID, order.size.Sub(size))
+	case ORDER_CHANGE:
+		size, err := decimal.NewFromString(update.Size)
+		if err != nil {
+			// Changes to market orders carry funds instead of a size, they never rest on the book
+			return true, nil
+		}
+		ob.resize(update.OrderID, size)
+	}
+	// Received orders only rest on the book once open
+	return true, nil
+}
+
+// Sequence returns the exchange sequence of the last update applied.
+func (ob *OrderbookL3) Sequence() int64 {
+	ob.updateLock.RLock()
+	defer ob.updateLock.RUnlock()
+	return ob.sequence
+}
+
+// CheckValid returns nil when the book can be queried, otherwise the reason it cannot.
+func (ob *OrderbookL3) CheckValid() error {
+	ob.updateLock.RLock()
+	defer ob.updateLock.RUnlock()
+	return ob.checkValid()
+}
+
+// Invalidate marks the book as out of sync. All queries fail until a new snapshot is set.
+func (ob *OrderbookL3) Invalidate() {
+	ob.updateLock.Lock()
+	defer ob.updateLock.Unlock()
+	ob.snapshotWasSet = false
+}
+
+// GetOrderCount returns the number of orders resting on the bids and asks.
+func (ob *OrderbookL3) GetOrderCount() (int, int) {
+	ob.updateLock.RLock()
+	defer ob.updateLock.RUnlock()
+	return ob.bids.orderCount, ob.asks.orderCount
+}
+
+func collectL3Levels(side *orderSide, depth int) []*L3Level {
+	var levels []*L3Level
+	side.ascend(func(level *orderLevel) bool {
+		if depth > 0 && len(levels) >= depth {
+			return false
+		}
+		levels = append(levels, &L3Level{Price: level.Price, Size: level.Size, Orders: level.orders.Len()})
+		return true
+	})
+	return levels
+}
+
+// GetDepth returns up to `depth` price levels per side, best price first, along with the number of
+// orders resting at each price. A depth of 0 returns every level.
+func (ob *OrderbookL3) GetDepth(depth int) (*L3Depth, int64, error) {
+	ob.updateLock.RLock()
+	defer ob.updateLock.RUnlock()
+
+	if err := ob.checkValid(); err != nil {
+		return nil, ob.lastEpochSeen, err
+	}
+	if depth < 0 {
+		return nil, ob.lastEpochSeen, ErrInvalidDepth
+	}
+	l3Depth := &L3Depth{
+		Bids: collectL3Levels(ob.bids, depth),
+		Asks: collectL3Levels(ob.asks, depth),
+	}
+	if bestBid, bestAsk := ob.bids.best(), ob.asks.best(); bestBid != nil && bestAsk != nil {
+		l3Depth.Mid = bestBid.Price.Add(bestAsk.Price).Div(decimal.NewFromInt(2))
+	}
+	return l3Depth, ob.lastEpochSeen, nil
+}
+
+// GetQueuePosition returns where the resting order `orderID` stands in the queue of its price.
+func (ob *OrderbookL3) GetQueuePosition(orderID string) (*QueuePosition, int64, error) {
+	ob.updateLock.RLock()
+	defer ob.updateLock.RUnlock()
+
+	if err := ob.checkValid(); err != nil {
+		return nil, ob.lastEpochSeen, err
+	}
+	order, ok := ob.orders[orderID]
+	if !ok {
+		return nil, ob.lastEpochSeen, fmt.Errorf("%w: %s", ErrUnknownOrder, orderID)
+	}
+	position := &QueuePosition{
+		OrderID:     orderID,
+		Side:        order.side,
+		Price:       order.level.Price,
+		Size:        order.size,
+		LevelOrders: order.level.orders.Len(),
+		LevelSize:   order.level.Size,
+	}
+	for element := order.level.orders.Front(); element != order.element; element = element.Next() {
+		position.OrdersAhead++
+		position.SizeAhead = position.SizeAhead.Add(element.Value.(*restingOrder).size)
+	}
+	return position, ob.lastEpochSeen, nil
+}
+
+// EstimateQueuePosition returns where a new order placed now at `price` on `side` would stand: behind
+// every order already resting at that price. Prices that would cross the book return ErrInvalidAmount.
+func (ob *OrderbookL3) EstimateQueuePosition(side string, price decimal.Decimal) (*QueuePosition, int64, error) {
+	ob.updateLock.RLock()
+	defer ob.updateLock.RUnlock()
+
+	if err := ob.checkValid(); err != nil {
+		return nil, ob.lastEpochSeen, err
+	}
+	if side != BIDS && side != ASKS {
+		return nil, ob.lastEpochSeen, fmt.Errorf("%w: %s", ErrUnsupportedOperation, side)
+	}
+	if price.Sign() <= 0 {
+		return nil, ob.lastEpochSeen, ErrInvalidAmount
+	}
+	if side == BIDS {
+		if bestAsk := ob.asks.best(); bestAsk != nil && price.GreaterThanOrEqual(bestAsk.Price) {
+			return nil, ob.lastEpochSeen, fmt.Errorf("%w: a bid at %s crosses the book", ErrInvalidAmount, price)
+		}
+	} else if bestBid := ob.bids.best(); bestBid != nil && price.LessThanOrEqual(bestBid.Price) {
+		return nil, ob.lastEpochSeen, fmt.Errorf("%w: an ask at %s crosses the book", ErrInvalidAmount, price)
+	}
+	position := &QueuePosition{Side: side, Price: price}
+	if level := ob.selectSide(side).get(price); level != nil {
+		position.OrdersAhead = level.orders.Len()
+		position.SizeAhead = level.Size
+		position.LevelOrders = level.orders.Len()
+		position.LevelSize = level.Size
+	}
+	return position, ob.lastEpochSeen, nil
+}
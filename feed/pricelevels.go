@@ -0,0 +1,111 @@
+package feed
+
+import (
+	"github.com/google/btree"
+	"github.com/shopspring/decimal"
+)
+
+// BTREE_DEGREE is the branching factor of the price level trees.
+const BTREE_DEGREE = 32
+
+// levelKey is the price of a level along with the key it is sorted by, which is the negated price
+// for bids so that both sides iterate from the best price outwards. Levels embed it, and it is used
+// on its own to look levels up by price.
+type levelKey struct {
+	Price   decimal.Decimal
+	sortKey decimal.Decimal
+}
+
+func (lk *levelKey) key() *levelKey {
+	return lk
+}
+
+// Less orders levels of any kind by their sort key.
+func (lk *levelKey) Less(than btree.Item) bool {
+	return lk.sortKey.LessThan(than.(sortedLevel).key().sortKey)
+}
+
+// sortedLevel is a price level stored in a sortedSide.
+type sortedLevel interface {
+	btree.Item
+	key() *levelKey
+}
+
+// sortedSide is one side of a book, stored as a B-tree of price levels best price first. Inserts,
+// lookups and removals are O(log n). It is shared by the level 2 and level 3 books, which store
+// levels of their own.
+type sortedSide struct {
+	levels     *btree.BTree
+	descending bool
+}
+
+func newSortedSide(descending bool) sortedSide {
+	return sortedSide{
+		levels:     btree.New(BTREE_DEGREE),
+		descending: descending,
+	}
+}
+
+// keyAt returns the key of the level at `price`.
+func (ss *sortedSide) keyAt(price decimal.Decimal) levelKey {
+	if ss.descending {
+		return levelKey{Price: price, sortKey: price.Neg()}
+	}
+	return levelKey{Price: price, sortKey: price}
+}
+
+// get returns the level at `price`, or nil if there is none.
+func (ss *sortedSide) get(price decimal.Decimal) btree.Item {
+	key := ss.keyAt(price)
+	return ss.levels.Get(&key)
+}
+
+// bestItem returns the level with the best price, or nil if the side is empty.
+func (ss *sortedSide) bestItem() btree.Item {
+	return ss.levels.Min()
+}
+
+func (ss *sortedSide) len() int {
+	return ss.levels.Len()
+}
+
+// priceLevel holds the aggregated size resting at a single price.
+type priceLevel struct {
+	levelKey
+	Size decimal.Decimal
+}
+
+// bookSide is one side of the orderbook. Zero-size levels are never stored.
+type bookSide struct {
+	sortedSide
+}
+
+func newBookSide(descending bool) *bookSide {
+	return &bookSide{sortedSide: newSortedSide(descending)}
+}
+
+// set replaces the size at a price level, removing the level if the size is zero.
+func (bs *bookSide) set(price, size decimal.Decimal) {
+	level := &priceLevel{levelKey: bs.keyAt(price), Size: size}
+	if size.Sign() <= 0 {
+		bs.levels.Delete(level)
+		return
+	}
+	bs.levels.ReplaceOrInsert(level)
+}
+
+// ascend calls fn for every level from the best price outwards, until fn returns false.
+func (bs *bookSide) ascend(fn func(level *priceLevel) bool) {
+	bs.levels.Ascend(func(item btree.Item) bool {
+		return fn(item.(*priceLevel))
+	})
+}
+
+// best returns the level with the best price, or nil if the side is empty.
+func (bs *bookSide) best() *priceLevel {
+	item := bs.bestItem()
+	if item == nil {
+		return nil
+	}
+	return item.(*priceLevel)
+}
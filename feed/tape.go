@@ -0,0 +1,146 @@
+package feed
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Taker sides of a Trade.
+const (
+	TRADE_BUY  = "buy"
+	TRADE_SELL = "sell"
+)
+
+// TradeTape keeps the recent trades of a product, oldest first. Trades older than the retention are
+// dropped, as are the oldest trades once more than `maxTrades` are kept. Trades are only dropped when
+// another one is added, so queries also leave out the trades that fell out of the retention since,
+// which happens in quiet markets.
+type TradeTape struct {
+	ProductID  string
+	retention  time.Duration
+	maxTrades  int
+	trades     []*Trade
+	lastID     int64
+	updateLock *sync.RWMutex
+}
+
+// NewTradeTape creates an empty tape keeping `retention` worth of trades, and at most `maxTrades`.
+func NewTradeTape(productID string, retention time.Duration, maxTrades int) *TradeTape {
+	return &TradeTape{
+		ProductID:  productID,
+		retention:  retention,
+		maxTrades:  maxTrades,
+		updateLock: &sync.RWMutex{},
+	}
+}
+
+// Add records `trade`. Trades are identified by their increasing TradeID, so a trade already recorded
+// or older than the last one is skipped and false is returned, for example the last match sent again
+// when resubscribing.
+func (tt *TradeTape) Add(trade *Trade) bool {
+	tt.updateLock.Lock()
+	defer tt.updateLock.Unlock()
+
+	if trade.TradeID <= tt.lastID {
+		return false
+	}
+	tt.lastID = trade.TradeID
+	tt.trades = append(tt.trades, trade)
+	tt.prune(trade.Time)
+	return true
+}
+
+// prune drops the trades that fell out of the retention as of `now`, and the oldest trades over maxTrades.
+func (tt *TradeTape) prune(now time.Time) {
+	// The dropped trades are released once append outgrows the array
+	tt.trades = tt.retained(now)
+	if len(tt.trades) > tt.maxTrades {
+		tt.trades = tt.trades[len(tt.trades)-tt.maxTrades:]
+	}
+}
+
+// retained returns the trades still within the retention as of `now`. The caller must hold the lock.
+func (tt *TradeTape) retained(now time.Time) []*Trade {
+	cutoff := now.Add(-tt.retention)
+	first := 0
+	for first < len(tt.trades) && tt.trades[first].Time.Before(cutoff) {
+		first++
+	}
+	return tt.trades[first:]
+}
+
+// LastTrade returns the most recent trade, unless it is older than the retention.
+func (tt *TradeTape) LastTrade() (*Trade, error) {
+	tt.updateLock.RLock()
+	defer tt.updateLock.RUnlock()
+	trades := tt.retained(time.Now())
+	if len(trades) == 0 {
+		return nil, ErrNoTrades
+	}
+	return trades[len(trades)-1], nil
+}
+
+// RecentTrades returns up to `limit` trades within the retention, most recent first, or all of them
+// if limit is 0.
+func (tt *TradeTape) RecentTrades(limit int) ([]*Trade, error) {
+	tt.updateLock.RLock()
+	defer tt.updateLock.RUnlock()
+	if limit < 0 {
+		return nil, ErrInvalidDepth
+	}
+	kept := tt.retained(time.Now())
+	if limit == 0 || limit > len(kept) {
+		limit = len(kept)
+	}
+	trades := make([]*Trade, limit)
+	for idx := range trades {
+		trades[idx] = kept[len(kept)-1-idx]
+	}
+	return trades, nil
+}
+
+// Trades returns the trades that happened at or after `since`, oldest first, leaving out those older
+// than the retention.
+func (tt *TradeTape) Trades(since time.Time) []*Trade {
+	tt.updateLock.RLock()
+	defer tt.updateLock.RUnlock()
+	kept := tt.retained(time.Now())
+	first := len(kept)
+	for first > 0 && !kept[first-1].Time.Before(since) {
+		first--
+	}
+	return append([]*Trade{}, kept[first:]...)
+}
+
+// Stats summarizes the trades of the `window` up to `now`. Windows longer than the retention of the
+// tape would silently miss trades, so they return ErrInvalidWindow.
+func (tt *TradeTape) Stats(window time.Duration, now time.Time) (*TradeStats, error) {
+	if window <= 0 || window > tt.retention {
+		return nil, fmt.Errorf("%w: %s, the tape keeps %s", ErrInvalidWindow, window, tt.retention)
+	}
+	stats := &TradeStats{Window: window}
+	for _, trade := range tt.Trades(now.Add(-window)) {
+		if trade.Time.After(now) {
+			break
+		}
+		stats.Trades++
+		stats.Volume = stats.Volume.Add(trade.Size)
+		stats.Notional = stats.Notional.Add(trade.Size.Mul(trade.Price))
+		if trade.Side == TRADE_BUY {
+			stats.BuyVolume = stats.BuyVolume.Add(trade.Size)
+		} else {
+			stats.SellVolume = stats.SellVolume.Add(trade.Size)
+		}
+		if stats.High.IsZero() || trade.Price.GreaterThan(stats.High) {
+			stats.High = trade.Price
+		}
+		if stats.Low.IsZero() || trade.Price.LessThan(stats.Low) {
+			stats.Low = trade.Price
+		}
+	}
+	if stats.Volume.Sign() > 0 {
+		stats.VWAP = stats.Notional.DivRound(stats.Volume, DIVISION_PRECISION)
+	}
+	return stats, nil
+}
@@ -1,18 +1,183 @@
 package feed
 
-import "time"
+import (
+	"time"
+
+	"github.com/shopspring/decimal"
+)
 
 type Update struct {
 	Price string
 	Size  string
 }
 
-type orderbookSortedKey struct {
-	Value float64
-	Key   string
+// TopOfBook is the best bid and ask of an orderbook.
+type TopOfBook struct {
+	BidPrice, BidSize decimal.Decimal
+	AskPrice, AskSize decimal.Decimal
+	Mid, Spread       decimal.Decimal
+}
+
+// Level is the aggregated size resting at a price.
+type Level struct {
+	Price, Size decimal.Decimal
+}
+
+// OrderbookDepth is a view of the price levels of an orderbook, best price first.
+// Mid is zero if either side of the book is empty.
+type OrderbookDepth struct {
+	Bids, Asks []*Level
+	Mid        decimal.Decimal
+}
+
+// Fill is the base size taken from a single price level by a quote.
+type Fill struct {
+	Price, Size decimal.Decimal
+}
+
+// Quote is the result of a simulated market operation. Amount is the result of the
+// operation, VWAP is expressed in quote per base and SlippageBps is the distance of the
+// VWAP from mid, positive when worse than mid. SlippageBps is zero if either side is empty.
+// Fee is the fee paid in quote currency, zero unless the quote was made net of fees, see QuoteWithFee.
+type Quote struct {
+	Amount      decimal.Decimal
+	Fills       []*Fill
+	VWAP        decimal.Decimal
+	WorstPrice  decimal.Decimal
+	SlippageBps decimal.Decimal
+	Fee         decimal.Decimal
 }
 
-type sortByOrderbookPrice []*orderbookSortedKey
+// LiquidityPoint is the liquidity available on one side of the book up to DistanceBps from mid.
+// Size is the executable base amount, Notional the quote amount it trades for, and AveragePrice
+// their ratio, zero when there is no liquidity within the distance.
+type LiquidityPoint struct {
+	DistanceBps  decimal.Decimal
+	LimitPrice   decimal.Decimal
+	Size         decimal.Decimal
+	Notional     decimal.Decimal
+	AveragePrice decimal.Decimal
+}
+
+// LiquidityCurve is the cumulative liquidity of both sides of the book, nearest distance first.
+type LiquidityCurve struct {
+	Mid  decimal.Decimal
+	Bids []*LiquidityPoint
+	Asks []*LiquidityPoint
+}
+
+// Fillable is how much of one side of the book can be executed within a limit. Size is the base
+// amount and Notional the quote amount it trades for. AveragePrice and WorstPrice are zero when
+// nothing can be filled.
+type Fillable struct {
+	Size         decimal.Decimal
+	Notional     decimal.Decimal
+	AveragePrice decimal.Decimal
+	WorstPrice   decimal.Decimal
+}
+
+// MaxFillable holds the base that can be bought from the asks and sold into the bids within a limit.
+type MaxFillable struct {
+	Buy  *Fillable
+	Sell *Fillable
+}
+
+// QuoteRequest is a single market operation of a batch, see OrderbookFeed.BatchQuote.
+// FeeBps is the taker fee to quote net of, zero quotes gross amounts.
+type QuoteRequest struct {
+	Operation string
+	Amount    decimal.Decimal
+	FeeBps    decimal.Decimal
+}
+
+// QuoteResult holds either the quote or the error for a QuoteRequest.
+type QuoteResult struct {
+	Quote *Quote
+	Err   error
+}
+
+// OrderUpdate is a change to a single order of a level 3 book, Type is one of the ORDER_ constants.
+// Side is BIDS or ASKS. Size is the remaining size for ORDER_OPEN and ORDER_DONE, the new size for
+// ORDER_CHANGE and the size traded with the resting order for ORDER_MATCH. Orders of a snapshot are
+// ORDER_OPEN updates, in queue order. Price and Size may be empty, for example for market orders.
+type OrderUpdate struct {
+	Type     string
+	Sequence int64
+	OrderID  string
+	Side     string
+	Price    string
+	Size     string
+}
+
+// L3Level is a price level of a level 3 book, Orders is the number of orders resting at the price.
+type L3Level struct {
+	Price, Size decimal.Decimal
+	Orders      int
+}
+
+// L3Depth is a view of the price levels of a level 3 book, best price first.
+// Mid is zero if either side of the book is empty.
+type L3Depth struct {
+	Bids, Asks []*L3Level
+	Mid        decimal.Decimal
+}
+
+// QueuePosition is where an order stands in the queue of its price level. OrdersAhead and SizeAhead
+// are what must trade, or be cancelled, at the same price before the order starts filling.
+type QueuePosition struct {
+	OrderID     string
+	Side        string
+	Price       decimal.Decimal
+	Size        decimal.Decimal
+	OrdersAhead int
+	SizeAhead   decimal.Decimal
+	LevelOrders int
+	LevelSize   decimal.Decimal
+}
+
+// Trade is an execution reported by the exchange. Side is the side of the taker, TRADE_BUY when a
+// resting ask was lifted and TRADE_SELL when a resting bid was hit.
+type Trade struct {
+	TradeID int64
+	Side    string
+	Price   decimal.Decimal
+	Size    decimal.Decimal
+	Time    time.Time
+}
+
+// TradeStats summarizes the trades of a rolling window. Volume is in base and Notional in quote.
+// VWAP, High and Low are zero when no trade happened within the window.
+type TradeStats struct {
+	Window     time.Duration
+	Trades     int
+	Volume     decimal.Decimal
+	BuyVolume  decimal.Decimal
+	SellVolume decimal.Decimal
+	Notional   decimal.Decimal
+	VWAP       decimal.Decimal
+	High       decimal.Decimal
+	Low        decimal.Decimal
+}
+
+// Candle summarizes the trades and the book mid of the interval starting at Start. Open, High, Low and
+// Close are trade prices, Volume is in base and Notional in quote. The Mid prices are sampled from the
+// book every time it changes, MidOpen is the mid as the interval started when it was already known.
+// An interval without trades is flat at the previous close, with no volume.
+type Candle struct {
+	Interval time.Duration
+	Start    time.Time
+	Open     decimal.Decimal
+	High     decimal.Decimal
+	Low      decimal.Decimal
+	Close    decimal.Decimal
+	Volume   decimal.Decimal
+	Notional decimal.Decimal
+	Trades   int
+	MidOpen  decimal.Decimal
+	MidHigh  decimal.Decimal
+	MidLow   decimal.Decimal
+	MidClose decimal.Decimal
+}
 
 type LevelTwoOrderbook struct {
 	Bids [][]interface{} `json:"bids"`
@@ -46,7 +211,48 @@ type L2SnapshotMessage struct {
 	Asks      [][]string `json:"asks"`
 }
 
+// L3SnapshotMessage is the level 3 book returned by the Coinbase Pro REST API. Orders are
+// [price, size, order_id] triplets, in queue order.
+type L3SnapshotMessage struct {
+	Sequence int64      `json:"sequence"`
+	Bids     [][]string `json:"bids"`
+	Asks     [][]string `json:"asks"`
+}
+
+// FullChannelMessage is any of the received, open, done, match and change messages of the full
+// channel. Match messages name the resting order MakerOrderID, the other messages OrderID. Match
+// and last_match messages are also sent on the matches channel.
+type FullChannelMessage struct {
+	WebsocketType
+	ProductID     string    `json:"product_id"`
+	Sequence      int64     `json:"sequence"`
+	TradeID       int64     `json:"trade_id"`
+	Time          time.Time `json:"time"`
+	Side          string    `json:"side"`
+	OrderID       string    `json:"order_id"`
+	MakerOrderID  string    `json:"maker_order_id"`
+	Price         string    `json:"price"`
+	Size          string    `json:"size"`
+	RemainingSize string    `json:"remaining_size"`
+	NewSize       string    `json:"new_size"`
+	Reason        string    `json:"reason"`
+}
+
 type OrderbookModel interface {
 	SetSnapshot(epoch int64, bids []*Update, asks []*Update) bool
 	WriteUpdate(epoch int64, bids []*Update, asks []*Update) bool
 }
+
+type HeartbeatMessage struct {
+	WebsocketType
+	ProductID   string    `json:"product_id"`
+	Sequence    int64     `json:"sequence"`
+	LastTradeID int64     `json:"last_trade_id"`
+	Time        time.Time `json:"time"`
+}
+
+type ErrorMessage struct {
+	WebsocketType
+	Message string `json:"message"`
+	Reason  string `json:"reason"`
+}
@@ -5,10 +5,13 @@ go 1.15
 require (
 	github.com/fullstorydev/grpcurl v1.7.0 // indirect
 	github.com/golang/protobuf v1.4.2
+	github.com/google/btree v1.0.0
 	github.com/google/uuid v1.1.2
 	github.com/gorilla/websocket v1.4.2
 	github.com/prometheus/client_golang v1.7.1
+	github.com/shopspring/decimal v1.2.0
 	github.com/sirupsen/logrus v1.7.0
+	google.golang.org/genproto v0.0.0-20200331122359-1ee6d9798940
 	google.golang.org/grpc v1.33.0
 	google.golang.org/grpc/cmd/protoc-gen-go-grpc v1.0.0 // indirect
 	google.golang.org/protobuf v1.23.0
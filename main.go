@@ -5,22 +5,89 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"pirosb3/real_feed/controller"
+	"pirosb3/real_feed/datasource"
+	"pirosb3/real_feed/feed"
 	"pirosb3/real_feed/rpc"
+	"strconv"
+	"strings"
+	"syscall"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 func main() {
-	market := os.Getenv("MARKET")
+	// MARKETS is a comma separated list of products, MARKET is still supported for a single product
+	markets := os.Getenv("MARKETS")
+	if markets == "" {
+		markets = os.Getenv("MARKET")
+	}
+	products := strings.Split(markets, ",")
+	websocketURL := os.Getenv("WEBSOCKET_URL")
+	if websocketURL == "" {
+		websocketURL = datasource.COINBASE_PRO_URL
+	}
 	port := "8000"
-	ctx, _ := context.WithCancel(context.Background())
+	ctx, cancelFn := context.WithCancel(context.Background())
+	defer cancelFn()
+
+	// Either replay a recording from REPLAY_FILE, or connect to the live websocket and
+	// optionally record every message to RECORD_FILE
+	var source datasource.MultiProductSource
+	if replayFile := os.Getenv("REPLAY_FILE"); replayFile != "" {
+		// Recordings only hold the level2 and matches channels, level 3 books cannot be replayed
+		if os.Getenv("LEVEL3") == "true" {
+			log.Fatalln("LEVEL3 cannot be combined with REPLAY_FILE, recordings hold no level 3 messages")
+		}
+		speed := 1.0
+		if replaySpeed := os.Getenv("REPLAY_SPEED"); replaySpeed != "" {
+			parsedSpeed, err := strconv.ParseFloat(replaySpeed, 64)
+			if err != nil {
+				log.Fatalln(err.Error())
+			}
+			speed = parsedSpeed
+		}
+		log.WithField("path", replayFile).WithField("speed", speed).Infoln("Replaying recording")
+		source = datasource.NewReplaySource(ctx, replayFile, speed)
+	} else {
+		websocket := datasource.NewCoinbaseProWebsocket(ctx, websocketURL, products...)
+		// RECONNECT_MAX_ATTEMPTS makes the websocket give up, and the markets stop quoting, after that many failed reconnections
+		if maxAttempts := os.Getenv("RECONNECT_MAX_ATTEMPTS"); maxAttempts != "" {
+			parsedMaxAttempts, err := strconv.Atoi(maxAttempts)
+			if err != nil {
+				log.Fatalln(err.Error())
+			}
+			policy := datasource.DefaultReconnectPolicy
+			policy.MaxAttempts = parsedMaxAttempts
+			websocket.SetReconnectPolicy(policy)
+		}
+		if recordFile := os.Getenv("RECORD_FILE"); recordFile != "" {
+			recorder, err := datasource.NewRecorder(recordFile)
+			if err != nil {
+				log.Fatalln(err.Error())
+			}
+			defer recorder.Close()
+			websocket.SetRecorder(recorder)
+		}
+		source = websocket
+	}
 
-	// Start feed controller
-	fc := controller.NewFeedController(ctx, market)
-	fc.Start()
+	// Start one feed controller per product, all sharing a single source
+	demux := datasource.NewDemultiplexer(ctx, source)
+	feedControllers := make(map[string]*controller.FeedController)
+	for _, product := range products {
+		feedControllers[product] = controller.NewFeedController(ctx, product, demux.Source(product))
+	}
+	for product, fc := range feedControllers {
+		if err := fc.Start(); err != nil {
+			log.WithField("market", product).Fatalln(err.Error())
+		}
+	}
 
 	// Start prometheus server
 	go func() {
@@ -28,17 +95,125 @@ func main() {
 		http.ListenAndServe(":2112", nil)
 	}()
 
-	// Create wrapper service
-	orderbookController := controller.NewOrderbookGrpcController(fc, market)
+	// FEE_SCHEDULE_FILE enables quotes net of fees
+	var feeSchedule *feed.FeeSchedule
+	if feeScheduleFile := os.Getenv("FEE_SCHEDULE_FILE"); feeScheduleFile != "" {
+		loadedSchedule, err := feed.LoadFeeSchedule(feeScheduleFile)
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+		feeSchedule = loadedSchedule
+	}
+
+	// Create wrapper services, v1 is kept for existing clients
+	orderbookController := controller.NewOrderbookGrpcController(feedControllers)
+	orderbookControllerV2 := controller.NewOrderbookGrpcControllerV2(feedControllers, feeSchedule)
+
+	// VENUES is a comma separated list of name=url of other Coinbase compatible websockets quoting
+	// the same markets. PlanExecution splits operations across them and the books above, named VENUE,
+	// and GetConsolidatedOrderbook merges them into one book. VENUE_FEE_SCHEDULE_FILES is a comma
+	// separated list of name=path of the fee schedule of each other venue, VENUE pays FEE_SCHEDULE_FILE
+	if venues := os.Getenv("VENUES"); venues != "" {
+		primaryVenue := os.Getenv("VENUE")
+		if primaryVenue == "" {
+			primaryVenue = controller.DEFAULT_VENUE
+		}
+		venueControllers := map[string]map[string]*controller.FeedController{primaryVenue: feedControllers}
+		for _, venue := range strings.Split(venues, ",") {
+			nameAndURL := strings.SplitN(venue, "=", 2)
+			if len(nameAndURL) != 2 {
+				log.Fatalf("Venue '%s' should be name=url", venue)
+			}
+			if _, ok := venueControllers[nameAndURL[0]]; ok {
+				log.Fatalf("Venue '%s' is configured twice", nameAndURL[0])
+			}
+			venueControllers[nameAndURL[0]] = startVenue(ctx, nameAndURL[1], products)
+			log.WithField("venue", nameAndURL[0]).WithField("url", nameAndURL[1]).Infoln("Routing across venue")
+		}
+		orderbookControllerV2.SetSmartOrderRouter(controller.NewSmartOrderRouter(venueControllers))
+
+		venueFees := map[string]*feed.FeeSchedule{primaryVenue: feeSchedule}
+		if venueFeeScheduleFiles := os.Getenv("VENUE_FEE_SCHEDULE_FILES"); venueFeeScheduleFiles != "" {
+			for _, venueFeeSchedule := range strings.Split(venueFeeScheduleFiles, ",") {
+				nameAndPath := strings.SplitN(venueFeeSchedule, "=", 2)
+				if len(nameAndPath) != 2 {
+					log.Fatalf("Venue fee schedule '%s' should be name=path", venueFeeSchedule)
+				}
+				if _, ok := venueControllers[nameAndPath[0]]; !ok {
+					log.Fatalf("Fee schedule given for unknown venue '%s'", nameAndPath[0])
+				}
+				loadedSchedule, err := feed.LoadFeeSchedule(nameAndPath[1])
+				if err != nil {
+					log.Fatalln(err.Error())
+				}
+				venueFees[nameAndPath[0]] = loadedSchedule
+			}
+		}
+		orderbookControllerV2.SetVenueFeeSchedules(venueFees)
+	}
+
+	// LEVEL3 keeps an order by order book of every market from the full channel, on a websocket of its
+	// own, with snapshots from the REST API at REST_URL
+	var orderFeedControllers map[string]*controller.OrderFeedController
+	if os.Getenv("LEVEL3") == "true" {
+		restURL := os.Getenv("REST_URL")
+		if restURL == "" {
+			restURL = datasource.COINBASE_PRO_REST_URL
+		}
+		fullChannel := datasource.NewDemultiplexer(ctx, datasource.NewCoinbaseProFullChannelWebsocket(ctx, websocketURL, restURL, products...))
+		orderFeedControllers = make(map[string]*controller.OrderFeedController)
+		for _, product := range products {
+			orderFeedControllers[product] = controller.NewOrderFeedController(ctx, product, fullChannel.Source(product))
+		}
+		for product, oc := range orderFeedControllers {
+			if err := oc.Start(); err != nil {
+				log.WithField("market", product).Fatalln(err.Error())
+			}
+		}
+		orderbookControllerV2.SetOrderFeedControllers(orderFeedControllers)
+	}
 
 	// Start gRPC server
 	grpcServer := grpc.NewServer()
 	rpc.RegisterOrderbookServiceServer(grpcServer, *orderbookController)
+	rpc.RegisterOrderbookServiceV2Server(grpcServer, *orderbookControllerV2)
+
+	// Report the health of every market through the standard gRPC health service
+	healthServer := health.NewServer()
+	healthpb.RegisterHealthServer(grpcServer, healthServer)
+	healthReporter := controller.NewHealthReporter(ctx, healthServer, feedControllers)
+	healthReporter.SetOrderFeedControllers(orderFeedControllers)
+	healthReporter.Start()
 	// ... // determine whether to use TLS
 	lis, err := net.Listen("tcp", ":"+port)
 	if err != nil {
 		log.Fatalln(err.Error())
 	}
-	log.WithField("market", market).WithField("port", port).Infoln("Starting gRPC server")
+
+	// Stop serving on SIGINT or SIGTERM, so that deferred cleanup such as closing a recording runs
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+		log.Warningln("Shutting down gRPC server")
+		healthServer.Shutdown()
+		grpcServer.GracefulStop()
+	}()
+	log.WithField("markets", markets).WithField("port", port).Infoln("Starting gRPC server")
 	grpcServer.Serve(lis)
 }
+
+// startVenue starts one feed controller per product, fed by the websocket at `websocketURL`.
+func startVenue(ctx context.Context, websocketURL string, products []string) map[string]*controller.FeedController {
+	demux := datasource.NewDemultiplexer(ctx, datasource.NewCoinbaseProWebsocket(ctx, websocketURL, products...))
+	feedControllers := make(map[string]*controller.FeedController)
+	for _, product := range products {
+		feedControllers[product] = controller.NewFeedController(ctx, product, demux.Source(product))
+	}
+	for product, fc := range feedControllers {
+		if err := fc.Start(); err != nil {
+			log.WithField("market", product).Fatalln(err.Error())
+		}
+	}
+	return feedControllers
+}
@@ -22,6 +22,10 @@ type OrderbookServiceClient interface {
 	BuyQuote(ctx context.Context, in *PricingRequest, opts ...grpc.CallOption) (*PricingResponse, error)
 	SellBase(ctx context.Context, in *PricingRequest, opts ...grpc.CallOption) (*PricingResponse, error)
 	SellQuote(ctx context.Context, in *PricingRequest, opts ...grpc.CallOption) (*PricingResponse, error)
+	// Pushes the top of the book every time the book changes
+	StreamTopOfBook(ctx context.Context, in *TopOfBookRequest, opts ...grpc.CallOption) (OrderbookService_StreamTopOfBookClient, error)
+	// Returns the price levels of the book
+	GetOrderbook(ctx context.Context, in *OrderbookRequest, opts ...grpc.CallOption) (*OrderbookResponse, error)
 }
 
 type orderbookServiceClient struct {
@@ -68,6 +72,47 @@ func (c *orderbookServiceClient) SellQuote(ctx context.Context, in *PricingReque
 	return out, nil
 }
 
+func (c *orderbookServiceClient) StreamTopOfBook(ctx context.Context, in *TopOfBookRequest, opts ...grpc.CallOption) (OrderbookService_StreamTopOfBookClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_OrderbookService_serviceDesc.Streams[0], "/OrderbookService/StreamTopOfBook", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &orderbookServiceStreamTopOfBookClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type OrderbookService_StreamTopOfBookClient interface {
+	Recv() (*TopOfBookResponse, error)
+	grpc.ClientStream
+}
+
+type orderbookServiceStreamTopOfBookClient struct {
+	grpc.ClientStream
+}
+
+func (x *orderbookServiceStreamTopOfBookClient) Recv() (*TopOfBookResponse, error) {
+	m := new(TopOfBookResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *orderbookServiceClient) GetOrderbook(ctx context.Context, in *OrderbookRequest, opts ...grpc.CallOption) (*OrderbookResponse, error) {
+	out := new(OrderbookResponse)
+	err := c.cc.Invoke(ctx, "/OrderbookService/GetOrderbook", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // OrderbookServiceServer is the server API for OrderbookService service.
 // All implementations must embed UnimplementedOrderbookServiceServer
 // for forward compatibility
@@ -77,6 +122,10 @@ type OrderbookServiceServer interface {
 	BuyQuote(context.Context, *PricingRequest) (*PricingResponse, error)
 	SellBase(context.Context, *PricingRequest) (*PricingResponse, error)
 	SellQuote(context.Context, *PricingRequest) (*PricingResponse, error)
+	// Pushes the top of the book every time the book changes
+	StreamTopOfBook(*TopOfBookRequest, OrderbookService_StreamTopOfBookServer) error
+	// Returns the price levels of the book
+	GetOrderbook(context.Context, *OrderbookRequest) (*OrderbookResponse, error)
 	mustEmbedUnimplementedOrderbookServiceServer()
 }
 
@@ -96,6 +145,12 @@ func (UnimplementedOrderbookServiceServer) SellBase(context.Context, *PricingReq
 func (UnimplementedOrderbookServiceServer) SellQuote(context.Context, *PricingRequest) (*PricingResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method SellQuote not implemented")
 }
+func (UnimplementedOrderbookServiceServer) StreamTopOfBook(*TopOfBookRequest, OrderbookService_StreamTopOfBookServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamTopOfBook not implemented")
+}
+func (UnimplementedOrderbookServiceServer) GetOrderbook(context.Context, *OrderbookRequest) (*OrderbookResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetOrderbook not implemented")
+}
 func (UnimplementedOrderbookServiceServer) mustEmbedUnimplementedOrderbookServiceServer() {}
 
 // UnsafeOrderbookServiceServer may be embedded to opt out of forward compatibility for this service.
@@ -181,6 +236,45 @@ func _OrderbookService_SellQuote_Handler(srv interface{}, ctx context.Context, d
 	return interceptor(ctx, in, info, handler)
 }
 
+func _OrderbookService_StreamTopOfBook_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(TopOfBookRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(OrderbookServiceServer).StreamTopOfBook(m, &orderbookServiceStreamTopOfBookServer{stream})
+}
+
+type OrderbookService_StreamTopOfBookServer interface {
+	Send(*TopOfBookResponse) error
+	grpc.ServerStream
+}
+
+type orderbookServiceStreamTopOfBookServer struct {
+	grpc.ServerStream
+}
+
+func (x *orderbookServiceStreamTopOfBookServer) Send(m *TopOfBookResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _OrderbookService_GetOrderbook_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(OrderbookRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OrderbookServiceServer).GetOrderbook(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/OrderbookService/GetOrderbook",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OrderbookServiceServer).GetOrderbook(ctx, req.(*OrderbookRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 var _OrderbookService_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "OrderbookService",
 	HandlerType: (*OrderbookServiceServer)(nil),
@@ -201,7 +295,857 @@ var _OrderbookService_serviceDesc = grpc.ServiceDesc{
 			MethodName: "SellQuote",
 			Handler:    _OrderbookService_SellQuote_Handler,
 		},
+		{
+			MethodName: "GetOrderbook",
+			Handler:    _OrderbookService_GetOrderbook_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamTopOfBook",
+			Handler:       _OrderbookService_StreamTopOfBook_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "service.proto",
+}
+
+// OrderbookServiceV2Client is the client API for OrderbookServiceV2 service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type OrderbookServiceV2Client interface {
+	BuyBase(ctx context.Context, in *QuoteRequest, opts ...grpc.CallOption) (*QuoteResponse, error)
+	BuyQuote(ctx context.Context, in *QuoteRequest, opts ...grpc.CallOption) (*QuoteResponse, error)
+	SellBase(ctx context.Context, in *QuoteRequest, opts ...grpc.CallOption) (*QuoteResponse, error)
+	SellQuote(ctx context.Context, in *QuoteRequest, opts ...grpc.CallOption) (*QuoteResponse, error)
+	// Pushes the top of the book every time the book changes
+	StreamTopOfBook(ctx context.Context, in *TopOfBookRequest, opts ...grpc.CallOption) (OrderbookServiceV2_StreamTopOfBookClient, error)
+	// Returns the price levels of the book
+	GetOrderbook(ctx context.Context, in *OrderbookRequest, opts ...grpc.CallOption) (*OrderbookResponse, error)
+	// Prices several operations and amounts against the same version of the book
+	BatchQuote(ctx context.Context, in *BatchQuoteRequest, opts ...grpc.CallOption) (*BatchQuoteResponse, error)
+	// Returns the size executable on each side within several distances from mid
+	GetLiquidityCurve(ctx context.Context, in *LiquidityCurveRequest, opts ...grpc.CallOption) (*LiquidityCurveResponse, error)
+	// Returns how much can be bought and sold within a limit price or a maximum slippage
+	GetMaxFillable(ctx context.Context, in *MaxFillableRequest, opts ...grpc.CallOption) (*MaxFillableResponse, error)
+	// Converts an amount of one asset into another through the best route among the books served
+	QuoteRoute(ctx context.Context, in *RouteQuoteRequest, opts ...grpc.CallOption) (*RouteQuoteResponse, error)
+	PlanExecution(ctx context.Context, in *ExecutionRequest, opts ...grpc.CallOption) (*ExecutionResponse, error)
+	GetConsolidatedOrderbook(ctx context.Context, in *OrderbookRequest, opts ...grpc.CallOption) (*ConsolidatedOrderbookResponse, error)
+	// Prices a market operation against the consolidated book as if it were a single book
+	QuoteConsolidated(ctx context.Context, in *ConsolidatedQuoteRequest, opts ...grpc.CallOption) (*ConsolidatedQuoteResponse, error)
+	// Only served for the markets with a level 3 book
+	GetOrderbookL3(ctx context.Context, in *OrderbookL3Request, opts ...grpc.CallOption) (*OrderbookL3Response, error)
+	GetQueuePosition(ctx context.Context, in *QueuePositionRequest, opts ...grpc.CallOption) (*QueuePositionResponse, error)
+	GetLastTrade(ctx context.Context, in *TradesRequest, opts ...grpc.CallOption) (*LastTradeResponse, error)
+	GetRecentTrades(ctx context.Context, in *TradesRequest, opts ...grpc.CallOption) (*TradesResponse, error)
+	GetTradeStats(ctx context.Context, in *TradeStatsRequest, opts ...grpc.CallOption) (*TradeStatsResponse, error)
+	GetCandles(ctx context.Context, in *CandlesRequest, opts ...grpc.CallOption) (*CandlesResponse, error)
+	// Sends every candle of the requested intervals as it closes
+	StreamCandles(ctx context.Context, in *CandlesStreamRequest, opts ...grpc.CallOption) (OrderbookServiceV2_StreamCandlesClient, error)
+}
+
+type orderbookServiceV2Client struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewOrderbookServiceV2Client(cc grpc.ClientConnInterface) OrderbookServiceV2Client {
+	return &orderbookServiceV2Client{cc}
+}
+
+func (c *orderbookServiceV2Client) BuyBase(ctx context.Context, in *QuoteRequest, opts ...grpc.CallOption) (*QuoteResponse, error) {
+	out := new(QuoteResponse)
+	err := c.cc.Invoke(ctx, "/OrderbookServiceV2/BuyBase", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *orderbookServiceV2Client) BuyQuote(ctx context.Context, in *QuoteRequest, opts ...grpc.CallOption) (*QuoteResponse, error) {
+	out := new(QuoteResponse)
+	err := c.cc.Invoke(ctx, "/OrderbookServiceV2/BuyQuote", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *orderbookServiceV2Client) SellBase(ctx context.Context, in *QuoteRequest, opts ...grpc.CallOption) (*QuoteResponse, error) {
+	out := new(QuoteResponse)
+	err := c.cc.Invoke(ctx, "/OrderbookServiceV2/SellBase", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *orderbookServiceV2Client) SellQuote(ctx context.Context, in *QuoteRequest, opts ...grpc.CallOption) (*QuoteResponse, error) {
+	out := new(QuoteResponse)
+	err := c.cc.Invoke(ctx, "/OrderbookServiceV2/SellQuote", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *orderbookServiceV2Client) StreamTopOfBook(ctx context.Context, in *TopOfBookRequest, opts ...grpc.CallOption) (OrderbookServiceV2_StreamTopOfBookClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_OrderbookServiceV2_serviceDesc.Streams[0], "/OrderbookServiceV2/StreamTopOfBook", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &orderbookServiceV2StreamTopOfBookClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type OrderbookServiceV2_StreamTopOfBookClient interface {
+	Recv() (*TopOfBookResponse, error)
+	grpc.ClientStream
+}
+
+type orderbookServiceV2StreamTopOfBookClient struct {
+	grpc.ClientStream
+}
+
+func (x *orderbookServiceV2StreamTopOfBookClient) Recv() (*TopOfBookResponse, error) {
+	m := new(TopOfBookResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *orderbookServiceV2Client) GetOrderbook(ctx context.Context, in *OrderbookRequest, opts ...grpc.CallOption) (*OrderbookResponse, error) {
+	out := new(OrderbookResponse)
+	err := c.cc.Invoke(ctx, "/OrderbookServiceV2/GetOrderbook", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *orderbookServiceV2Client) BatchQuote(ctx context.Context, in *BatchQuoteRequest, opts ...grpc.CallOption) (*BatchQuoteResponse, error) {
+	out := new(BatchQuoteResponse)
+	err := c.cc.Invoke(ctx, "/OrderbookServiceV2/BatchQuote", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *orderbookServiceV2Client) GetLiquidityCurve(ctx context.Context, in *LiquidityCurveRequest, opts ...grpc.CallOption) (*LiquidityCurveResponse, error) {
+	out := new(LiquidityCurveResponse)
+	err := c.cc.Invoke(ctx, "/OrderbookServiceV2/GetLiquidityCurve", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *orderbookServiceV2Client) GetMaxFillable(ctx context.Context, in *MaxFillableRequest, opts ...grpc.CallOption) (*MaxFillableResponse, error) {
+	out := new(MaxFillableResponse)
+	err := c.cc.Invoke(ctx, "/OrderbookServiceV2/GetMaxFillable", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *orderbookServiceV2Client) QuoteRoute(ctx context.Context, in *RouteQuoteRequest, opts ...grpc.CallOption) (*RouteQuoteResponse, error) {
+	out := new(RouteQuoteResponse)
+	err := c.cc.Invoke(ctx, "/OrderbookServiceV2/QuoteRoute", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *orderbookServiceV2Client) PlanExecution(ctx context.Context, in *ExecutionRequest, opts ...grpc.CallOption) (*ExecutionResponse, error) {
+	out := new(ExecutionResponse)
+	err := c.cc.Invoke(ctx, "/OrderbookServiceV2/PlanExecution", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *orderbookServiceV2Client) GetConsolidatedOrderbook(ctx context.Context, in *OrderbookRequest, opts ...grpc.CallOption) (*ConsolidatedOrderbookResponse, error) {
+	out := new(ConsolidatedOrderbookResponse)
+	err := c.cc.Invoke(ctx, "/OrderbookServiceV2/GetConsolidatedOrderbook", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *orderbookServiceV2Client) QuoteConsolidated(ctx context.Context, in *ConsolidatedQuoteRequest, opts ...grpc.CallOption) (*ConsolidatedQuoteResponse, error) {
+	out := new(ConsolidatedQuoteResponse)
+	err := c.cc.Invoke(ctx, "/OrderbookServiceV2/QuoteConsolidated", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *orderbookServiceV2Client) GetOrderbookL3(ctx context.Context, in *OrderbookL3Request, opts ...grpc.CallOption) (*OrderbookL3Response, error) {
+	out := new(OrderbookL3Response)
+	err := c.cc.Invoke(ctx, "/OrderbookServiceV2/GetOrderbookL3", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *orderbookServiceV2Client) GetQueuePosition(ctx context.Context, in *QueuePositionRequest, opts ...grpc.CallOption) (*QueuePositionResponse, error) {
+	out := new(QueuePositionResponse)
+	err := c.cc.Invoke(ctx, "/OrderbookServiceV2/GetQueuePosition", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *orderbookServiceV2Client) GetLastTrade(ctx context.Context, in *TradesRequest, opts ...grpc.CallOption) (*LastTradeResponse, error) {
+	out := new(LastTradeResponse)
+	err := c.cc.Invoke(ctx, "/OrderbookServiceV2/GetLastTrade", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *orderbookServiceV2Client) GetRecentTrades(ctx context.Context, in *TradesRequest, opts ...grpc.CallOption) (*TradesResponse, error) {
+	out := new(TradesResponse)
+	err := c.cc.Invoke(ctx, "/OrderbookServiceV2/GetRecentTrades", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *orderbookServiceV2Client) GetTradeStats(ctx context.Context, in *TradeStatsRequest, opts ...grpc.CallOption) (*TradeStatsResponse, error) {
+	out := new(TradeStatsResponse)
+	err := c.cc.Invoke(ctx, "/OrderbookServiceV2/GetTradeStats", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *orderbookServiceV2Client) GetCandles(ctx context.Context, in *CandlesRequest, opts ...grpc.CallOption) (*CandlesResponse, error) {
+	out := new(CandlesResponse)
+	err := c.cc.Invoke(ctx, "/OrderbookServiceV2/GetCandles", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *orderbookServiceV2Client) StreamCandles(ctx context.Context, in *CandlesStreamRequest, opts ...grpc.CallOption) (OrderbookServiceV2_StreamCandlesClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_OrderbookServiceV2_serviceDesc.Streams[1], "/OrderbookServiceV2/StreamCandles", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &orderbookServiceV2StreamCandlesClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type OrderbookServiceV2_StreamCandlesClient interface {
+	Recv() (*Candle, error)
+	grpc.ClientStream
+}
+
+type orderbookServiceV2StreamCandlesClient struct {
+	grpc.ClientStream
+}
+
+func (x *orderbookServiceV2StreamCandlesClient) Recv() (*Candle, error) {
+	m := new(Candle)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// OrderbookServiceV2Server is the server API for OrderbookServiceV2 service.
+// All implementations must embed UnimplementedOrderbookServiceV2Server
+// for forward compatibility
+type OrderbookServiceV2Server interface {
+	BuyBase(context.Context, *QuoteRequest) (*QuoteResponse, error)
+	BuyQuote(context.Context, *QuoteRequest) (*QuoteResponse, error)
+	SellBase(context.Context, *QuoteRequest) (*QuoteResponse, error)
+	SellQuote(context.Context, *QuoteRequest) (*QuoteResponse, error)
+	// Pushes the top of the book every time the book changes
+	StreamTopOfBook(*TopOfBookRequest, OrderbookServiceV2_StreamTopOfBookServer) error
+	// Returns the price levels of the book
+	GetOrderbook(context.Context, *OrderbookRequest) (*OrderbookResponse, error)
+	// Prices several operations and amounts against the same version of the book
+	BatchQuote(context.Context, *BatchQuoteRequest) (*BatchQuoteResponse, error)
+	// Returns the size executable on each side within several distances from mid
+	GetLiquidityCurve(context.Context, *LiquidityCurveRequest) (*LiquidityCurveResponse, error)
+	// Returns how much can be bought and sold within a limit price or a maximum slippage
+	GetMaxFillable(context.Context, *MaxFillableRequest) (*MaxFillableResponse, error)
+	// Converts an amount of one asset into another through the best route among the books served
+	QuoteRoute(context.Context, *RouteQuoteRequest) (*RouteQuoteResponse, error)
+	PlanExecution(context.Context, *ExecutionRequest) (*ExecutionResponse, error)
+	GetConsolidatedOrderbook(context.Context, *OrderbookRequest) (*ConsolidatedOrderbookResponse, error)
+	// Prices a market operation against the consolidated book as if it were a single book
+	QuoteConsolidated(context.Context, *ConsolidatedQuoteRequest) (*ConsolidatedQuoteResponse, error)
+	// Only served for the markets with a level 3 book
+	GetOrderbookL3(context.Context, *OrderbookL3Request) (*OrderbookL3Response, error)
+	GetQueuePosition(context.Context, *QueuePositionRequest) (*QueuePositionResponse, error)
+	GetLastTrade(context.Context, *TradesRequest) (*LastTradeResponse, error)
+	GetRecentTrades(context.Context, *TradesRequest) (*TradesResponse, error)
+	GetTradeStats(context.Context, *TradeStatsRequest) (*TradeStatsResponse, error)
+	GetCandles(context.Context, *CandlesRequest) (*CandlesResponse, error)
+	// Sends every candle of the requested intervals as it closes
+	StreamCandles(*CandlesStreamRequest, OrderbookServiceV2_StreamCandlesServer) error
+	mustEmbedUnimplementedOrderbookServiceV2Server()
+}
+
+// UnimplementedOrderbookServiceV2Server must be embedded to have forward compatible implementations.
+type UnimplementedOrderbookServiceV2Server struct {
+}
+
+func (UnimplementedOrderbookServiceV2Server) BuyBase(context.Context, *QuoteRequest) (*QuoteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BuyBase not implemented")
+}
+func (UnimplementedOrderbookServiceV2Server) BuyQuote(context.Context, *QuoteRequest) (*QuoteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BuyQuote not implemented")
+}
+func (UnimplementedOrderbookServiceV2Server) SellBase(context.Context, *QuoteRequest) (*QuoteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SellBase not implemented")
+}
+func (UnimplementedOrderbookServiceV2Server) SellQuote(context.Context, *QuoteRequest) (*QuoteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SellQuote not implemented")
+}
+func (UnimplementedOrderbookServiceV2Server) StreamTopOfBook(*TopOfBookRequest, OrderbookServiceV2_StreamTopOfBookServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamTopOfBook not implemented")
+}
+func (UnimplementedOrderbookServiceV2Server) GetOrderbook(context.Context, *OrderbookRequest) (*OrderbookResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetOrderbook not implemented")
+}
+func (UnimplementedOrderbookServiceV2Server) BatchQuote(context.Context, *BatchQuoteRequest) (*BatchQuoteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BatchQuote not implemented")
+}
+func (UnimplementedOrderbookServiceV2Server) GetLiquidityCurve(context.Context, *LiquidityCurveRequest) (*LiquidityCurveResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetLiquidityCurve not implemented")
+}
+func (UnimplementedOrderbookServiceV2Server) GetMaxFillable(context.Context, *MaxFillableRequest) (*MaxFillableResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetMaxFillable not implemented")
+}
+func (UnimplementedOrderbookServiceV2Server) QuoteRoute(context.Context, *RouteQuoteRequest) (*RouteQuoteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method QuoteRoute not implemented")
+}
+func (UnimplementedOrderbookServiceV2Server) PlanExecution(context.Context, *ExecutionRequest) (*ExecutionResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PlanExecution not implemented")
+}
+func (UnimplementedOrderbookServiceV2Server) GetConsolidatedOrderbook(context.Context, *OrderbookRequest) (*ConsolidatedOrderbookResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetConsolidatedOrderbook not implemented")
+}
+func (UnimplementedOrderbookServiceV2Server) QuoteConsolidated(context.Context, *ConsolidatedQuoteRequest) (*ConsolidatedQuoteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method QuoteConsolidated not implemented")
+}
+func (UnimplementedOrderbookServiceV2Server) GetOrderbookL3(context.Context, *OrderbookL3Request) (*OrderbookL3Response, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetOrderbookL3 not implemented")
+}
+func (UnimplementedOrderbookServiceV2Server) GetQueuePosition(context.Context, *QueuePositionRequest) (*QueuePositionResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetQueuePosition not implemented")
+}
+func (UnimplementedOrderbookServiceV2Server) GetLastTrade(context.Context, *TradesRequest) (*LastTradeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetLastTrade not implemented")
+}
+func (UnimplementedOrderbookServiceV2Server) GetRecentTrades(context.Context, *TradesRequest) (*TradesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetRecentTrades not implemented")
+}
+func (UnimplementedOrderbookServiceV2Server) GetTradeStats(context.Context, *TradeStatsRequest) (*TradeStatsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetTradeStats not implemented")
+}
+func (UnimplementedOrderbookServiceV2Server) GetCandles(context.Context, *CandlesRequest) (*CandlesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetCandles not implemented")
+}
+func (UnimplementedOrderbookServiceV2Server) StreamCandles(*CandlesStreamRequest, OrderbookServiceV2_StreamCandlesServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamCandles not implemented")
+}
+func (UnimplementedOrderbookServiceV2Server) mustEmbedUnimplementedOrderbookServiceV2Server() {}
+
+// UnsafeOrderbookServiceV2Server may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to OrderbookServiceV2Server will
+// result in compilation errors.
+type UnsafeOrderbookServiceV2Server interface {
+	mustEmbedUnimplementedOrderbookServiceV2Server()
+}
+
+func RegisterOrderbookServiceV2Server(s *grpc.Server, srv OrderbookServiceV2Server) {
+	s.RegisterService(&_OrderbookServiceV2_serviceDesc, srv)
+}
+
+func _OrderbookServiceV2_BuyBase_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(QuoteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OrderbookServiceV2Server).BuyBase(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/OrderbookServiceV2/BuyBase",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OrderbookServiceV2Server).BuyBase(ctx, req.(*QuoteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OrderbookServiceV2_BuyQuote_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(QuoteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OrderbookServiceV2Server).BuyQuote(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/OrderbookServiceV2/BuyQuote",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OrderbookServiceV2Server).BuyQuote(ctx, req.(*QuoteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OrderbookServiceV2_SellBase_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(QuoteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OrderbookServiceV2Server).SellBase(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/OrderbookServiceV2/SellBase",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OrderbookServiceV2Server).SellBase(ctx, req.(*QuoteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OrderbookServiceV2_SellQuote_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(QuoteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OrderbookServiceV2Server).SellQuote(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/OrderbookServiceV2/SellQuote",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OrderbookServiceV2Server).SellQuote(ctx, req.(*QuoteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OrderbookServiceV2_StreamTopOfBook_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(TopOfBookRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(OrderbookServiceV2Server).StreamTopOfBook(m, &orderbookServiceV2StreamTopOfBookServer{stream})
+}
+
+type OrderbookServiceV2_StreamTopOfBookServer interface {
+	Send(*TopOfBookResponse) error
+	grpc.ServerStream
+}
+
+type orderbookServiceV2StreamTopOfBookServer struct {
+	grpc.ServerStream
+}
+
+func (x *orderbookServiceV2StreamTopOfBookServer) Send(m *TopOfBookResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _OrderbookServiceV2_GetOrderbook_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(OrderbookRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OrderbookServiceV2Server).GetOrderbook(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/OrderbookServiceV2/GetOrderbook",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OrderbookServiceV2Server).GetOrderbook(ctx, req.(*OrderbookRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OrderbookServiceV2_BatchQuote_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BatchQuoteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OrderbookServiceV2Server).BatchQuote(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/OrderbookServiceV2/BatchQuote",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OrderbookServiceV2Server).BatchQuote(ctx, req.(*BatchQuoteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OrderbookServiceV2_GetLiquidityCurve_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LiquidityCurveRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OrderbookServiceV2Server).GetLiquidityCurve(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/OrderbookServiceV2/GetLiquidityCurve",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OrderbookServiceV2Server).GetLiquidityCurve(ctx, req.(*LiquidityCurveRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OrderbookServiceV2_GetMaxFillable_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MaxFillableRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OrderbookServiceV2Server).GetMaxFillable(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/OrderbookServiceV2/GetMaxFillable",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OrderbookServiceV2Server).GetMaxFillable(ctx, req.(*MaxFillableRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OrderbookServiceV2_QuoteRoute_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RouteQuoteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OrderbookServiceV2Server).QuoteRoute(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/OrderbookServiceV2/QuoteRoute",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OrderbookServiceV2Server).QuoteRoute(ctx, req.(*RouteQuoteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OrderbookServiceV2_PlanExecution_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ExecutionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OrderbookServiceV2Server).PlanExecution(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/OrderbookServiceV2/PlanExecution",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OrderbookServiceV2Server).PlanExecution(ctx, req.(*ExecutionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OrderbookServiceV2_GetConsolidatedOrderbook_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(OrderbookRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OrderbookServiceV2Server).GetConsolidatedOrderbook(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/OrderbookServiceV2/GetConsolidatedOrderbook",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OrderbookServiceV2Server).GetConsolidatedOrderbook(ctx, req.(*OrderbookRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OrderbookServiceV2_QuoteConsolidated_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ConsolidatedQuoteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OrderbookServiceV2Server).QuoteConsolidated(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/OrderbookServiceV2/QuoteConsolidated",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OrderbookServiceV2Server).QuoteConsolidated(ctx, req.(*ConsolidatedQuoteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OrderbookServiceV2_GetOrderbookL3_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(OrderbookL3Request)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OrderbookServiceV2Server).GetOrderbookL3(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/OrderbookServiceV2/GetOrderbookL3",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OrderbookServiceV2Server).GetOrderbookL3(ctx, req.(*OrderbookL3Request))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OrderbookServiceV2_GetQueuePosition_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(QueuePositionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OrderbookServiceV2Server).GetQueuePosition(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/OrderbookServiceV2/GetQueuePosition",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OrderbookServiceV2Server).GetQueuePosition(ctx, req.(*QueuePositionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OrderbookServiceV2_GetLastTrade_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TradesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OrderbookServiceV2Server).GetLastTrade(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/OrderbookServiceV2/GetLastTrade",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OrderbookServiceV2Server).GetLastTrade(ctx, req.(*TradesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OrderbookServiceV2_GetRecentTrades_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TradesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OrderbookServiceV2Server).GetRecentTrades(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/OrderbookServiceV2/GetRecentTrades",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OrderbookServiceV2Server).GetRecentTrades(ctx, req.(*TradesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OrderbookServiceV2_GetTradeStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TradeStatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OrderbookServiceV2Server).GetTradeStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/OrderbookServiceV2/GetTradeStats",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OrderbookServiceV2Server).GetTradeStats(ctx, req.(*TradeStatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OrderbookServiceV2_GetCandles_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CandlesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OrderbookServiceV2Server).GetCandles(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/OrderbookServiceV2/GetCandles",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OrderbookServiceV2Server).GetCandles(ctx, req.(*CandlesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _OrderbookServiceV2_StreamCandles_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(CandlesStreamRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(OrderbookServiceV2Server).StreamCandles(m, &orderbookServiceV2StreamCandlesServer{stream})
+}
+
+type OrderbookServiceV2_StreamCandlesServer interface {
+	Send(*Candle) error
+	grpc.ServerStream
+}
+
+type orderbookServiceV2StreamCandlesServer struct {
+	grpc.ServerStream
+}
+
+func (x *orderbookServiceV2StreamCandlesServer) Send(m *Candle) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+var _OrderbookServiceV2_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "OrderbookServiceV2",
+	HandlerType: (*OrderbookServiceV2Server)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "BuyBase",
+			Handler:    _OrderbookServiceV2_BuyBase_Handler,
+		},
+		{
+			MethodName: "BuyQuote",
+			Handler:    _OrderbookServiceV2_BuyQuote_Handler,
+		},
+		{
+			MethodName: "SellBase",
+			Handler:    _OrderbookServiceV2_SellBase_Handler,
+		},
+		{
+			MethodName: "SellQuote",
+			Handler:    _OrderbookServiceV2_SellQuote_Handler,
+		},
+		{
+			MethodName: "GetOrderbook",
+			Handler:    _OrderbookServiceV2_GetOrderbook_Handler,
+		},
+		{
+			MethodName: "BatchQuote",
+			Handler:    _OrderbookServiceV2_BatchQuote_Handler,
+		},
+		{
+			MethodName: "GetLiquidityCurve",
+			Handler:    _OrderbookServiceV2_GetLiquidityCurve_Handler,
+		},
+		{
+			MethodName: "GetMaxFillable",
+			Handler:    _OrderbookServiceV2_GetMaxFillable_Handler,
+		},
+		{
+			MethodName: "QuoteRoute",
+			Handler:    _OrderbookServiceV2_QuoteRoute_Handler,
+		},
+		{
+			MethodName: "PlanExecution",
+			Handler:    _OrderbookServiceV2_PlanExecution_Handler,
+		},
+		{
+			MethodName: "GetConsolidatedOrderbook",
+			Handler:    _OrderbookServiceV2_GetConsolidatedOrderbook_Handler,
+		},
+		{
+			MethodName: "QuoteConsolidated",
+			Handler:    _OrderbookServiceV2_QuoteConsolidated_Handler,
+		},
+		{
+			MethodName: "GetOrderbookL3",
+			Handler:    _OrderbookServiceV2_GetOrderbookL3_Handler,
+		},
+		{
+			MethodName: "GetQueuePosition",
+			Handler:    _OrderbookServiceV2_GetQueuePosition_Handler,
+		},
+		{
+			MethodName: "GetLastTrade",
+			Handler:    _OrderbookServiceV2_GetLastTrade_Handler,
+		},
+		{
+			MethodName: "GetRecentTrades",
+			Handler:    _OrderbookServiceV2_GetRecentTrades_Handler,
+		},
+		{
+			MethodName: "GetTradeStats",
+			Handler:    _OrderbookServiceV2_GetTradeStats_Handler,
+		},
+		{
+			MethodName: "GetCandles",
+			Handler:    _OrderbookServiceV2_GetCandles_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamTopOfBook",
+			Handler:       _OrderbookServiceV2_StreamTopOfBook_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "StreamCandles",
+			Handler:       _OrderbookServiceV2_StreamCandles_Handler,
+			ServerStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "service.proto",
 }